@@ -12,6 +12,7 @@ type NodeType string
 const (
 	ProgramNode        NodeType = "Program"
 	NumericLiteralNode NodeType = "NumericLiteral"
+	IntegerLiteralNode NodeType = "IntegerLiteral"
 	IdentifierNode     NodeType = "Identifier"
 	BinaryExprNode     NodeType = "BinaryExpr"
 	VarDeclarationNode NodeType = "VarDeclaration"
@@ -19,25 +20,41 @@ const (
 	StringLiteralNode  NodeType = "StringLiteral"
 	IfStatementNode    NodeType = "IfStatement"
 	ForStatementNode   NodeType = "ForStatement"
+	ForInStatementNode NodeType = "ForInStatement"
+	ForClauseStatementNode NodeType = "ForClauseStatement"
 	WhileStatementNode NodeType = "WhileStatement"
+	DoWhileStatementNode NodeType = "DoWhileStatement"
 	BlockStatementNode NodeType = "BlockStatement"
 	AssignmentExprNode NodeType = "AssignmentExpr"
 	BooleanLiteralNode NodeType = "BooleanLiteral"
 	ArrayLiteralNode   NodeType = "ArrayLiteral"
 	MapLiteralNode     NodeType = "MapLiteral"
 	MemberExprNode     NodeType = "MemberExpr"
+	IndexExprNode      NodeType = "IndexExpr"
 	ImportStatementNode NodeType = "ImportStatement"
 	FunctionDeclarationNode NodeType = "FunctionDeclaration"
 	ReturnStatementNode    NodeType = "ReturnStatement"
 	UnaryExprNode          NodeType = "UnaryExpr"
 	TryStatementNode       NodeType = "TryStatement"
 	CatchStatementNode     NodeType = "CatchStatement"
+	ThrowStatementNode     NodeType = "ThrowStatement"
 	BreakStatementNode     NodeType = "BreakStatement"
 	ContinueStatementNode  NodeType = "ContinueStatement"
+	SwitchStatementNode    NodeType = "SwitchStatement"
+	NullLiteralNode        NodeType = "NullLiteral"
 )
 
+// Position is the source location a node starts at.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) Pos() Position { return p }
+
 type Stmt interface {
 	Kind() NodeType
+	Pos() Position
 }
 
 type Expr interface {
@@ -46,11 +63,15 @@ type Expr interface {
 }
 
 type Program struct {
-	Body []Stmt
+	Position
+	Body    []Stmt
+	File    string   // source file name, if known
+	Exports []string // names declared with export, the members of the module the file is imported as
 }
 func (p *Program) Kind() NodeType { return ProgramNode }
 
 type BinaryExpr struct {
+	Position
 	Left     Expr
 	Right    Expr
 	Operator string
@@ -59,32 +80,64 @@ func (b *BinaryExpr) Kind() NodeType { return BinaryExprNode }
 func (b *BinaryExpr) exprNode()      {}
 
 type Identifier struct {
+	Position
 	Symbol string
 }
 func (i *Identifier) Kind() NodeType { return IdentifierNode }
 func (i *Identifier) exprNode()      {}
 
 type NumericLiteral struct {
+	Position
 	Value float64
 }
 func (n *NumericLiteral) Kind() NodeType { return NumericLiteralNode }
 func (n *NumericLiteral) exprNode()      {}
 
+// IntegerLiteral -> number written without a decimal point that fits in an int64
+type IntegerLiteral struct {
+	Position
+	Value int64
+}
+func (n *IntegerLiteral) Kind() NodeType { return IntegerLiteralNode }
+func (n *IntegerLiteral) exprNode()      {}
+
 type StringLiteral struct {
+	Position
 	Value string
 }
 func (s *StringLiteral) Kind() NodeType { return StringLiteralNode }
 func (s *StringLiteral) exprNode()      {}
 
+// DeclKind -> binding kind of a declaration: let and const are immutable, var is not
+type DeclKind string
+
+const (
+	LetDecl   DeclKind = "let"
+	VarDecl   DeclKind = "var"
+	ConstDecl DeclKind = "const"
+)
+
+func (k DeclKind) Mutable() bool { return k == VarDecl }
+
+// ImmutableMessage -> error text for a write to a let/const binding
+func ImmutableMessage(name string, kind DeclKind) string {
+	if kind == LetDecl {
+		return fmt.Sprintf("Cannot assign to immutable variable '%s' declared with let; use var for a mutable binding.", name)
+	}
+	return fmt.Sprintf("Cannot assign to constant variable '%s'.", name)
+}
+
 type VarDeclaration struct {
+	Position
 	Identifier string
 	Value      Expr
-	Constant   bool
+	DeclKind   DeclKind
 }
 func (v *VarDeclaration) Kind() NodeType { return VarDeclarationNode }
 func (v *VarDeclaration) exprNode()      {}
 
 type CallExpr struct {
+	Position
 	Callee Expr
 	Args   []Expr
 }
@@ -92,85 +145,154 @@ func (c *CallExpr) Kind() NodeType { return CallExprNode }
 func (c *CallExpr) exprNode()      {}
 
 type MemberExpr struct {
+	Position
 	Object   Expr
 	Property *Identifier
+	Optional bool // obj?.prop -> null when obj is null
 }
 func (m *MemberExpr) Kind() NodeType { return MemberExprNode }
 func (m *MemberExpr) exprNode()      {}
 
+// Index expression: arr[i], m["key"]
+type IndexExpr struct {
+	Position
+	Object   Expr
+	Index    Expr
+	Optional bool // obj?.[index] -> null when obj is null
+}
+func (ie *IndexExpr) Kind() NodeType { return IndexExprNode }
+func (ie *IndexExpr) exprNode()      {}
+
 type BlockStatement struct {
+	Position
 	Statements []Stmt
 }
 func (bs *BlockStatement) Kind() NodeType { return BlockStatementNode }
 
 type IfStatement struct {
+	Position
 	Condition   Expr
 	Consequence *BlockStatement
 	Alternative *BlockStatement
 }
 func (is *IfStatement) Kind() NodeType { return IfStatementNode }
 
+// ForStatement -> for range(i, end) / for range(i, start, end, step)
 type ForStatement struct {
+	Position
 	Identifier *Identifier
-	Range      Expr
+	Start      Expr // nil -> 0
+	Range      Expr // end, exclusive
+	Step       Expr // nil -> 1
 	Body       *BlockStatement
+	Label      string // "" when the loop is not labeled
 }
 func (fs *ForStatement) Kind() NodeType { return ForStatementNode }
 
+// ForInStatement -> for x in collection / for k, v in collection
+type ForInStatement struct {
+	Position
+	Key        *Identifier // nil in the single-variable form
+	Value      *Identifier // element or character; a map's key in the single-variable form
+	Collection Expr
+	Body       *BlockStatement
+	Label      string
+}
+func (fs *ForInStatement) Kind() NodeType { return ForInStatementNode }
+
+// ForClauseStatement -> for (init; condition; post), any clause may be empty
+type ForClauseStatement struct {
+	Position
+	Init      Stmt
+	Condition Expr
+	Post      Expr
+	Body      *BlockStatement
+	Label     string
+}
+func (fs *ForClauseStatement) Kind() NodeType { return ForClauseStatementNode }
+
 type WhileStatement struct {
+	Position
 	Condition Expr
 	Body      *BlockStatement
+	Label     string
 }
 func (ws *WhileStatement) Kind() NodeType { return WhileStatementNode }
 
+// DoWhileStatement -> do { } while (cond), the body runs before the first test
+type DoWhileStatement struct {
+	Position
+	Body      *BlockStatement
+	Condition Expr
+	Label     string
+}
+func (ds *DoWhileStatement) Kind() NodeType { return DoWhileStatementNode }
+
 type AssignmentExpr struct {
+	Position
 	Assignee Expr
 	Value    Expr
+	Operator string // "" for plain =, else the arithmetic operator of a compound form (+ for +=)
 }
 func (a *AssignmentExpr) Kind() NodeType { return AssignmentExprNode }
 func (a *AssignmentExpr) exprNode()      {}
 
 type BooleanLiteral struct {
+	Position
 	Value bool
 }
 func (b *BooleanLiteral) Kind() NodeType { return BooleanLiteralNode }
 func (b *BooleanLiteral) exprNode()      {}
 
+type NullLiteral struct {
+	Position
+}
+func (n *NullLiteral) Kind() NodeType { return NullLiteralNode }
+func (n *NullLiteral) exprNode()      {}
+
 type ArrayLiteral struct {
+	Position
 	Elements []Expr
 }
 func (a *ArrayLiteral) Kind() NodeType { return ArrayLiteralNode }
 func (a *ArrayLiteral) exprNode()      {}
 
 type MapLiteral struct {
+	Position
 	Properties []*Property
 }
 func (m *MapLiteral) Kind() NodeType { return MapLiteralNode }
 func (m *MapLiteral) exprNode()      {}
 
 type ImportStatement struct {
+	Position
 	Path  string
 	Alias string
+	File  string // source file name, if known; relative module paths start from its directory
 }
 func (is *ImportStatement) Kind() NodeType { return ImportStatementNode }
 
 // Function Declaration: funct name(a, b) { ... }
 type FunctionDeclaration struct {
+	Position
 	Name   string
 	Params []string
 	Body   *BlockStatement
+	File   string // source file name, if known
 }
 func (fd *FunctionDeclaration) Kind() NodeType { return FunctionDeclarationNode }
 func (fd *FunctionDeclaration) exprNode()      {}
 
 // Return Statement: return expr
 type ReturnStatement struct {
+	Position
 	Value Expr
 }
 func (rs *ReturnStatement) Kind() NodeType { return ReturnStatementNode }
 
 // Unary expressions: ++x, --x, x++, x--
 type UnaryExpr struct {
+	Position
 	Operand  Expr
 	Operator string
 	Prefix   bool // true for ++x, false for x++
@@ -178,33 +300,74 @@ type UnaryExpr struct {
 func (u *UnaryExpr) Kind() NodeType { return UnaryExprNode }
 func (u *UnaryExpr) exprNode()      {}
 
-// Try-catch statement: try { ... } catch(e) { ... }
+// Try statement: try { ... } catch(e) { ... } finally { ... }
+// CatchBlock or FinallyBlock may be nil, but not both.
 type TryStatement struct {
-	TryBlock   *BlockStatement
-	CatchBlock *BlockStatement
-	ErrorVar   string
+	Position
+	TryBlock     *BlockStatement
+	CatchBlock   *BlockStatement
+	ErrorVar     string
+	FinallyBlock *BlockStatement
 }
 func (ts *TryStatement) Kind() NodeType { return TryStatementNode }
 
+// Throw statement: throw expr
+type ThrowStatement struct {
+	Position
+	Value Expr
+}
+func (ts *ThrowStatement) Kind() NodeType { return ThrowStatementNode }
+
 // Break statement
-type BreakStatement struct{}
+type BreakStatement struct {
+	Position
+	Label string // "" -> innermost loop or switch
+}
 func (bs *BreakStatement) Kind() NodeType { return BreakStatementNode }
 
 // Continue statement
-type ContinueStatement struct{}
+type ContinueStatement struct {
+	Position
+	Label string // "" -> innermost loop
+}
 func (cs *ContinueStatement) Kind() NodeType { return ContinueStatementNode }
 
+// Switch statement: switch (expr) { case a, b: ... default: ... }
+type SwitchStatement struct {
+	Position
+	Discriminant Expr
+	Cases        []*SwitchCase
+}
+func (ss *SwitchStatement) Kind() NodeType { return SwitchStatementNode }
+
+// SwitchCase -> one case clause; Values is empty for default
+type SwitchCase struct {
+	Position
+	Values []Expr
+	Body   *BlockStatement
+}
+
 type Property struct {
 	Key   Expr
 	Value Expr
 }
 
+// labelPrefix -> "name: " ahead of a labeled loop
+func labelPrefix(label string) string {
+	if label == "" {
+		return ""
+	}
+	return label + ": "
+}
+
 func PrettyPrint(e Stmt) string {
 	start := time.Now()
 	var result string
 	switch node := e.(type) {
 	case *NumericLiteral:
 		result = fmt.Sprintf("%v", node.Value)
+	case *IntegerLiteral:
+		result = fmt.Sprintf("%d", node.Value)
 	case *Identifier:
 		result = node.Symbol
 	case *StringLiteral:
@@ -241,31 +404,81 @@ func PrettyPrint(e Stmt) string {
 		result = out.String()
 	case *VarDeclaration:
 		var out bytes.Buffer
-		if node.Constant {
-			out.WriteString("const ")
-		} else {
-			out.WriteString("let ")
-		}
+		out.WriteString(string(node.DeclKind))
+		out.WriteString(" ")
 		out.WriteString(node.Identifier)
 		out.WriteString(" = ")
 		out.WriteString(PrettyPrint(node.Value))
 		result = out.String()
 	case *ForStatement:
 		var out bytes.Buffer
+		out.WriteString(labelPrefix(node.Label))
 		out.WriteString("for ")
 		out.WriteString(PrettyPrint(node.Identifier))
 		out.WriteString(" in ")
-		out.WriteString(PrettyPrint(node.Range))
+		if node.Start == nil && node.Step == nil {
+			out.WriteString(PrettyPrint(node.Range))
+		} else {
+			bounds := []string{"0", PrettyPrint(node.Range), "1"}
+			if node.Start != nil {
+				bounds[0] = PrettyPrint(node.Start)
+			}
+			if node.Step != nil {
+				bounds[2] = PrettyPrint(node.Step)
+			}
+			out.WriteString("range(" + strings.Join(bounds, ", ") + ")")
+		}
 		out.WriteString(" ")
 		out.WriteString(PrettyPrint(node.Body))
 		result = out.String()
+	case *ForInStatement:
+		var out bytes.Buffer
+		out.WriteString(labelPrefix(node.Label))
+		out.WriteString("for ")
+		if node.Key != nil {
+			out.WriteString(PrettyPrint(node.Key))
+			out.WriteString(", ")
+		}
+		out.WriteString(PrettyPrint(node.Value))
+		out.WriteString(" in ")
+		out.WriteString(PrettyPrint(node.Collection))
+		out.WriteString(" ")
+		out.WriteString(PrettyPrint(node.Body))
+		result = out.String()
+	case *ForClauseStatement:
+		var out bytes.Buffer
+		out.WriteString(labelPrefix(node.Label))
+		out.WriteString("for (")
+		if node.Init != nil {
+			out.WriteString(PrettyPrint(node.Init))
+		}
+		out.WriteString("; ")
+		if node.Condition != nil {
+			out.WriteString(PrettyPrint(node.Condition))
+		}
+		out.WriteString("; ")
+		if node.Post != nil {
+			out.WriteString(PrettyPrint(node.Post))
+		}
+		out.WriteString(") ")
+		out.WriteString(PrettyPrint(node.Body))
+		result = out.String()
 	case *WhileStatement:
 		var out bytes.Buffer
+		out.WriteString(labelPrefix(node.Label))
 		out.WriteString("while ")
 		out.WriteString(PrettyPrint(node.Condition))
 		out.WriteString(" ")
 		out.WriteString(PrettyPrint(node.Body))
 		result = out.String()
+	case *DoWhileStatement:
+		var out bytes.Buffer
+		out.WriteString(labelPrefix(node.Label))
+		out.WriteString("do ")
+		out.WriteString(PrettyPrint(node.Body))
+		out.WriteString(" while ")
+		out.WriteString(PrettyPrint(node.Condition))
+		result = out.String()
 	case *CallExpr:
 		var out bytes.Buffer
 		args := []string{}
@@ -278,13 +491,25 @@ func PrettyPrint(e Stmt) string {
 		out.WriteString(")")
 		result = out.String()
 	case *MemberExpr:
-		result = fmt.Sprintf("%s.%s", PrettyPrint(node.Object), node.Property.Symbol)
+		if node.Optional {
+			result = fmt.Sprintf("%s?.%s", PrettyPrint(node.Object), node.Property.Symbol)
+		} else {
+			result = fmt.Sprintf("%s.%s", PrettyPrint(node.Object), node.Property.Symbol)
+		}
+	case *IndexExpr:
+		if node.Optional {
+			result = fmt.Sprintf("%s?.[%s]", PrettyPrint(node.Object), PrettyPrint(node.Index))
+		} else {
+			result = fmt.Sprintf("%s[%s]", PrettyPrint(node.Object), PrettyPrint(node.Index))
+		}
+	case *NullLiteral:
+		result = "null"
 	case *ImportStatement:
 		result = fmt.Sprintf("import \"%s\" as %s", node.Path, node.Alias)
 	case *AssignmentExpr:
 		var out bytes.Buffer
 		out.WriteString(PrettyPrint(node.Assignee))
-		out.WriteString(" = ")
+		out.WriteString(" " + node.Operator + "= ")
 		out.WriteString(PrettyPrint(node.Value))
 		result = out.String()
 	case *BooleanLiteral:
@@ -330,15 +555,42 @@ case *MapLiteral:
 		var out bytes.Buffer
 		out.WriteString("try ")
 		out.WriteString(PrettyPrint(node.TryBlock))
-		out.WriteString(" catch(")
-		out.WriteString(node.ErrorVar)
-		out.WriteString(") ")
-		out.WriteString(PrettyPrint(node.CatchBlock))
+		if node.CatchBlock != nil {
+			out.WriteString(" catch(")
+			out.WriteString(node.ErrorVar)
+			out.WriteString(") ")
+			out.WriteString(PrettyPrint(node.CatchBlock))
+		}
+		if node.FinallyBlock != nil {
+			out.WriteString(" finally ")
+			out.WriteString(PrettyPrint(node.FinallyBlock))
+		}
 		result = out.String()
+	case *ThrowStatement:
+		result = fmt.Sprintf("throw %s", PrettyPrint(node.Value))
 	case *BreakStatement:
-		result = "break"
+		result = strings.TrimSpace("break " + node.Label)
 	case *ContinueStatement:
-		result = "continue"
+		result = strings.TrimSpace("continue " + node.Label)
+	case *SwitchStatement:
+		var out bytes.Buffer
+		out.WriteString("switch ")
+		out.WriteString(PrettyPrint(node.Discriminant))
+		out.WriteString(" {")
+		for _, c := range node.Cases {
+			if len(c.Values) == 0 {
+				out.WriteString(" default: ")
+			} else {
+				values := make([]string, len(c.Values))
+				for i, v := range c.Values {
+					values[i] = PrettyPrint(v)
+				}
+				out.WriteString(" case " + strings.Join(values, ", ") + ": ")
+			}
+			out.WriteString(PrettyPrint(c.Body))
+		}
+		out.WriteString(" }")
+		result = out.String()
 	default:
 		result = fmt.Sprintf("Unknown statement type: %T", e)
 	}
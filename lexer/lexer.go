@@ -2,7 +2,6 @@ package lexer
 
 import (
 	"fmt"
-	"os"
 	"unicode"
 )
 
@@ -22,17 +21,26 @@ const (
 	Else
 	For
 	While
+	Do
 	ForRange
+	In
 	True
 	False
+	Null
 	Import
 	As
 	Funct
 	Return
 	Try
 	Catch
+	Finally
+	Throw
 	Break
 	Continue
+	Switch
+	Case
+	Default
+	Export
 
 	// Grouping * Operators
 	BinaryOperator
@@ -40,8 +48,11 @@ const (
 	Increment
 	Decrement
 	Equals
+	CompoundAssign
 	ComparisonOperator
 	LogicalOperator
+	Not
+	QuestionDot
 	OpenParen
 	CloseParen
 	OpenBrace
@@ -50,6 +61,7 @@ const (
 	CloseBracket
 	Colon
 	Comma
+	Semicolon
 	Dot
 )
 
@@ -76,12 +88,18 @@ func (t TokenType) String() string {
 		return "For"
 	case While:
 		return "While"
+	case Do:
+		return "Do"
 	case ForRange:
 		return "ForRange"
+	case In:
+		return "In"
 	case True:
 		return "True"
 	case False:
 		return "False"
+	case Null:
+		return "Null"
 	case BinaryOperator:
 		return "BinaryOperator"
 	case Modulo:
@@ -92,10 +110,16 @@ func (t TokenType) String() string {
 		return "Decrement"
 	case Equals:
 		return "Equals"
+	case CompoundAssign:
+		return "CompoundAssign"
 	case ComparisonOperator:
 		return "ComparisonOperator"
 	case LogicalOperator:
 		return "LogicalOperator"
+	case Not:
+		return "Not"
+	case QuestionDot:
+		return "QuestionDot"
 	case OpenParen:
 		return "OpenParen"
 	case CloseParen:
@@ -112,6 +136,8 @@ func (t TokenType) String() string {
 		return "Colon"
 	case Comma:
 		return "Comma"
+	case Semicolon:
+		return "Semicolon"
 	case Dot:
 		return "Dot"
 	case Import:
@@ -126,10 +152,22 @@ func (t TokenType) String() string {
 		return "Try"
 	case Catch:
 		return "Catch"
+	case Finally:
+		return "Finally"
+	case Throw:
+		return "Throw"
 	case Break:
 		return "Break"
 	case Continue:
 		return "Continue"
+	case Switch:
+		return "Switch"
+	case Case:
+		return "Case"
+	case Default:
+		return "Default"
+	case Export:
+		return "Export"
 	default:
 		return "Unknown"
 	}
@@ -156,17 +194,27 @@ var keywords = map[string]TokenType{
 	"else":      Else,
 	"for":       For,
 	"while":     While,
+	"do":        Do,
 	"for range": ForRange,
+	"in":        In,
 	"true":      True,
 	"false":     False,
+	"null":      Null,
 	"import":    Import,
 	"as":        As,
 	"funct":     Funct,
 	"return":    Return,
 	"try":       Try,
 	"catch":     Catch,
+	"finally":   Finally,
+	"throw":     Throw,
 	"break":     Break,
 	"continue":  Continue,
+	"switch":    Switch,
+	"case":      Case,
+	"default":   Default,
+	"export":    Export,
+	"div":       BinaryOperator, // floor division: a div b
 }
 
 func isAlpha(ch rune) bool {
@@ -182,8 +230,23 @@ func isInt(ch rune) bool {
 	return unicode.IsDigit(ch)
 }
 
+// Error -> source that cannot be tokenized at Line, Column; Message does not repeat the position
+type Error struct {
+	Message string
+	Line    int
+	Column  int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at line %d, column %d", e.Message, e.Line, e.Column)
+}
+
+func newError(message string, line, column int) *Error {
+	return &Error{Message: message, Line: line, Column: column}
+}
+
 // Tokenizer
-func Tokenize(sourceCode string) []Token {
+func Tokenize(sourceCode string) ([]Token, *Error) {
 	var tokens []Token
 	src := []rune(sourceCode)
 	line := 1
@@ -194,17 +257,25 @@ func Tokenize(sourceCode string) []Token {
 
 		// Single-char tokens
 		if ch == '"' {
+			startLine, startCol := line, col
 			src = src[1:] // consume "
 			col++
 			str := ""
 			for len(src) > 0 && src[0] != '"' {
+				if src[0] == '\n' {
+					line++
+					col = 0
+				}
 				str += string(src[0])
 				src = src[1:]
 				col++
 			}
+			if len(src) == 0 {
+				return nil, newError("Unterminated string", startLine, startCol)
+			}
 			src = src[1:] // consume "
 			col++
-			tokens = append(tokens, token(str, String, line, col-len(str)-2))
+			tokens = append(tokens, token(str, String, startLine, startCol))
 		} else if ch == '(' {
 			tokens = append(tokens, token(string(ch), OpenParen, line, col))
 			src = src[1:]
@@ -237,10 +308,18 @@ func Tokenize(sourceCode string) []Token {
 			tokens = append(tokens, token(string(ch), Comma, line, col))
 			src = src[1:]
 			col++
+		} else if ch == ';' {
+			tokens = append(tokens, token(string(ch), Semicolon, line, col))
+			src = src[1:]
+			col++
 		} else if ch == '.' {
 			tokens = append(tokens, token(string(ch), Dot, line, col))
 			src = src[1:]
 			col++
+		} else if (ch == '+' || ch == '-' || ch == '*' || ch == '/' || ch == '%') && len(src) > 1 && src[1] == '=' {
+			tokens = append(tokens, token(string(ch)+"=", CompoundAssign, line, col))
+			src = src[2:]
+			col += 2
 		} else if ch == '%' {
 			tokens = append(tokens, token(string(ch), Modulo, line, col))
 			src = src[1:]
@@ -292,7 +371,19 @@ func Tokenize(sourceCode string) []Token {
 				tokens = append(tokens, token("!=", ComparisonOperator, line, col))
 				src = src[2:]
 				col += 2
+			} else {
+				tokens = append(tokens, token(string(ch), Not, line, col))
+				src = src[1:]
+				col++
 			}
+		} else if (ch == '<' || ch == '>') && len(src) > 1 && src[1] == ch {
+			tokens = append(tokens, token(string(ch)+string(ch), BinaryOperator, line, col))
+			src = src[2:]
+			col += 2
+		} else if ch == '^' || ch == '~' {
+			tokens = append(tokens, token(string(ch), BinaryOperator, line, col))
+			src = src[1:]
+			col++
 		} else if ch == '<' {
 			if len(src) > 1 && src[1] == '=' {
 				tokens = append(tokens, token("<=", ComparisonOperator, line, col))
@@ -313,17 +404,33 @@ func Tokenize(sourceCode string) []Token {
 				src = src[1:]
 				col++
 			}
+		} else if ch == '?' && len(src) > 1 && src[1] == '?' {
+			tokens = append(tokens, token("??", LogicalOperator, line, col))
+			src = src[2:]
+			col += 2
+		} else if ch == '?' && len(src) > 1 && src[1] == '.' {
+			tokens = append(tokens, token("?.", QuestionDot, line, col))
+			src = src[2:]
+			col += 2
 		} else if ch == '&' {
 			if len(src) > 1 && src[1] == '&' {
 				tokens = append(tokens, token("&&", LogicalOperator, line, col))
 				src = src[2:]
 				col += 2
+			} else {
+				tokens = append(tokens, token("&", BinaryOperator, line, col))
+				src = src[1:]
+				col++
 			}
 		} else if ch == '|' {
 			if len(src) > 1 && src[1] == '|' {
 				tokens = append(tokens, token("||", LogicalOperator, line, col))
 				src = src[2:]
 				col += 2
+			} else {
+				tokens = append(tokens, token("|", BinaryOperator, line, col))
+				src = src[1:]
+				col++
 			}
 		} else {
 			// Multi-character tokens
@@ -335,6 +442,17 @@ func Tokenize(sourceCode string) []Token {
 					src = src[1:]
 					col++
 				}
+				// a fraction makes it a float: 1.5 (but 1.foo stays a member access)
+				if len(src) > 1 && src[0] == '.' && isInt(src[1]) {
+					num += "."
+					src = src[1:]
+					col++
+					for len(src) > 0 && isInt(src[0]) {
+						num += string(src[0])
+						src = src[1:]
+						col++
+					}
+				}
 				tokens = append(tokens, token(num, Number, line, startCol))
 			} else if isAlpha(ch) {
 				startCol := col
@@ -376,11 +494,10 @@ func Tokenize(sourceCode string) []Token {
 				}
 				src = src[1:] // skip whitespace
 			} else {
-				fmt.Fprintf(os.Stderr, "Unrecognized character: %d (%q) at line %d, column %d\n", ch, ch, line, col)
-				os.Exit(1)
+				return nil, newError(fmt.Sprintf("Unrecognized character: %d (%q)", ch, ch), line, col)
 			}
 		}
 	}
 
-	return tokens
+	return tokens, nil
 }
\ No newline at end of file
@@ -1,86 +1,65 @@
 package libraries
 
 import (
+	"DYMS/runtime"
 	"math"
 )
 
-// Define interfaces to avoid import cycles
-type RuntimeVal interface {
-	Type() string
-	String() string
+func init() {
+	runtime.RegisterModule("fmaths", fmathsModule)
 }
 
-type NumberVal struct {
-	Value float64
+// number -> value of a numeric argument; integers and numbers both count
+func number(v runtime.RuntimeVal) (float64, bool) {
+	switch n := v.(type) {
+	case *runtime.NumberVal:
+		return n.Value, true
+	case *runtime.IntVal:
+		return float64(n.Value), true
+	}
+	return 0, false
 }
 
-func (n *NumberVal) Type() string  { return "Number" }
-func (n *NumberVal) String() string { return "" }
-
-type MapVal struct {
-	Properties map[string]RuntimeVal
-}
-
-func (m *MapVal) Type() string  { return "Map" }
-func (m *MapVal) String() string { return "" }
-
-type Error struct {
-	Message string
-	Line    int
-	Column  int
-}
-
-func (e *Error) Error() string { return e.Message }
-
-func NewError(message string, line int, column int) *Error {
-	return &Error{Message: message, Line: line, Column: column}
-}
-
-type Function func(args ...RuntimeVal) (RuntimeVal, *Error)
-
-func (f Function) Type() string  { return "Function" }
-func (f Function) String() string { return "[function]" }
-
-// RegisterFMaths registers advanced mathematical functions
-func RegisterFMaths() *MapVal {
-	mathFuncs := make(map[string]RuntimeVal)
+// fmathsModule -> advanced mathematical functions and constants
+func fmathsModule(*runtime.Engine) *runtime.MapVal {
+	mathFuncs := make(map[string]runtime.RuntimeVal)
 	
 	// Basic powers and roots
-	mathFuncs["pow"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
+	mathFuncs["pow"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 2 {
-			return nil, NewError("pow requires 2 arguments", 0, 0)
+			return nil, runtime.NewError("pow requires 2 arguments", 0, 0)
 		}
-		x, ok1 := args[0].(*NumberVal)
-		y, ok2 := args[1].(*NumberVal)
+		x, ok1 := number(args[0])
+		y, ok2 := number(args[1])
 		if !ok1 || !ok2 {
-			return nil, NewError("pow requires numeric arguments", 0, 0)
+			return nil, runtime.NewError("pow requires numeric arguments", 0, 0)
 		}
-		return &NumberVal{Value: math.Pow(x.Value, y.Value)}, nil
+		return &runtime.NumberVal{Value: math.Pow(x, y)}, nil
 	})
 	
 	mathFuncs["sqrt"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("sqrt requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("sqrt requires numeric argument", 0, 0)
 		}
-		if x.Value < 0 {
+		if x < 0 {
 			return nil, runtime.NewError("sqrt of negative number", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Sqrt(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Sqrt(x)}, nil
 	})
 	
 	mathFuncs["cbrt"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("cbrt requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("cbrt requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Cbrt(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Cbrt(x)}, nil
 	})
 	
 	// Logarithmic functions
@@ -88,42 +67,42 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("log requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("log requires numeric argument", 0, 0)
 		}
-		if x.Value <= 0 {
+		if x <= 0 {
 			return nil, runtime.NewError("log of non-positive number", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Log(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Log(x)}, nil
 	})
 	
 	mathFuncs["log10"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("log10 requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("log10 requires numeric argument", 0, 0)
 		}
-		if x.Value <= 0 {
+		if x <= 0 {
 			return nil, runtime.NewError("log10 of non-positive number", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Log10(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Log10(x)}, nil
 	})
 	
 	mathFuncs["log2"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("log2 requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("log2 requires numeric argument", 0, 0)
 		}
-		if x.Value <= 0 {
+		if x <= 0 {
 			return nil, runtime.NewError("log2 of non-positive number", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Log2(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Log2(x)}, nil
 	})
 	
 	// Exponential functions
@@ -131,22 +110,22 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("exp requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("exp requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Exp(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Exp(x)}, nil
 	})
 	
 	mathFuncs["exp2"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("exp2 requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("exp2 requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Exp2(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Exp2(x)}, nil
 	})
 	
 	// Trigonometric functions
@@ -154,33 +133,33 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("sin requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("sin requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Sin(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Sin(x)}, nil
 	})
 	
 	mathFuncs["cos"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("cos requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("cos requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Cos(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Cos(x)}, nil
 	})
 	
 	mathFuncs["tan"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("tan requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("tan requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Tan(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Tan(x)}, nil
 	})
 	
 	// Inverse trigonometric functions
@@ -188,51 +167,51 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("asin requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("asin requires numeric argument", 0, 0)
 		}
-		if x.Value < -1 || x.Value > 1 {
+		if x < -1 || x > 1 {
 			return nil, runtime.NewError("asin domain error: argument must be in [-1, 1]", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Asin(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Asin(x)}, nil
 	})
 	
 	mathFuncs["acos"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("acos requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("acos requires numeric argument", 0, 0)
 		}
-		if x.Value < -1 || x.Value > 1 {
+		if x < -1 || x > 1 {
 			return nil, runtime.NewError("acos domain error: argument must be in [-1, 1]", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Acos(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Acos(x)}, nil
 	})
 	
 	mathFuncs["atan"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("atan requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("atan requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Atan(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Atan(x)}, nil
 	})
 	
 	mathFuncs["atan2"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 2 {
 			return nil, runtime.NewError("atan2 requires 2 arguments", 0, 0)
 		}
-		y, ok1 := args[0].(*runtime.NumberVal)
-		x, ok2 := args[1].(*runtime.NumberVal)
+		y, ok1 := number(args[0])
+		x, ok2 := number(args[1])
 		if !ok1 || !ok2 {
 			return nil, runtime.NewError("atan2 requires numeric arguments", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Atan2(y.Value, x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Atan2(y, x)}, nil
 	})
 	
 	// Hyperbolic functions
@@ -240,33 +219,33 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("sinh requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("sinh requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Sinh(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Sinh(x)}, nil
 	})
 	
 	mathFuncs["cosh"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("cosh requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("cosh requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Cosh(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Cosh(x)}, nil
 	})
 	
 	mathFuncs["tanh"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("tanh requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("tanh requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Tanh(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Tanh(x)}, nil
 	})
 	
 	// Utility functions
@@ -274,44 +253,44 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("abs requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("abs requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Abs(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Abs(x)}, nil
 	})
 	
 	mathFuncs["ceil"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("ceil requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("ceil requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Ceil(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Ceil(x)}, nil
 	})
 	
 	mathFuncs["floor"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("floor requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("floor requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Floor(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Floor(x)}, nil
 	})
 	
 	mathFuncs["round"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("round requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("round requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Round(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Round(x)}, nil
 	})
 	
 	mathFuncs["min"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
@@ -320,9 +299,9 @@ func RegisterFMaths() *MapVal {
 		}
 		minVal := math.Inf(1) // positive infinity
 		for _, arg := range args {
-			if num, ok := arg.(*runtime.NumberVal); ok {
-				if num.Value < minVal {
-					minVal = num.Value
+			if num, ok := number(arg); ok {
+				if num < minVal {
+					minVal = num
 				}
 			} else {
 				return nil, runtime.NewError("min requires numeric arguments", 0, 0)
@@ -337,9 +316,9 @@ func RegisterFMaths() *MapVal {
 		}
 		maxVal := math.Inf(-1) // negative infinity
 		for _, arg := range args {
-			if num, ok := arg.(*runtime.NumberVal); ok {
-				if num.Value > maxVal {
-					maxVal = num.Value
+			if num, ok := number(arg); ok {
+				if num > maxVal {
+					maxVal = num
 				}
 			} else {
 				return nil, runtime.NewError("max requires numeric arguments", 0, 0)
@@ -361,23 +340,23 @@ func RegisterFMaths() *MapVal {
 		if len(args) < 1 {
 			return nil, runtime.NewError("gamma requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("gamma requires numeric argument", 0, 0)
 		}
-		return &runtime.NumberVal{Value: math.Gamma(x.Value)}, nil
+		return &runtime.NumberVal{Value: math.Gamma(x)}, nil
 	})
 	
 	mathFuncs["factorial"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
 			return nil, runtime.NewError("factorial requires 1 argument", 0, 0)
 		}
-		x, ok := args[0].(*runtime.NumberVal)
+		x, ok := number(args[0])
 		if !ok {
 			return nil, runtime.NewError("factorial requires numeric argument", 0, 0)
 		}
-		n := int(x.Value)
-		if n < 0 || float64(n) != x.Value {
+		n := int(x)
+		if n < 0 || float64(n) != x {
 			return nil, runtime.NewError("factorial requires non-negative integer", 0, 0)
 		}
 		result := 1.0
@@ -388,4 +367,4 @@ func RegisterFMaths() *MapVal {
 	})
 	
 	return &runtime.MapVal{Properties: mathFuncs}
-}
\ No newline at end of file
+}
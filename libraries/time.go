@@ -5,21 +5,34 @@ import (
 	"time"
 )
 
-func RegisterTime(env *runtime.Environment) {
-	env.Set("now", runtime.BuiltinFunction(func(args ...runtime.Value) runtime.Value {
-		return runtime.Number(float64(time.Now().UnixNano()) / 1e9) // now -> seconds
-	}))
-	env.Set("millis", runtime.BuiltinFunction(func(args ...runtime.Value) runtime.Value {
-		return runtime.Number(float64(time.Now().UnixNano()) / 1e6) // millis -> milliseconds
-	}))
-	env.Set("sleep", runtime.BuiltinFunction(func(args ...runtime.Value) runtime.Value {
+func init() {
+	runtime.RegisterModule("time", timeModule)
+}
+
+// timeModule -> clock readings and sleep
+func timeModule(*runtime.Engine) *runtime.MapVal {
+	timeFuncs := make(map[string]runtime.RuntimeVal)
+
+	timeFuncs["now"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
+		return &runtime.NumberVal{Value: float64(time.Now().UnixNano()) / 1e9}, nil // now -> seconds
+	})
+	timeFuncs["millis"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
+		return &runtime.NumberVal{Value: float64(time.Now().UnixNano()) / 1e6}, nil // millis -> milliseconds
+	})
+	timeFuncs["nanos"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
+		return &runtime.NumberVal{Value: float64(time.Now().UnixNano())}, nil
+	})
+	timeFuncs["sleep"] = runtime.Function(func(args ...runtime.RuntimeVal) (runtime.RuntimeVal, *runtime.Error) {
 		if len(args) < 1 {
-			return runtime.Null
+			return nil, runtime.NewError("sleep requires 1 argument", 0, 0)
 		}
-		sec, ok := args[0].(runtime.NumberValue)
-		if ok {
-			time.Sleep(time.Duration(sec.Float() * float64(time.Second)))
+		sec, ok := number(args[0])
+		if !ok {
+			return nil, runtime.NewError("sleep requires numeric argument", 0, 0)
 		}
-		return runtime.Null
-	}))
+		time.Sleep(time.Duration(sec * float64(time.Second))) // sleep -> seconds, fractions allowed
+		return &runtime.NullVal{}, nil
+	})
+
+	return &runtime.MapVal{Properties: timeFuncs}
 }
@@ -1,23 +1,28 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"DYMS/lexer"
-	"DYMS/parser"
+	_ "DYMS/libraries" // registers the time and fmaths modules
 	"DYMS/runtime"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: dyms <filename.dy>")
+	tierStats := flag.Bool("tier-stats", false, "run functions tiered (interpreter first, hot ones on the VM) and print each function's tier to stderr")
+	interpret := flag.Bool("interpret", false, "run on the tree-walking interpreter, the reference implementation")
+	noOptimize := flag.Bool("no-optimize", false, "turn off compiler and interpreter optimizations")
+	stdoutPath := flag.String("stdout", "", "write the program's output (println, printf, printlnml) to this file")
+	stderrPath := flag.String("stderr", "", "write logln and systemout output, errors and the tier report to this file")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: dyms [--interpret] [--no-optimize] [--tier-stats] [--stdout file] [--stderr file] <filename.dy>")
 		os.Exit(1)
 	}
 
-	filename := os.Args[1]
+	filename := flag.Arg(0)
 	
 	// Check file extension
 	ext := strings.ToLower(filepath.Ext(filename))
@@ -26,28 +31,42 @@ func main() {
 		os.Exit(1)
 	}
 	
-	sourceCode, readErr := ioutil.ReadFile(filename)
-	if readErr != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", readErr)
+	stdout := outputFile(*stdoutPath, os.Stdout)
+	stderr := outputFile(*stderrPath, os.Stderr)
+	engine, err := runtime.NewEngine(runtime.Options{
+		Interpret:  *interpret,
+		NoOptimize: *noOptimize,
+		Tiering:    *tierStats,
+		Stdout:     stdout,
+		Stderr:     stderr,
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
 		os.Exit(1)
 	}
-
-	tokens := lexer.Tokenize(string(sourceCode))
-	p := parser.New(tokens)
-	program, perr := p.ParseProgram()
-	if perr != nil {
-		fmt.Fprintln(os.Stderr, perr.Error())
+	_, rerr := engine.RunFile(filename)
+	if *tierStats {
+		fmt.Fprint(stderr, engine.TierReport())
+	}
+	if rerr != nil {
+		if traced, ok := rerr.(*runtime.Error); ok {
+			fmt.Fprintln(stderr, traced.Traceback())
+		} else {
+			fmt.Fprintln(stderr, rerr.Error())
+		}
 		os.Exit(1)
 	}
+}
 
-	// env -> for program
-	env := runtime.GlobalEnv
-
-	// Use hybrid execution engine (VM for functions, interpreter for complex operations)
-	hybrid := runtime.NewHybridEngine(env)
-	_, rerr := hybrid.Execute(program)
-	if rerr != nil {
-		fmt.Fprintln(os.Stderr, rerr.Error())
+// outputFile -> the file at path, created or truncated, or fallback when path is empty
+func outputFile(path string, fallback *os.File) *os.File {
+	if path == "" {
+		return fallback
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot open %s: %v\n", path, err)
 		os.Exit(1)
 	}
+	return f
 }
\ No newline at end of file
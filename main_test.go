@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestMain -> with DYMS_RUN_MAIN set the test binary stands in for dyms itself, so each
+// script runs in a fresh process with its own globals
+func TestMain(m *testing.M) {
+	if os.Getenv("DYMS_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+var (
+	// verdict -> a benchmark's judgment on how long a loop took, as test/19 prints them;
+	// the "targets met" summary is followed by a boolean that is dropped too
+	verdict  = regexp.MustCompile(`^\[println\]: (✓ PASS - Under|✗ FAIL - Over) [0-9]+ms target$`)
+	targets  = regexp.MustCompile(`^\[println\]: Performance targets met:$`)
+	millis   = regexp.MustCompile(`[0-9]+(\.[0-9]+)? ?ms\b`)
+	timing   = regexp.MustCompile(`(?i)\b(took|elapsed)\b`)
+	number   = regexp.MustCompile(`^\[println\]: -?[0-9]+(\.[0-9]+)?(e[-+][0-9]+)?$`)
+	unit     = regexp.MustCompile(`^\[println\]: ms$`)
+	boolLine = regexp.MustCompile(`^\[println\]: (true|false)$`)
+)
+
+// runScript -> combined output of dyms run with args on file
+func runScript(t *testing.T, file string, args ...string) string {
+	cmd := exec.Command(os.Args[0], append(args, file)...)
+	cmd.Env = append(os.Environ(), "DYMS_RUN_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	if _, failed := err.(*exec.ExitError); err != nil && !failed {
+		t.Fatalf("running %s: %v", file, err)
+	}
+	return string(out)
+}
+
+// masked -> output with durations blanked: millisecond counts become N, a number
+// printed on its own just before "ms" is dropped and so are lines saying how long
+// something took; the benchmarks' timing verdicts are dropped too, with the boolean
+// printed after their "targets met" summary. Any other line is compared as it is
+func masked(out string) string {
+	var kept []string
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		if verdict.MatchString(line) || targets.MatchString(line) {
+			continue
+		}
+		if i > 0 && targets.MatchString(lines[i-1]) && boolLine.MatchString(line) {
+			continue
+		}
+		if timing.MatchString(line) || (number.MatchString(line) && i+1 < len(lines) && unit.MatchString(lines[i+1])) {
+			continue
+		}
+		kept = append(kept, millis.ReplaceAllString(line, "N ms"))
+	}
+	return strings.Join(kept, "\n")
+}
+
+// TestEnginesPreserveOutput -> every script prints the same on the VM and on the
+// interpreter, each with optimizations on and off
+func TestEnginesPreserveOutput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs every script four times")
+	}
+	files, err := filepath.Glob("test/*.dy")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test scripts found: %v", err)
+	}
+	// variants -> compared against the default run, the VM with optimizations
+	variants := []struct {
+		name string
+		args []string
+	}{
+		{"vm-no-optimize", []string{"--no-optimize"}},
+		{"interpreter", []string{"--interpret"}},
+		{"interpreter-no-optimize", []string{"--interpret", "--no-optimize"}},
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			t.Parallel()
+			want := masked(runScript(t, file))
+			for _, v := range variants {
+				if got := masked(runScript(t, file, v.args...)); got != want {
+					t.Errorf("%s output differs from the VM's\n--- vm ---\n%s\n--- %s ---\n%s", v.name, want, v.name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMaskedKeepsOutputThatIsNotATiming(t *testing.T) {
+	out := strings.Join([]string{
+		"[println]: ✗ FAIL - Over 150ms target",
+		"[println]: ✓ PASS - Under 50ms target",
+		"[println]: Performance targets met:",
+		"[println]: false",
+		"[println]: fail",
+		"[println]: still fails:",
+		"[println]: true",
+		"if else failed",
+		"[println]: took 12.5 ms",
+	}, "\n")
+	want := strings.Join([]string{
+		"[println]: fail",
+		"[println]: still fails:",
+		"[println]: true",
+		"if else failed",
+	}, "\n")
+	if got := masked(out); got != want {
+		t.Errorf("masked =\n%s\nwant\n%s", got, want)
+	}
+}
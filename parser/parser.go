@@ -4,15 +4,35 @@ import (
 	"fmt"
 	"DYMS/ast"
 	"DYMS/lexer"
-	"DYMS/runtime"
 	"strconv"
+	"strings"
 )
 
+// Error -> syntax error at Line, Column; Message does not repeat the position
+type Error struct {
+	Message string
+	Line    int
+	Column  int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at line %d, column %d", e.Message, e.Line, e.Column)
+}
+
+func newError(message string, line, column int) *Error {
+	return &Error{Message: message, Line: line, Column: column}
+}
+
 type Parser struct {
 	tokens    []lexer.Token
 	pos       int
+	file      string
 	lookahead [3]lexer.Token // Fast lookahead cache
 	lookaheadValid [3]bool
+	scopes    []map[string]ast.DeclKind // lexical bindings seen so far, innermost last
+	labels    []string                  // labels of the enclosing loops in the current function
+	loops     int                       // enclosing loops in the current function
+	switches  int                       // enclosing switches in the current function
 }
 
 // parser ->
@@ -20,11 +40,16 @@ func New(tokens []lexer.Token) *Parser {
 	return &Parser{tokens: tokens, pos: 0}
 }
 
+// NewWithFile -> parser that records file on programs and functions
+func NewWithFile(tokens []lexer.Token, file string) *Parser {
+	return &Parser{tokens: tokens, pos: 0, file: file}
+}
+
 // Fast helpers with caching
 func (p *Parser) peek() lexer.Token {
 	if !p.lookaheadValid[0] {
 		if p.pos >= len(p.tokens) {
-			p.lookahead[0] = lexer.Token{Type: -1, Value: ""}
+			p.lookahead[0] = p.end()
 		} else {
 			p.lookahead[0] = p.tokens[p.pos]
 		}
@@ -36,13 +61,13 @@ func (p *Parser) peek() lexer.Token {
 func (p *Parser) peekAhead(offset int) lexer.Token {
 	if offset >= 3 { // fallback for far lookahead
 		if p.pos+offset >= len(p.tokens) {
-			return lexer.Token{Type: -1, Value: ""}
+			return p.end()
 		}
 		return p.tokens[p.pos+offset]
 	}
 	if !p.lookaheadValid[offset] {
 		if p.pos+offset >= len(p.tokens) {
-			p.lookahead[offset] = lexer.Token{Type: -1, Value: ""}
+			p.lookahead[offset] = p.end()
 		} else {
 			p.lookahead[offset] = p.tokens[p.pos+offset]
 		}
@@ -51,6 +76,15 @@ func (p *Parser) peekAhead(offset int) lexer.Token {
 	return p.lookahead[offset]
 }
 
+// end -> the token past the last one, placed just after it so errors at the end of input have a position
+func (p *Parser) end() lexer.Token {
+	if len(p.tokens) == 0 {
+		return lexer.Token{Type: -1, Value: "", Line: 1, Column: 1}
+	}
+	last := p.tokens[len(p.tokens)-1]
+	return lexer.Token{Type: -1, Value: "", Line: last.Line, Column: last.Column + len(last.Value)}
+}
+
 func (p *Parser) consume() lexer.Token {
 	tok := p.peek()
 	p.pos++
@@ -63,19 +97,30 @@ func (p *Parser) consume() lexer.Token {
 	return tok
 }
 
-func (p *Parser) expect(expected lexer.TokenType, message string) (lexer.Token, *runtime.Error) {
+// pos -> source position of a token
+func pos(tok lexer.Token) ast.Position {
+	return ast.Position{Line: tok.Line, Column: tok.Column}
+}
+
+func (p *Parser) expect(expected lexer.TokenType, message string) (lexer.Token, *Error) {
 	tok := p.consume()
 	if tok.Type != expected {
-		return tok, runtime.NewError(fmt.Sprintf("%s at line %d, column %d", message, tok.Line, tok.Column), tok.Line, tok.Column)
+		return tok, newError(message, tok.Line, tok.Column)
 	}
 	return tok, nil
 }
 
 // parseprogram ->
-func (p *Parser) ParseProgram() (*ast.Program, *runtime.Error) {
-	prog := &ast.Program{Body: []ast.Stmt{}}
+func (p *Parser) ParseProgram() (*ast.Program, *Error) {
+	prog := &ast.Program{Position: ast.Position{Line: 1, Column: 1}, Body: []ast.Stmt{}, File: p.file}
 	for p.pos < len(p.tokens) {
-		stmt, err := p.parseStmt()
+		var stmt ast.Stmt
+		var err *Error
+		if p.peek().Type == lexer.Export {
+			stmt, err = p.parseExport(prog)
+		} else {
+			stmt, err = p.parseStmt()
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -86,42 +131,175 @@ func (p *Parser) ParseProgram() (*ast.Program, *runtime.Error) {
 	return prog, nil
 }
 
+// parseExport -> export let/var/const/funct declaration at the top level of a file; the
+// name it declares is recorded as one of the program's exports
+func (p *Parser) parseExport(prog *ast.Program) (ast.Stmt, *Error) {
+	exportTok := p.consume() // export ->
+	switch p.peek().Type {
+	case lexer.Let, lexer.Var, lexer.Const:
+		stmt, err := p.parseVarDeclaration()
+		if err != nil {
+			return nil, err
+		}
+		prog.Exports = append(prog.Exports, stmt.(*ast.VarDeclaration).Identifier)
+		return stmt, nil
+	case lexer.Funct:
+		if p.peekAhead(1).Type != lexer.Identifier {
+			break
+		}
+		stmt, err := p.parseFunctionDeclaration()
+		if err != nil {
+			return nil, err
+		}
+		prog.Exports = append(prog.Exports, stmt.(*ast.FunctionDeclaration).Name)
+		return stmt, nil
+	}
+	return nil, newError("Expected a declaration after 'export'", exportTok.Line, exportTok.Column)
+}
+
+// pushScope/popScope -> mirror runtime scoping so writes to let/const are rejected at parse time
+func (p *Parser) pushScope() { p.scopes = append(p.scopes, map[string]ast.DeclKind{}) }
+func (p *Parser) popScope()  { p.scopes = p.scopes[:len(p.scopes)-1] }
+
+func (p *Parser) declare(name string, kind ast.DeclKind) {
+	if len(p.scopes) == 0 {
+		p.pushScope()
+	}
+	p.scopes[len(p.scopes)-1][name] = kind
+}
+
+// checkAssignable -> error if name statically resolves to a let/const binding
+func (p *Parser) checkAssignable(name string, at ast.Position) *Error {
+	for i := len(p.scopes) - 1; i >= 0; i-- {
+		if kind, ok := p.scopes[i][name]; ok {
+			if kind.Mutable() {
+				return nil
+			}
+			return newError(ast.ImmutableMessage(name, kind), at.Line, at.Column)
+		}
+	}
+	return nil
+}
+
 // parsestmt ->
-func (p *Parser) parseStmt() (ast.Stmt, *runtime.Error) {
+func (p *Parser) parseStmt() (ast.Stmt, *Error) {
 	switch p.peek().Type {
 	case lexer.Import:
 		return p.parseImportStatement()
+	case lexer.Export:
+		tok := p.peek()
+		return nil, newError("'export' is only allowed at the top level of a file", tok.Line, tok.Column)
 	case lexer.Funct:
 		return p.parseFunctionDeclaration()
 	case lexer.Return:
 		return p.parseReturnStatement()
 	case lexer.Try:
 		return p.parseTryStatement()
+	case lexer.Throw:
+		return p.parseThrowStatement()
 	case lexer.Break:
-		p.consume()
-		return &ast.BreakStatement{}, nil
+		tok := p.consume()
+		if p.loops == 0 && p.switches == 0 {
+			return nil, newError("'break' outside of a loop or switch", tok.Line, tok.Column)
+		}
+		label, err := p.parseJumpLabel(tok)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.BreakStatement{Position: pos(tok), Label: label}, nil
 	case lexer.Continue:
-		p.consume()
-		return &ast.ContinueStatement{}, nil
+		tok := p.consume()
+		if p.loops == 0 {
+			return nil, newError("'continue' outside of a loop", tok.Line, tok.Column)
+		}
+		label, err := p.parseJumpLabel(tok)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.ContinueStatement{Position: pos(tok), Label: label}, nil
 	case lexer.Let, lexer.Var, lexer.Const:
 		return p.parseVarDeclaration()
 	case lexer.If:
 		return p.parseIfStatement()
 	case lexer.ForRange:
 		return p.parseForStatement()
+	case lexer.For:
+		return p.parseForLoop()
 	case lexer.While:
 		return p.parseWhileStatement()
+	case lexer.Do:
+		return p.parseDoWhileStatement()
+	case lexer.Switch:
+		return p.parseSwitchStatement()
 	case lexer.Else:
 		return nil, nil // else -> handled by if
 	case lexer.OpenBrace:
 		return p.parseBlockStatement()
+	case lexer.Identifier:
+		if p.peekAhead(1).Type == lexer.Colon {
+			return p.parseLabeledLoop()
+		}
+		return p.parseExpr()
 	default:
 		return p.parseExpr()
 	}
 }
 
-func (p *Parser) parseVarDeclaration() (ast.Stmt, *runtime.Error) {
-	isConstant := p.consume().Type == lexer.Const
+// parseLabeledLoop -> name: loop, the target of `break name` / `continue name`
+func (p *Parser) parseLabeledLoop() (ast.Stmt, *Error) {
+	labelTok := p.consume()
+	p.consume() // : ->
+	for _, label := range p.labels {
+		if label == labelTok.Value {
+			return nil, newError(fmt.Sprintf("Label '%s' is already used by an enclosing loop", labelTok.Value), labelTok.Line, labelTok.Column)
+		}
+	}
+	switch next := p.peek(); next.Type {
+	case lexer.ForRange, lexer.For, lexer.While, lexer.Do:
+	default:
+		return nil, newError(fmt.Sprintf("Expected a loop after label '%s'", labelTok.Value), next.Line, next.Column)
+	}
+
+	p.labels = append(p.labels, labelTok.Value)
+	stmt, err := p.parseStmt()
+	p.labels = p.labels[:len(p.labels)-1]
+	if err != nil {
+		return nil, err
+	}
+	switch loop := stmt.(type) {
+	case *ast.ForStatement:
+		loop.Label = labelTok.Value
+	case *ast.ForInStatement:
+		loop.Label = labelTok.Value
+	case *ast.ForClauseStatement:
+		loop.Label = labelTok.Value
+	case *ast.WhileStatement:
+		loop.Label = labelTok.Value
+	case *ast.DoWhileStatement:
+		loop.Label = labelTok.Value
+	}
+	return stmt, nil
+}
+
+// parseJumpLabel -> optional label after break/continue; it must be on the keyword's line
+// and name an enclosing loop
+func (p *Parser) parseJumpLabel(keyword lexer.Token) (string, *Error) {
+	next := p.peek()
+	if next.Type != lexer.Identifier || next.Line != keyword.Line {
+		return "", nil
+	}
+	p.consume()
+	for _, label := range p.labels {
+		if label == next.Value {
+			return label, nil
+		}
+	}
+	return "", newError(fmt.Sprintf("Unknown label '%s' for %s", next.Value, keyword.Value), next.Line, next.Column)
+}
+
+func (p *Parser) parseVarDeclaration() (ast.Stmt, *Error) {
+	declTok := p.consume()
+	kind := ast.DeclKind(declTok.Value)
 	identifier, err := p.expect(lexer.Identifier, "Expected identifier in variable declaration")
 	if err != nil {
 		return nil, err
@@ -135,11 +313,12 @@ func (p *Parser) parseVarDeclaration() (ast.Stmt, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ast.VarDeclaration{Identifier: identifier.Value, Value: value, Constant: isConstant}, nil
+	p.declare(identifier.Value, kind)
+	return &ast.VarDeclaration{Position: pos(declTok), Identifier: identifier.Value, Value: value, DeclKind: kind}, nil
 }
 
-func (p *Parser) parseIfStatement() (ast.Stmt, *runtime.Error) {
-	p.consume() // if ->
+func (p *Parser) parseIfStatement() (ast.Stmt, *Error) {
+	ifTok := p.consume() // if ->
 	_, err := p.expect(lexer.OpenParen, "Expected '(' after 'if'")
 	if err != nil {
 		return nil, err
@@ -159,22 +338,32 @@ func (p *Parser) parseIfStatement() (ast.Stmt, *runtime.Error) {
 
 	var alternative *ast.BlockStatement
 	if p.peek().Type == lexer.Else {
-		p.consume() // else ->
-		alternative, err = p.parseBlockStatement()
-		if err != nil {
-			return nil, err
+		elseTok := p.consume() // else ->
+		if p.peek().Type == lexer.If {
+			// else if -> nested if wrapped as the alternative block
+			nested, err := p.parseIfStatement()
+			if err != nil {
+				return nil, err
+			}
+			alternative = &ast.BlockStatement{Position: pos(elseTok), Statements: []ast.Stmt{nested}}
+		} else {
+			alternative, err = p.parseBlockStatement()
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	return &ast.IfStatement{
+		Position:    pos(ifTok),
 		Condition:   condition,
 		Consequence: consequence,
 		Alternative: alternative,
 	}, nil
 }
 
-func (p *Parser) parseForStatement() (ast.Stmt, *runtime.Error) {
-	p.consume() // for range ->
+func (p *Parser) parseForStatement() (ast.Stmt, *Error) {
+	forTok := p.consume() // for range ->
 	_, err := p.expect(lexer.OpenParen, "Expected '(' after 'for range'")
 	if err != nil {
 		return nil, err
@@ -187,204 +376,436 @@ func (p *Parser) parseForStatement() (ast.Stmt, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	rangeExpr, err := p.parseExpr()
-	if err != nil {
-		return nil, err
+	// bounds -> end, or start, end and an optional step
+	var bounds []ast.Expr
+	for {
+		bound, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if len(bounds) == 3 {
+			return nil, newError("Too many values in for range, expected (i, end) or (i, start, end, step)", bound.Pos().Line, bound.Pos().Column)
+		}
+		bounds = append(bounds, bound)
+		if p.peek().Type != lexer.Comma {
+			break
+		}
+		p.consume() // , ->
 	}
 	_, err = p.expect(lexer.CloseParen, "Expected ')' after for loop range")
 	if err != nil {
 		return nil, err
 	}
-	body, err := p.parseBlockStatement()
+	p.pushScope()
+	p.declare(identifier.Value, ast.VarDecl)
+	body, err := p.parseLoopBody()
+	p.popScope()
 	if err != nil {
 		return nil, err
 	}
 
-	return &ast.ForStatement{
-		Identifier: &ast.Identifier{Symbol: identifier.Value},
-		Range:      rangeExpr,
+	stmt := &ast.ForStatement{
+		Position:   pos(forTok),
+		Identifier: &ast.Identifier{Position: pos(identifier), Symbol: identifier.Value},
+		Range:      bounds[0],
 		Body:       body,
-	}, nil
+	}
+	if len(bounds) > 1 {
+		stmt.Start, stmt.Range = bounds[0], bounds[1]
+	}
+	if len(bounds) > 2 {
+		stmt.Step = bounds[2]
+	}
+	return stmt, nil
 }
 
-func (p *Parser) parseWhileStatement() (ast.Stmt, *runtime.Error) {
-	p.consume() // while ->
-	_, err := p.expect(lexer.OpenParen, "Expected '(' after 'while'")
+// parseForLoop -> for (init; condition; post) { } or for x in collection { } / for k, v in collection { }
+func (p *Parser) parseForLoop() (ast.Stmt, *Error) {
+	forTok := p.consume() // for ->
+	if p.peek().Type == lexer.OpenParen {
+		return p.parseForClause(forTok)
+	}
+
+	first, err := p.expect(lexer.Identifier, "Expected loop variable or '(' after 'for'")
 	if err != nil {
 		return nil, err
 	}
-	condition, err := p.parseExpr()
+	stmt := &ast.ForInStatement{Position: pos(forTok), Value: &ast.Identifier{Position: pos(first), Symbol: first.Value}}
+	if p.peek().Type == lexer.Comma {
+		p.consume() // , ->
+		second, err := p.expect(lexer.Identifier, "Expected second loop variable after ','")
+		if err != nil {
+			return nil, err
+		}
+		if second.Value == first.Value {
+			return nil, newError(fmt.Sprintf("Duplicate loop variable '%s'", second.Value), second.Line, second.Column)
+		}
+		stmt.Key = stmt.Value
+		stmt.Value = &ast.Identifier{Position: pos(second), Symbol: second.Value}
+	}
+	_, err = p.expect(lexer.In, "Expected 'in' after for loop variables")
 	if err != nil {
 		return nil, err
 	}
-	_, err = p.expect(lexer.CloseParen, "Expected ')' after while condition")
+	stmt.Collection, err = p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
-	body, err := p.parseBlockStatement()
+
+	p.pushScope()
+	if stmt.Key != nil {
+		p.declare(stmt.Key.Symbol, ast.VarDecl)
+	}
+	p.declare(stmt.Value.Symbol, ast.VarDecl)
+	stmt.Body, err = p.parseLoopBody()
+	p.popScope()
 	if err != nil {
 		return nil, err
 	}
-
-	return &ast.WhileStatement{
-		Condition: condition,
-		Body:      body,
-	}, nil
+	return stmt, nil
 }
 
-func (p *Parser) parseBlockStatement() (*ast.BlockStatement, *runtime.Error) {
-	_, err := p.expect(lexer.OpenBrace, "Expected '{' to start a block statement")
+// parseForClause -> (init; condition; post) { }, init is scoped to the loop
+func (p *Parser) parseForClause(forTok lexer.Token) (ast.Stmt, *Error) {
+	p.consume() // ( ->
+	p.pushScope()
+	defer p.popScope()
+
+	stmt := &ast.ForClauseStatement{Position: pos(forTok)}
+	var err *Error
+	switch p.peek().Type {
+	case lexer.Semicolon:
+	case lexer.Let, lexer.Var, lexer.Const:
+		stmt.Init, err = p.parseVarDeclaration()
+	default:
+		stmt.Init, err = p.parseExpr()
+	}
 	if err != nil {
 		return nil, err
 	}
-	statements := []ast.Stmt{}
-	for p.peek().Type != lexer.CloseBrace && p.pos < len(p.tokens) {
-		stmt, err := p.parseStmt()
-		if err != nil {
+	if _, err := p.expect(lexer.Semicolon, "Expected ';' after for loop initializer"); err != nil {
+		return nil, err
+	}
+	if p.peek().Type != lexer.Semicolon {
+		if stmt.Condition, err = p.parseExpr(); err != nil {
 			return nil, err
 		}
-		statements = append(statements, stmt)
 	}
-	_, err = p.expect(lexer.CloseBrace, "Expected '}' to end a block statement")
+	if _, err := p.expect(lexer.Semicolon, "Expected ';' after for loop condition"); err != nil {
+		return nil, err
+	}
+	if p.peek().Type != lexer.CloseParen {
+		if stmt.Post, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect(lexer.CloseParen, "Expected ')' after for loop clauses"); err != nil {
+		return nil, err
+	}
+	stmt.Body, err = p.parseLoopBody()
 	if err != nil {
 		return nil, err
 	}
-	return &ast.BlockStatement{Statements: statements}, nil
+	return stmt, nil
 }
 
-// parseexpr ->
-func (p *Parser) parseExpr() (ast.Expr, *runtime.Error) {
-	return p.parseAssignmentExpr()
-}
-
-func (p *Parser) parseAssignmentExpr() (ast.Expr, *runtime.Error) {
-	left, err := p.parseLogicalExpr()
+// parseSwitchStatement -> switch (expr) { case a, b: stmts default: stmts }
+func (p *Parser) parseSwitchStatement() (ast.Stmt, *Error) {
+	switchTok := p.consume() // switch ->
+	_, err := p.expect(lexer.OpenParen, "Expected '(' after 'switch'")
+	if err != nil {
+		return nil, err
+	}
+	discriminant, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(lexer.CloseParen, "Expected ')' after switch value")
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(lexer.OpenBrace, "Expected '{' to start switch body")
 	if err != nil {
 		return nil, err
 	}
 
-	if p.peek().Type == lexer.Equals {
-		_, isIdentifier := left.(*ast.Identifier)
-		if !isIdentifier {
-			return nil, runtime.NewError(fmt.Sprintf("Invalid assignment target: %T at line %d, column %d", left, p.peek().Line, p.peek().Column), p.peek().Line, p.peek().Column)
+	stmt := &ast.SwitchStatement{Position: pos(switchTok), Discriminant: discriminant}
+	p.switches++
+	defer func() { p.switches-- }()
+	hasDefault := false
+	for p.peek().Type != lexer.CloseBrace && p.pos < len(p.tokens) {
+		caseTok := p.consume()
+		clause := &ast.SwitchCase{Position: pos(caseTok)}
+		switch caseTok.Type {
+		case lexer.Case:
+			for {
+				value, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				clause.Values = append(clause.Values, value)
+				if p.peek().Type != lexer.Comma {
+					break
+				}
+				p.consume() // , ->
+			}
+		case lexer.Default:
+			if hasDefault {
+				return nil, newError("Multiple default clauses in switch", caseTok.Line, caseTok.Column)
+			}
+			hasDefault = true
+		default:
+			return nil, newError("Expected 'case' or 'default' in switch body", caseTok.Line, caseTok.Column)
 		}
-		p.consume() // = ->
-		value, err := p.parseAssignmentExpr()
+		colonTok, err := p.expect(lexer.Colon, "Expected ':' after switch case")
 		if err != nil {
 			return nil, err
 		}
-		return &ast.AssignmentExpr{Assignee: left, Value: value}, nil
-	}
 
-	return left, nil
+		// case body -> statements up to the next clause, in their own scope
+		clause.Body = &ast.BlockStatement{Position: pos(colonTok)}
+		p.pushScope()
+		for p.pos < len(p.tokens) {
+			next := p.peek().Type
+			if next == lexer.Case || next == lexer.Default || next == lexer.CloseBrace {
+				break
+			}
+			bodyStmt, err := p.parseStmt()
+			if err != nil {
+				p.popScope()
+				return nil, err
+			}
+			clause.Body.Statements = append(clause.Body.Statements, bodyStmt)
+		}
+		p.popScope()
+		stmt.Cases = append(stmt.Cases, clause)
+	}
+	_, err = p.expect(lexer.CloseBrace, "Expected '}' to end switch body")
+	if err != nil {
+		return nil, err
+	}
+	return stmt, nil
 }
 
-func (p *Parser) parseLogicalExpr() (ast.Expr, *runtime.Error) {
-	left, err := p.parseComparisonExpr()
+func (p *Parser) parseWhileStatement() (ast.Stmt, *Error) {
+	whileTok := p.consume() // while ->
+	_, err := p.expect(lexer.OpenParen, "Expected '(' after 'while'")
 	if err != nil {
 		return nil, err
 	}
-
-	for p.peek().Type == lexer.LogicalOperator {
-		op := p.consume().Value
-		right, err := p.parseComparisonExpr()
-		if err != nil {
-			return nil, err
-		}
-		left = &ast.BinaryExpr{
-			Left:     left,
-			Right:    right,
-			Operator: op,
-		}
+	condition, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(lexer.CloseParen, "Expected ')' after while condition")
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.parseLoopBody()
+	if err != nil {
+		return nil, err
 	}
 
-	return left, nil
+	return &ast.WhileStatement{
+		Position:  pos(whileTok),
+		Condition: condition,
+		Body:      body,
+	}, nil
 }
 
-func (p *Parser) parseComparisonExpr() (ast.Expr, *runtime.Error) {
-	left, err := p.parseAdditiveExpr()
+// parseDoWhileStatement -> do { } while (cond)
+func (p *Parser) parseDoWhileStatement() (ast.Stmt, *Error) {
+	doTok := p.consume() // do ->
+	body, err := p.parseLoopBody()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(lexer.While, "Expected 'while' after do block")
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(lexer.OpenParen, "Expected '(' after 'while'")
+	if err != nil {
+		return nil, err
+	}
+	condition, err := p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
+	_, err = p.expect(lexer.CloseParen, "Expected ')' after while condition")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ast.DoWhileStatement{
+		Position:  pos(doTok),
+		Body:      body,
+		Condition: condition,
+	}, nil
+}
+
+// parseLoopBody -> block in which break and continue are allowed
+func (p *Parser) parseLoopBody() (*ast.BlockStatement, *Error) {
+	p.loops++
+	defer func() { p.loops-- }()
+	return p.parseBlockStatement()
+}
 
-	for p.peek().Type == lexer.ComparisonOperator {
-		op := p.consume().Value
-		right, err := p.parseAdditiveExpr()
+func (p *Parser) parseBlockStatement() (*ast.BlockStatement, *Error) {
+	openTok, err := p.expect(lexer.OpenBrace, "Expected '{' to start a block statement")
+	if err != nil {
+		return nil, err
+	}
+	p.pushScope()
+	defer p.popScope()
+	statements := []ast.Stmt{}
+	for p.peek().Type != lexer.CloseBrace && p.pos < len(p.tokens) {
+		stmt, err := p.parseStmt()
 		if err != nil {
 			return nil, err
 		}
-		left = &ast.BinaryExpr{
-			Left:     left,
-			Right:    right,
-			Operator: op,
-		}
+		statements = append(statements, stmt)
+	}
+	_, err = p.expect(lexer.CloseBrace, "Expected '}' to end a block statement")
+	if err != nil {
+		return nil, err
 	}
+	return &ast.BlockStatement{Position: pos(openTok), Statements: statements}, nil
+}
 
-	return left, nil
+// parseexpr ->
+func (p *Parser) parseExpr() (ast.Expr, *Error) {
+	return p.parseAssignmentExpr()
 }
 
-func (p *Parser) parseAdditiveExpr() (ast.Expr, *runtime.Error) {
-	left, err := p.parseMultiplicativeExpr()
+func (p *Parser) parseAssignmentExpr() (ast.Expr, *Error) {
+	left, err := p.parseBinaryExpr(1)
 	if err != nil {
 		return nil, err
 	}
 
-	for p.peek().Value == "+" || p.peek().Value == "-" {
-		op := p.consume().Value
-		right, err := p.parseMultiplicativeExpr()
+	if p.peek().Type == lexer.Equals || p.peek().Type == lexer.CompoundAssign {
+		opTok := p.peek()
+		compound := opTok.Type == lexer.CompoundAssign
+		switch target := left.(type) {
+		case *ast.Identifier:
+			if err := p.checkAssignable(target.Symbol, target.Pos()); err != nil {
+				return nil, err
+			}
+		case *ast.IndexExpr:
+			if target.Optional {
+				return nil, newError("Invalid assignment target: optional index", target.Line, target.Column)
+			}
+		case *ast.MemberExpr:
+			if target.Optional {
+				return nil, newError("Invalid assignment target: optional member", target.Line, target.Column)
+			}
+		default:
+			return nil, newError(fmt.Sprintf("Invalid assignment target: %T", left), opTok.Line, opTok.Column)
+		}
+		p.consume() // = or op= ->
+		value, err := p.parseAssignmentExpr()
 		if err != nil {
 			return nil, err
 		}
-		left = &ast.BinaryExpr{
-			Left:     left,
-			Right:    right,
-			Operator: op,
+		assign := &ast.AssignmentExpr{Position: left.Pos(), Assignee: left, Value: value}
+		if compound {
+			assign.Operator = strings.TrimSuffix(opTok.Value, "=")
 		}
+		return assign, nil
 	}
 
 	return left, nil
 }
 
-func (p *Parser) parseMultiplicativeExpr() (ast.Expr, *runtime.Error) {
+// binaryPrecedence -> binding power of each binary operator, higher binds tighter
+var binaryPrecedence = map[string]int{
+	"??": 1,
+	"||": 2,
+	"&&": 3,
+	"==": 4, "!=": 4,
+	"<": 5, "<=": 5, ">": 5, ">=": 5,
+	"|": 6,
+	"^": 7,
+	"&": 8,
+	"<<": 9, ">>": 9,
+	"+": 10, "-": 10,
+	"*": 11, "/": 11, "%": 11, "div": 11,
+}
+
+// relationalPrecedence -> level that does not chain: a < b < c is rejected
+const relationalPrecedence = 5
+
+// binaryOperator -> precedence of the next token when it is a binary operator
+func (p *Parser) binaryOperator() (int, bool) {
+	tok := p.peek()
+	switch tok.Type {
+	case lexer.BinaryOperator, lexer.Modulo, lexer.ComparisonOperator, lexer.LogicalOperator:
+		prec, ok := binaryPrecedence[tok.Value]
+		return prec, ok
+	}
+	return 0, false
+}
+
+// parseBinaryExpr -> precedence climbing over binaryPrecedence, left-associative
+func (p *Parser) parseBinaryExpr(minPrec int) (ast.Expr, *Error) {
 	left, err := p.parseUnaryExpr()
 	if err != nil {
 		return nil, err
 	}
 
-	// Fast operator checking
+	relational := false
 	for {
-		tok := p.peek()
-		if tok.Type == lexer.BinaryOperator {
-			if tok.Value != "*" && tok.Value != "/" {
-				break
-			}
-		} else if tok.Type != lexer.Modulo {
+		prec, ok := p.binaryOperator()
+		if !ok || prec < minPrec {
 			break
 		}
-		op := p.consume().Value
-		right, err := p.parseUnaryExpr()
+		opTok := p.consume()
+		if prec == relationalPrecedence {
+			if relational {
+				return nil, newError("Comparison operators cannot be chained, combine them with &&", opTok.Line, opTok.Column)
+			}
+			relational = true
+		}
+		right, err := p.parseBinaryExpr(prec + 1)
 		if err != nil {
 			return nil, err
 		}
 		left = &ast.BinaryExpr{
+			Position: pos(opTok),
 			Left:     left,
 			Right:    right,
-			Operator: op,
+			Operator: opTok.Value,
 		}
 	}
 
 	return left, nil
 }
 
-func (p *Parser) parseUnaryExpr() (ast.Expr, *runtime.Error) {
+func (p *Parser) parseUnaryExpr() (ast.Expr, *Error) {
+	// Prefix operators: -x, +x, ~x, !x
+	if tok := p.peek(); tok.Type == lexer.Not || (tok.Type == lexer.BinaryOperator && (tok.Value == "-" || tok.Value == "+" || tok.Value == "~")) {
+		opTok := p.consume()
+		operand, err := p.parseUnaryExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &ast.UnaryExpr{Position: pos(opTok), Operand: operand, Operator: opTok.Value, Prefix: true}, nil
+	}
+
 	// Prefix operators: ++x, --x
 	if p.peek().Type == lexer.Increment || p.peek().Type == lexer.Decrement {
-		op := p.consume().Value
+		opTok := p.consume()
 		operand, err := p.parseCallExpr()
 		if err != nil {
 			return nil, err
 		}
-		return &ast.UnaryExpr{Operand: operand, Operator: op, Prefix: true}, nil
+		if ident, ok := operand.(*ast.Identifier); ok {
+			if err := p.checkAssignable(ident.Symbol, pos(opTok)); err != nil {
+				return nil, err
+			}
+		}
+		return &ast.UnaryExpr{Position: pos(opTok), Operand: operand, Operator: opTok.Value, Prefix: true}, nil
 	}
 
 	// Parse primary expression first
@@ -393,22 +814,38 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, *runtime.Error) {
 		return nil, err
 	}
 
-	// Postfix operators: x++, x--
-	if p.peek().Type == lexer.Increment || p.peek().Type == lexer.Decrement {
-		op := p.consume().Value
-		return &ast.UnaryExpr{Operand: expr, Operator: op, Prefix: false}, nil
+	// Postfix operators: x++, x-- (same line only, so a ++x on the next line stays prefix)
+	if (p.peek().Type == lexer.Increment || p.peek().Type == lexer.Decrement) && p.peek().Line == p.tokens[p.pos-1].Line {
+		opTok := p.consume()
+		if ident, ok := expr.(*ast.Identifier); ok {
+			if err := p.checkAssignable(ident.Symbol, pos(opTok)); err != nil {
+				return nil, err
+			}
+		}
+		return &ast.UnaryExpr{Position: pos(opTok), Operand: expr, Operator: opTok.Value, Prefix: false}, nil
 	}
 
 	return expr, nil
 }
 
-func (p *Parser) parseCallExpr() (ast.Expr, *runtime.Error) {
+func (p *Parser) parseCallExpr() (ast.Expr, *Error) {
 	callee, err := p.parseMemberExpr()
 	if err != nil {
 		return nil, err
 	}
 
-	for p.peek().Type == lexer.OpenParen {
+	for {
+		switch {
+		case p.atMemberAccess():
+			callee, err = p.parseMemberAccess(callee)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case p.peek().Type == lexer.OpenParen:
+		default:
+			return callee, nil
+		}
 		p.consume() // ( ->
 		args := []ast.Expr{}
 		if p.peek().Type != lexer.CloseParen {
@@ -431,50 +868,91 @@ func (p *Parser) parseCallExpr() (ast.Expr, *runtime.Error) {
 		if err != nil {
 			return nil, err
 		}
-		callee = &ast.CallExpr{Callee: callee, Args: args}
+		callee = &ast.CallExpr{Position: callee.Pos(), Callee: callee, Args: args}
 	}
-
-	return callee, nil
 }
 
-func (p *Parser) parseMemberExpr() (ast.Expr, *runtime.Error) {
+func (p *Parser) parseMemberExpr() (ast.Expr, *Error) {
 	obj, err := p.parsePrimary()
 	if err != nil {
 		return nil, err
 	}
-	for p.peek().Type == lexer.Dot {
-		p.consume() // . ->
-		prop, err := p.expect(lexer.Identifier, "Expected identifier after '.'")
+	for p.atMemberAccess() {
+		obj, err = p.parseMemberAccess(obj)
 		if err != nil {
 			return nil, err
 		}
-		obj = &ast.MemberExpr{Object: obj, Property: &ast.Identifier{Symbol: prop.Value}}
 	}
 	return obj, nil
 }
 
+// atMemberAccess -> the next token starts a .prop, ?.prop or [index] suffix; a [ on a new
+// line starts an array literal statement instead, as there are no statement terminators
+func (p *Parser) atMemberAccess() bool {
+	switch p.peek().Type {
+	case lexer.Dot, lexer.QuestionDot:
+		return true
+	case lexer.OpenBracket:
+		return p.peek().Line == p.tokens[p.pos-1].Line
+	}
+	return false
+}
+
+// parseMemberAccess -> one .prop, [index], ?.prop or ?.[index] suffix
+func (p *Parser) parseMemberAccess(obj ast.Expr) (ast.Expr, *Error) {
+	accessTok := p.consume()
+	optional := accessTok.Type == lexer.QuestionDot
+	if optional && p.peek().Type == lexer.OpenBracket {
+		accessTok = p.consume()
+	} else if accessTok.Type == lexer.Dot || optional {
+		prop, err := p.expect(lexer.Identifier, fmt.Sprintf("Expected identifier after '%s'", accessTok.Value))
+		if err != nil {
+			return nil, err
+		}
+		return &ast.MemberExpr{Position: pos(prop), Object: obj, Property: &ast.Identifier{Position: pos(prop), Symbol: prop.Value}, Optional: optional}, nil
+	}
+	// [ -> already consumed
+	index, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(lexer.CloseBracket, "Expected ']' after index expression")
+	if err != nil {
+		return nil, err
+	}
+	return &ast.IndexExpr{Position: pos(accessTok), Object: obj, Index: index, Optional: optional}, nil
+}
+
 // parseprimary ->
-func (p *Parser) parsePrimary() (ast.Expr, *runtime.Error) {
+func (p *Parser) parsePrimary() (ast.Expr, *Error) {
 	tok := p.consume()
 	switch tok.Type {
 	case lexer.Number:
+		// whole numbers are integers unless too large for one
+		if !strings.Contains(tok.Value, ".") {
+			if val, err := strconv.ParseInt(tok.Value, 10, 64); err == nil {
+				return &ast.IntegerLiteral{Position: pos(tok), Value: val}, nil
+			}
+		}
 		val, err := strconv.ParseFloat(tok.Value, 64)
 		if err != nil {
-			return nil, runtime.NewError(fmt.Sprintf("Could not parse number: %s", tok.Value), tok.Line, tok.Column)
+			return nil, newError(fmt.Sprintf("Could not parse number: %s", tok.Value), tok.Line, tok.Column)
 		}
-		return &ast.NumericLiteral{Value: val}, nil
+		return &ast.NumericLiteral{Position: pos(tok), Value: val}, nil
 	case lexer.Identifier:
-		return &ast.Identifier{Symbol: tok.Value}, nil
+		return &ast.Identifier{Position: pos(tok), Symbol: tok.Value}, nil
 	case lexer.String:
-		return &ast.StringLiteral{Value: tok.Value}, nil
+		return &ast.StringLiteral{Position: pos(tok), Value: tok.Value}, nil
 	case lexer.True:
-		return &ast.BooleanLiteral{Value: true}, nil
+		return &ast.BooleanLiteral{Position: pos(tok), Value: true}, nil
 	case lexer.False:
-		return &ast.BooleanLiteral{Value: false}, nil
+		return &ast.BooleanLiteral{Position: pos(tok), Value: false}, nil
+	case lexer.Null:
+		return &ast.NullLiteral{Position: pos(tok)}, nil
 	case lexer.OpenBracket:
-		return p.parseArrayLiteral()
+		return p.parseArrayLiteral(tok)
 	case lexer.OpenBrace:
-		return p.parseMapLiteral()
+		return p.parseMapLiteral(tok)
 	case lexer.OpenParen:
 		expr, err := p.parseExpr()
 		if err != nil {
@@ -486,14 +964,14 @@ func (p *Parser) parsePrimary() (ast.Expr, *runtime.Error) {
 		}
 		return expr, nil
 	case lexer.Funct:
-		return p.parseFunctionExpression()
+		return p.parseFunctionExpression(tok)
 	default:
-		return nil, runtime.NewError(fmt.Sprintf("Unexpected token: %s", tok.Value), tok.Line, tok.Column)
+		return nil, newError(fmt.Sprintf("Unexpected token: %s", tok.Value), tok.Line, tok.Column)
 	}
 }
 
-func (p *Parser) parseImportStatement() (ast.Stmt, *runtime.Error) {
-	p.consume() // import ->
+func (p *Parser) parseImportStatement() (ast.Stmt, *Error) {
+	importTok := p.consume() // import ->
 	strTok, err := p.expect(lexer.String, "Expected string path after 'import'")
 	if err != nil {
 		return nil, err
@@ -506,15 +984,17 @@ func (p *Parser) parseImportStatement() (ast.Stmt, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ast.ImportStatement{Path: strTok.Value, Alias: aliasTok.Value}, nil
+	p.declare(aliasTok.Value, ast.ConstDecl)
+	return &ast.ImportStatement{Position: pos(importTok), Path: strTok.Value, Alias: aliasTok.Value, File: p.file}, nil
 }
 
-func (p *Parser) parseFunctionDeclaration() (ast.Stmt, *runtime.Error) {
-	p.consume() // funct ->
+func (p *Parser) parseFunctionDeclaration() (ast.Stmt, *Error) {
+	functTok := p.consume() // funct ->
 	nameTok, err := p.expect(lexer.Identifier, "Expected function name after 'funct'")
 	if err != nil {
 		return nil, err
 	}
+	p.declare(nameTok.Value, ast.ConstDecl)
 	_, err = p.expect(lexer.OpenParen, "Expected '(' after function name")
 	if err != nil {
 		return nil, err
@@ -540,15 +1020,29 @@ func (p *Parser) parseFunctionDeclaration() (ast.Stmt, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	body, err := p.parseBlockStatement()
+	body, err := p.parseFunctionBody(params)
 	if err != nil {
 		return nil, err
 	}
-	return &ast.FunctionDeclaration{Name: nameTok.Value, Params: params, Body: body}, nil
+	return &ast.FunctionDeclaration{Position: pos(functTok), Name: nameTok.Value, Params: params, Body: body, File: p.file}, nil
 }
 
 // Parse function expression (anonymous function)
-func (p *Parser) parseFunctionExpression() (ast.Expr, *runtime.Error) {
+// parseFunctionBody -> body block with params bound in an enclosing scope
+func (p *Parser) parseFunctionBody(params []string) (*ast.BlockStatement, *Error) {
+	p.pushScope()
+	defer p.popScope()
+	// labels, loops, switches -> statements outside the function are not jump targets
+	labels, loops, switches := p.labels, p.loops, p.switches
+	p.labels, p.loops, p.switches = nil, 0, 0
+	defer func() { p.labels, p.loops, p.switches = labels, loops, switches }()
+	for _, param := range params {
+		p.declare(param, ast.VarDecl)
+	}
+	return p.parseBlockStatement()
+}
+
+func (p *Parser) parseFunctionExpression(functTok lexer.Token) (ast.Expr, *Error) {
 	// funct -> already consumed by parsePrimary
 	_, err := p.expect(lexer.OpenParen, "Expected '(' after 'funct'")
 	if err != nil {
@@ -575,63 +1069,84 @@ func (p *Parser) parseFunctionExpression() (ast.Expr, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	body, err := p.parseBlockStatement()
+	body, err := p.parseFunctionBody(params)
 	if err != nil {
 		return nil, err
 	}
 	// Return a function declaration but as an expression
-	return &ast.FunctionDeclaration{Name: "", Params: params, Body: body}, nil
+	return &ast.FunctionDeclaration{Position: pos(functTok), Name: "", Params: params, Body: body, File: p.file}, nil
 }
 
-func (p *Parser) parseReturnStatement() (ast.Stmt, *runtime.Error) {
-	p.consume() // return ->
+func (p *Parser) parseReturnStatement() (ast.Stmt, *Error) {
+	returnTok := p.consume() // return ->
 	value, err := p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
-	return &ast.ReturnStatement{Value: value}, nil
+	return &ast.ReturnStatement{Position: pos(returnTok), Value: value}, nil
 }
 
-func (p *Parser) parseTryStatement() (ast.Stmt, *runtime.Error) {
-	p.consume() // try
-	tryBlock, err := p.parseBlockStatement()
+func (p *Parser) parseThrowStatement() (ast.Stmt, *Error) {
+	throwTok := p.consume() // throw ->
+	value, err := p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
+	return &ast.ThrowStatement{Position: pos(throwTok), Value: value}, nil
+}
 
-	_, err = p.expect(lexer.Catch, "Expected 'catch' after try block")
+func (p *Parser) parseTryStatement() (ast.Stmt, *Error) {
+	tryTok := p.consume() // try
+	tryBlock, err := p.parseBlockStatement()
 	if err != nil {
 		return nil, err
 	}
+	stmt := &ast.TryStatement{Position: pos(tryTok), TryBlock: tryBlock}
 
-	_, err = p.expect(lexer.OpenParen, "Expected '(' after 'catch'")
-	if err != nil {
-		return nil, err
+	if p.peek().Type != lexer.Catch && p.peek().Type != lexer.Finally {
+		tok := p.peek()
+		return nil, newError("Expected 'catch' or 'finally' after try block", tok.Line, tok.Column)
 	}
 
-	errorVar, err := p.expect(lexer.Identifier, "Expected error variable name in catch clause")
-	if err != nil {
-		return nil, err
-	}
+	if p.peek().Type == lexer.Catch {
+		p.consume() // catch ->
+		_, err = p.expect(lexer.OpenParen, "Expected '(' after 'catch'")
+		if err != nil {
+			return nil, err
+		}
 
-	_, err = p.expect(lexer.CloseParen, "Expected ')' after error variable")
-	if err != nil {
-		return nil, err
+		errorVar, err := p.expect(lexer.Identifier, "Expected error variable name in catch clause")
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = p.expect(lexer.CloseParen, "Expected ')' after error variable")
+		if err != nil {
+			return nil, err
+		}
+
+		p.pushScope()
+		p.declare(errorVar.Value, ast.VarDecl)
+		stmt.CatchBlock, err = p.parseBlockStatement()
+		p.popScope()
+		if err != nil {
+			return nil, err
+		}
+		stmt.ErrorVar = errorVar.Value
 	}
 
-	catchBlock, err := p.parseBlockStatement()
-	if err != nil {
-		return nil, err
+	if p.peek().Type == lexer.Finally {
+		p.consume() // finally ->
+		stmt.FinallyBlock, err = p.parseBlockStatement()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &ast.TryStatement{
-		TryBlock:   tryBlock,
-		CatchBlock: catchBlock,
-		ErrorVar:   errorVar.Value,
-	}, nil
+	return stmt, nil
 }
 
-func (p *Parser) parseArrayLiteral() (ast.Expr, *runtime.Error) {
+func (p *Parser) parseArrayLiteral(openTok lexer.Token) (ast.Expr, *Error) {
 	elements := []ast.Expr{}
 	// [ -> already consumed
 	if p.peek().Type != lexer.CloseBracket {
@@ -654,10 +1169,10 @@ func (p *Parser) parseArrayLiteral() (ast.Expr, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ast.ArrayLiteral{Elements: elements}, nil
+	return &ast.ArrayLiteral{Position: pos(openTok), Elements: elements}, nil
 }
 
-func (p *Parser) parseMapLiteral() (ast.Expr, *runtime.Error) {
+func (p *Parser) parseMapLiteral(openTok lexer.Token) (ast.Expr, *Error) {
 	properties := []*ast.Property{}
 	// { -> already consumed
 	if p.peek().Type != lexer.CloseBrace {
@@ -688,5 +1203,5 @@ func (p *Parser) parseMapLiteral() (ast.Expr, *runtime.Error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ast.MapLiteral{Properties: properties}, nil
+	return &ast.MapLiteral{Position: pos(openTok), Properties: properties}, nil
 }
@@ -1,6 +1,9 @@
 package runtime
 
-import "fmt"
+import (
+	"DYMS/ast"
+	"strconv"
+)
 
 // OpCode represents a VM instruction opcode.
 type OpCode int
@@ -17,6 +20,12 @@ const (
 	OP_MUL
 	OP_DIV
 	OP_MOD
+	OP_IDIV          // integer (floor) division, div
+	OP_BIT_AND
+	OP_BIT_OR
+	OP_BIT_XOR
+	OP_SHL
+	OP_SHR
 	OP_CMP_EQ
 	OP_CMP_NE
 	OP_CMP_LT
@@ -29,11 +38,24 @@ const (
 	OP_RET
 	OP_POP
 	OP_GET_PROP      // object on stack, prop name as const index
+	OP_SET_PROP      // object, value on stack, prop name as const index; leaves value
 	OP_IMPORT        // alias const index, path const index
+	OP_THROW         // raise the value on top of stack as an error
+	OP_DEFINE_GLOBAL // name const index, decl kind const index
+	OP_SWITCH        // pop value, jump through jump table (table index)
+	OP_CLOSURE       // push a closure over a function const, capturing its upvalues (const index)
+	OP_LOAD_UPVALUE  // push captured variable (upvalue index)
+	OP_STORE_UPVALUE // captured variable = top of stack, leaves it (upvalue index)
+	OP_CLOSE_UPVALUES // detach upvalues of local slots >= operand from the stack (slot)
+	OP_TRY           // install a handler that resumes at the catch ip with the error on stack (absolute ip)
+	OP_END_TRY       // remove the innermost handler
+	OP_FAIL          // raise a runtime error with a message, e.g. a redeclared local (const index)
 	
 	// Fast opcodes for common patterns
 	OP_INCREMENT_LOCAL    // increment local variable by 1 (slot)
 	OP_DECREMENT_LOCAL    // decrement local variable by 1 (slot)
+	OP_INCREMENT         // add 1 to the number on top of stack
+	OP_DECREMENT         // subtract 1 from the number on top of stack
 	OP_ADD_CONST         // add constant to top of stack (const_idx)
 	OP_LOAD_CONST_0      // push constant 0 (no operands)
 	OP_LOAD_CONST_1      // push constant 1 (no operands) 
@@ -42,6 +64,7 @@ const (
 	OP_LOAD_NULL         // push null (no operands)
 	OP_DUP               // duplicate top of stack
 	OP_SWAP              // swap top two stack values
+	OP_DUP2              // duplicate the top two stack values (a b -> a b a b)
 	
 	// String operations
 	OP_CONCAT_2          // concat top 2 strings on stack
@@ -56,30 +79,91 @@ const (
 	// Loop optimization
 	OP_FOR_LOOP_START    // optimized for loop initialization
 	OP_FOR_LOOP_NEXT     // optimized for loop increment and check
+	OP_FOR_RANGE_CHECK   // jump unless counter is still short of end in step's direction (absolute ip, counter, end, step slots)
+	OP_ITER              // replace the collection on top of stack with an iterator over it
+	OP_ITER_NEXT         // push the next item of the iterator in slot, or jump when done (absolute ip, slot, pair flag)
 	
 	// Boolean operations
 	OP_NOT               // logical not
-	OP_AND               // logical and (short-circuit)
-	OP_OR                // logical or (short-circuit)
-	
-	// Math operations (fast opcodes)
-	OP_POW               // power operation (x^y)
-	OP_SQRT              // square root
-	OP_SIN               // sine
-	OP_COS               // cosine
-	OP_LOG               // natural logarithm
-	OP_EXP               // exponential (e^x)
-	OP_ABS               // absolute value
-	OP_FLOOR             // floor function
-	OP_CEIL              // ceiling function
+	OP_NEGATE            // arithmetic negation of a number
+	OP_BIT_NOT           // bitwise complement of an integer
+	OP_UNARY_PLUS        // numeric identity, errors on non-numbers
+	OP_AND               // short-circuit and: jump keeping a falsy top, else pop (absolute ip)
+	OP_OR                // short-circuit or: jump keeping a truthy top, else pop (absolute ip)
+	OP_NULLISH           // ??: jump keeping a non-null top, else pop (absolute ip)
+	OP_JUMP_IF_NULL      // ?. guard: jump keeping a null top, else fall through (absolute ip)
 )
 
+// operandCount -> number of inline operands following the opcode
+func (op OpCode) operandCount() int {
+	switch op {
+	case OP_FOR_RANGE_CHECK:
+		return 4
+	case OP_ITER_NEXT:
+		return 3
+	case OP_IMPORT, OP_DEFINE_GLOBAL:
+		return 2
+	case OP_CONST, OP_LOAD_GLOBAL, OP_STORE_GLOBAL, OP_LOAD_LOCAL, OP_STORE_LOCAL,
+		OP_JUMP, OP_JUMP_IF_FALSE, OP_CALL, OP_GET_PROP, OP_SET_PROP, OP_SWITCH,
+		OP_CLOSURE, OP_LOAD_UPVALUE, OP_STORE_UPVALUE, OP_CLOSE_UPVALUES, OP_TRY, OP_FAIL,
+		OP_INCREMENT_LOCAL, OP_DECREMENT_LOCAL, OP_ADD_CONST, OP_CONCAT_N,
+		OP_MAKE_ARRAY, OP_MAKE_MAP, OP_FOR_LOOP_START, OP_FOR_LOOP_NEXT,
+		OP_AND, OP_OR, OP_NULLISH, OP_JUMP_IF_NULL:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// isJump -> opcode whose first operand is an absolute ip
+func (op OpCode) isJump() bool {
+	switch op {
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_AND, OP_OR, OP_NULLISH, OP_JUMP_IF_NULL, OP_TRY, OP_ITER_NEXT,
+		OP_FOR_RANGE_CHECK:
+		return true
+	}
+	return false
+}
+
 // Chunk holds bytecode and a constant pool with optimizations.
 type Chunk struct {
 	Code      []int        // interleaved op and operands (ints for simplicity)
 	Consts    []RuntimeVal // constants pool
 	constMap  map[string]int // cache for constant deduplication
-	lineInfo  []int        // line number information for debugging
+	lineInfo  []ast.Position // source position of every Code slot
+	pos       ast.Position   // position stamped on newly emitted code
+	Tables    []*JumpTable   // switch dispatch tables used by OP_SWITCH
+}
+
+// JumpTable maps switch case keys to absolute ips; Default is taken on a miss.
+type JumpTable struct {
+	Targets map[string]int
+	Default int
+}
+
+// switchKey -> jump table key for numbers and strings; equal integers and floats share one
+func switchKey(v RuntimeVal) (string, bool) {
+	switch val := v.(type) {
+	case *NumberVal, *IntVal:
+		if i, ok := toInt(val); ok {
+			return "num:" + strconv.FormatInt(i, 10), true
+		}
+		f, _ := toFloat(val)
+		return "num:" + strconv.FormatFloat(f, 'g', -1, 64), true
+	case *StringVal:
+		return "str:" + val.Value, true
+	}
+	return "", false
+}
+
+// target -> ip to continue at for value
+func (t *JumpTable) target(v RuntimeVal) int {
+	if key, ok := switchKey(v); ok {
+		if ip, ok := t.Targets[key]; ok {
+			return ip
+		}
+	}
+	return t.Default
 }
 
 // NewChunk creates a new optimized chunk
@@ -88,7 +172,7 @@ func NewChunk() *Chunk {
 		Code:     make([]int, 0, 256),
 		Consts:   make([]RuntimeVal, 0, 64),
 		constMap: make(map[string]int),
-		lineInfo: make([]int, 0, 256),
+		lineInfo: make([]ast.Position, 0, 256),
 	}
 }
 
@@ -96,15 +180,70 @@ func (c *Chunk) emit(op OpCode, operands ...int) int {
 	ip := len(c.Code)
 	c.Code = append(c.Code, int(op))
 	c.Code = append(c.Code, operands...)
-	// Add line info placeholder (will be filled by compiler)
-	c.lineInfo = append(c.lineInfo, 0)
+	for i := 0; i <= len(operands); i++ {
+		c.lineInfo = append(c.lineInfo, c.pos)
+	}
 	return ip
 }
 
 // Fast emit for common single-operand instructions
 func (c *Chunk) emitFast(op OpCode, operand int) {
 	c.Code = append(c.Code, int(op), operand)
-	c.lineInfo = append(c.lineInfo, 0, 0)
+	c.lineInfo = append(c.lineInfo, c.pos, c.pos)
+}
+
+// position -> source position of the instruction at ip
+func (c *Chunk) position(ip int) ast.Position {
+	if ip < 0 || ip >= len(c.lineInfo) {
+		return ast.Position{}
+	}
+	return c.lineInfo[ip]
+}
+
+// jumpTargets -> set of ips some jump lands on
+func (c *Chunk) jumpTargets() map[int]bool {
+	targets := map[int]bool{}
+	for ip := 0; ip < len(c.Code); ip += 1 + OpCode(c.Code[ip]).operandCount() {
+		if OpCode(c.Code[ip]).isJump() {
+			targets[c.Code[ip+1]] = true
+		}
+	}
+	for _, table := range c.Tables {
+		for _, ip := range table.Targets {
+			targets[ip] = true
+		}
+		targets[table.Default] = true
+	}
+	return targets
+}
+
+// compact drops every slot not marked in keep and relocates jump targets.
+// keep must cover whole instructions (opcode and operands together).
+func (c *Chunk) compact(keep []bool) {
+	newIndex := make([]int, len(c.Code)+1)
+	code := make([]int, 0, len(c.Code))
+	lines := make([]ast.Position, 0, len(c.Code))
+	for ip, v := range c.Code {
+		newIndex[ip] = len(code)
+		if keep[ip] {
+			code = append(code, v)
+			lines = append(lines, c.lineInfo[ip])
+		}
+	}
+	newIndex[len(c.Code)] = len(code)
+	for ip := 0; ip < len(code); ip += 1 + OpCode(code[ip]).operandCount() {
+		if OpCode(code[ip]).isJump() {
+			code[ip+1] = newIndex[code[ip+1]]
+		}
+	}
+	for _, table := range c.Tables {
+		for key, ip := range table.Targets {
+			table.Targets[key] = newIndex[ip]
+		}
+		table.Default = newIndex[table.Default]
+	}
+	c.Code = code
+	c.lineInfo = lines
 }
 
 // Add constant with deduplication for better memory usage
@@ -131,10 +270,9 @@ func (c *Chunk) addConst(v RuntimeVal) int {
 func (c *Chunk) getConstKey(v RuntimeVal) string {
 	switch val := v.(type) {
 	case *NumberVal:
-		if val.Value == 0 { return "num:0" }
-		if val.Value == 1 { return "num:1" }
-		if val.Value == -1 { return "num:-1" }
-		return fmt.Sprintf("num:%f", val.Value)
+		return "num:" + strconv.FormatFloat(val.Value, 'g', -1, 64)
+	case *IntVal:
+		return "int:" + strconv.FormatInt(val.Value, 10)
 	case *StringVal:
 		if len(val.Value) < 64 { // Only cache short strings
 			return "str:" + val.Value
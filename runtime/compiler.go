@@ -2,27 +2,103 @@ package runtime
 
 import (
 	"DYMS/ast"
+	"fmt"
+	"math"
 )
 
+// localVar -> slot-backed binding, visible from its declaration to the end of its block
+type localVar struct {
+	name  string
+	slot  int
+	depth int
+	kind  ast.DeclKind
+}
+
 type functionScope struct {
-	locals     map[string]int // variable name to slot index
+	locals     []localVar              // visible locals, innermost last
+	pending    []localVar              // locals of open blocks reserved ahead of their declaration
+	kinds      map[string]ast.DeclKind // immutable globals declared at the top level
+	depth      int                     // block nesting; top-level declarations at depth 0 are globals
 	localsMax  int
 	isTopLevel bool
+	captures   []Capture // upvalues of the function being compiled
+}
+
+// resolveLocal -> innermost visible local named name
+func (s *functionScope) resolveLocal(name string) (localVar, bool) {
+	for i := len(s.locals) - 1; i >= 0; i-- {
+		if s.locals[i].name == name {
+			return s.locals[i], true
+		}
+	}
+	return localVar{}, false
+}
+
+// resolveCapture -> innermost local named name a nested function can capture: a visible
+// one, or one its block declares further down, which the function may run after
+func (s *functionScope) resolveCapture(name string) (localVar, bool) {
+	local, ok := s.resolveLocal(name)
+	for i := len(s.pending) - 1; i >= 0; i-- {
+		if p := s.pending[i]; p.name == name {
+			if !ok || p.depth > local.depth {
+				return p, true
+			}
+			break
+		}
+	}
+	return local, ok
+}
+
+// bindingScope -> where an identifier lives at runtime
+type bindingScope int
+
+const (
+	globalBinding bindingScope = iota
+	localBinding
+	upvalueBinding
+)
+
+type binding struct {
+	scope bindingScope
+	index int          // slot or upvalue index
+	kind  ast.DeclKind // "" when a global is not known to the compiler
+}
+
+// breakContext -> enclosing loop or switch that break/continue jump out of
+type breakContext struct {
+	breaks     []int  // OP_JUMPs to patch to the exit
+	continueAt int    // loop re-entry ip, -1 for switch
+	label      string // loop label, "" when unlabeled
+	tries      int    // try statements already open when the loop or switch began
+}
+
+// tryContext -> enclosing try statement; a break, continue or return leaving it
+// first removes its handler (when installed) and runs its finally block
+type tryContext struct {
+	handler bool
+	finally *ast.BlockStatement
 }
 
 type Compiler struct {
 	chunk   *Chunk
 	scopes  []*functionScope
+	file    string
+	err     *Error // first compile error
+	breaks  []*breakContext
+	tries   []*tryContext
+	enclosing *Compiler // compiler of the surrounding function, nil at the top level
+	optimizations bool  // constant folding, math opcodes and the peephole and dead code passes
+	engine    *HybridEngine // engine the compiled functions run in, nil outside one
 }
 
 func NewCompiler() *Compiler {
-	c := &Compiler{chunk: NewChunk()}
+	c := &Compiler{chunk: NewChunk(), optimizations: true}
 	c.pushScope(true)
 	return c
 }
 
 func (c *Compiler) pushScope(isTop bool) {
-	s := &functionScope{locals: map[string]int{}, isTopLevel: isTop}
+	s := &functionScope{kinds: map[string]ast.DeclKind{}, isTopLevel: isTop}
 	c.scopes = append(c.scopes, s)
 }
 
@@ -30,7 +106,8 @@ func (c *Compiler) popScope() { c.scopes = c.scopes[:len(c.scopes)-1] }
 
 func (c *Compiler) scope() *functionScope { return c.scopes[len(c.scopes)-1] }
 
-func (c *Compiler) Compile(prog *ast.Program) *VMFunction {
+func (c *Compiler) Compile(prog *ast.Program) (*VMFunction, *Error) {
+	c.file = prog.File
 	// Compile program body into a top-level function
 	for _, stmt := range prog.Body {
 		c.compileStmt(stmt)
@@ -40,34 +117,227 @@ func (c *Compiler) Compile(prog *ast.Program) *VMFunction {
 	c.chunk.emit(OP_RET)
 	
 	// Run advanced optimization passes
-	c.constantFolding()
-	c.peepholeOptimize()
-	c.deadCodeElimination()
+	if c.optimizations {
+		c.constantFolding()
+		c.peepholeOptimize()
+		c.deadCodeElimination()
+	}
 	
-	return &VMFunction{Name: "<main>", Arity: 0, Chunk: c.chunk, LocalsMax: c.scope().localsMax}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &VMFunction{Name: "<main>", File: prog.File, Arity: 0, Chunk: c.chunk, LocalsMax: c.scope().localsMax}, nil
+}
+
+// compileUserFunction -> bytecode for an interpreted function; its free variables
+// compile to globals, so it must run on a VM whose globals are the function's scope
+func (c *Compiler) compileUserFunction(f *UserFunction) (*VMFunction, *Error) {
+	c.file = f.File
+	fn := c.compileFunction(&ast.FunctionDeclaration{Name: f.Name, Params: f.Params, Body: f.Body.(*ast.BlockStatement), File: f.File})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return fn, nil
+}
+
+// fail -> records the first compile error at node's position
+func (c *Compiler) fail(node ast.Stmt, msg string) {
+	if c.err == nil {
+		pos := node.Pos()
+		c.err = NewError(msg, pos.Line, pos.Column)
+	}
+}
+
+// declare -> remembers a global's kind so later writes can be checked
+func (c *Compiler) declare(name string, kind ast.DeclKind) {
+	if kind.Mutable() {
+		delete(c.scope().kinds, name)
+	} else {
+		c.scope().kinds[name] = kind
+	}
+}
+
+// checkAssignable -> fails on writes to let/const bindings known to the compiler
+func (c *Compiler) checkAssignable(node ast.Stmt, name string) {
+	if b := c.resolve(name); !b.kind.Mutable() {
+		c.fail(node, ast.ImmutableMessage(name, b.kind))
+	}
+}
+
+// isGlobalScope -> declarations here define globals rather than locals
+func (c *Compiler) isGlobalScope() bool {
+	return c.scope().isTopLevel && c.scope().depth == 0
+}
+
+func (c *Compiler) beginBlock() { c.scope().depth++ }
+
+// endBlock -> drops the block's locals from view; their slots are not reused
+func (c *Compiler) endBlock() {
+	s := c.scope()
+	s.depth--
+	for len(s.locals) > 0 && s.locals[len(s.locals)-1].depth > s.depth {
+		s.locals = s.locals[:len(s.locals)-1]
+	}
+	for len(s.pending) > 0 && s.pending[len(s.pending)-1].depth > s.depth {
+		s.pending = s.pending[:len(s.pending)-1]
+	}
+}
+
+// reserve -> slots for the locals declared directly in the block being opened, so a
+// function nested in it can capture a sibling declared after it, as in the interpreter
+// where both share the block's environment
+func (c *Compiler) reserve(stmts []ast.Stmt) {
+	if c.isGlobalScope() {
+		return
+	}
+	s := c.scope()
+	for _, stmt := range stmts {
+		var local localVar
+		switch n := stmt.(type) {
+		case *ast.VarDeclaration:
+			local = localVar{name: n.Identifier, kind: n.DeclKind}
+		case *ast.FunctionDeclaration:
+			local = localVar{name: n.Name, kind: ast.ConstDecl}
+		}
+		if local.name == "" || c.pendingIndex(local.name) >= 0 {
+			continue
+		}
+		local.slot, local.depth = c.tempLocal(), s.depth
+		s.pending = append(s.pending, local)
+	}
+}
+
+// pendingIndex -> index of the slot reserved for name in the current block, -1 if none
+func (c *Compiler) pendingIndex(name string) int {
+	s := c.scope()
+	for i := len(s.pending) - 1; i >= 0 && s.pending[i].depth == s.depth; i-- {
+		if s.pending[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// addLocal -> fresh slot for a declaration in the current block; redeclaring a name
+// in the same block raises a runtime error when reached, as DeclareVar does for globals
+func (c *Compiler) addLocal(node ast.Stmt, name string, kind ast.DeclKind) int {
+	s := c.scope()
+	for i := len(s.locals) - 1; i >= 0 && s.locals[i].depth == s.depth; i-- {
+		if s.locals[i].name == name {
+			defer c.at(node)()
+			msg := c.chunk.addConst(&StringVal{Value: fmt.Sprintf("Cannot declare variable '%s'. It already exists.", name)})
+			c.chunk.emit(OP_FAIL, msg)
+			break
+		}
+	}
+	var slot int
+	if i := c.pendingIndex(name); i >= 0 {
+		slot = s.pending[i].slot
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+	} else {
+		slot = c.tempLocal()
+	}
+	s.locals = append(s.locals, localVar{name: name, slot: slot, depth: s.depth, kind: kind})
+	return slot
+}
+
+// resolve -> local slot, upvalue captured from an enclosing function, or global
+func (c *Compiler) resolve(name string) binding {
+	if local, ok := c.scope().resolveLocal(name); ok {
+		return binding{scope: localBinding, index: local.slot, kind: local.kind}
+	}
+	if idx, kind, ok := c.resolveUpvalue(name); ok {
+		return binding{scope: upvalueBinding, index: idx, kind: kind}
+	}
+	kind, known := c.root().scope().kinds[name]
+	if !known {
+		kind = ast.VarDecl
+	}
+	return binding{scope: globalBinding, kind: kind}
+}
+
+// root -> compiler of the program's top level
+func (c *Compiler) root() *Compiler {
+	for c.enclosing != nil {
+		c = c.enclosing
+	}
+	return c
+}
+
+// resolveUpvalue -> capture index of name when it is a local of an enclosing function,
+// threading it through every function in between
+func (c *Compiler) resolveUpvalue(name string) (int, ast.DeclKind, bool) {
+	if c.enclosing == nil {
+		return 0, "", false
+	}
+	if local, ok := c.enclosing.scope().resolveCapture(name); ok {
+		return c.addCapture(Capture{Local: true, Index: local.slot}), local.kind, true
+	}
+	if idx, kind, ok := c.enclosing.resolveUpvalue(name); ok {
+		return c.addCapture(Capture{Index: idx}), kind, true
+	}
+	return 0, "", false
+}
+
+func (c *Compiler) addCapture(capture Capture) int {
+	s := c.scope()
+	for i, existing := range s.captures {
+		if existing == capture {
+			return i
+		}
+	}
+	s.captures = append(s.captures, capture)
+	return len(s.captures) - 1
+}
+
+// emitLoad -> push the value of name
+func (c *Compiler) emitLoad(name string) {
+	switch b := c.resolve(name); b.scope {
+	case localBinding:
+		c.chunk.emit(OP_LOAD_LOCAL, b.index)
+	case upvalueBinding:
+		c.chunk.emit(OP_LOAD_UPVALUE, b.index)
+	default:
+		c.chunk.emit(OP_LOAD_GLOBAL, c.chunk.addConst(&StringVal{Value: name}))
+	}
+}
+
+// emitStore -> assign the value on top of the stack to name, leaving it there
+func (c *Compiler) emitStore(name string) {
+	switch b := c.resolve(name); b.scope {
+	case localBinding:
+		c.chunk.emit(OP_STORE_LOCAL, b.index)
+	case upvalueBinding:
+		c.chunk.emit(OP_STORE_UPVALUE, b.index)
+	default:
+		c.chunk.emit(OP_DUP)
+		c.chunk.emit(OP_STORE_GLOBAL, c.chunk.addConst(&StringVal{Value: name}))
+	}
+}
+
+// at -> stamps code emitted until the returned restore func runs with node's position
+func (c *Compiler) at(node ast.Stmt) func() {
+	prev := c.chunk.pos
+	if pos := node.Pos(); pos.Line > 0 {
+		c.chunk.pos = pos
+	}
+	return func() { c.chunk.pos = prev }
 }
 
 func (c *Compiler) compileStmt(s ast.Stmt) {
+	defer c.at(s)()
 	switch n := s.(type) {
 	case *ast.VarDeclaration:
 		c.compileExpr(n.Value)
-		if c.scope().isTopLevel {
+		if c.isGlobalScope() {
 			nameIdx := c.chunk.addConst(&StringVal{Value: n.Identifier})
-			c.chunk.emit(OP_STORE_GLOBAL, nameIdx)
+			kindIdx := c.chunk.addConst(&StringVal{Value: string(n.DeclKind)})
+			c.chunk.emit(OP_DEFINE_GLOBAL, nameIdx, kindIdx)
+			c.declare(n.Identifier, n.DeclKind)
 		} else {
-			slot := c.ensureLocal(n.Identifier)
+			slot := c.addLocal(n, n.Identifier, n.DeclKind)
 			c.chunk.emit(OP_STORE_LOCAL, slot)
-		}
-	case *ast.AssignmentExpr:
-		// Only identifier targets supported here
-		if ident, ok := n.Assignee.(*ast.Identifier); ok {
-			c.compileExpr(n.Value)
-			if slot, ok := c.scope().locals[ident.Symbol]; ok {
-				c.chunk.emit(OP_STORE_LOCAL, slot)
-			} else {
-				nameIdx := c.chunk.addConst(&StringVal{Value: ident.Symbol})
-				c.chunk.emit(OP_STORE_GLOBAL, nameIdx)
-			}
+			c.chunk.emit(OP_POP)
 		}
 	case *ast.IfStatement:
 		c.compileExpr(n.Condition)
@@ -80,59 +350,159 @@ func (c *Compiler) compileStmt(s ast.Stmt) {
 		}
 		c.patch(jend, len(c.chunk.Code))
 	case *ast.WhileStatement:
-		start := len(c.chunk.Code)
+		start := c.loopEntry()
 		c.compileExpr(n.Condition)
 		jfalse := c.chunk.emit(OP_JUMP_IF_FALSE, -1)
+		ctx := c.pushBreak(n.Label, start)
 		c.compileBlock(n.Body)
+		c.popBreak()
 		c.chunk.emit(OP_JUMP, start)
 		c.patch(jfalse, len(c.chunk.Code))
+		c.patchBreaks(ctx, len(c.chunk.Code))
 	case *ast.ForStatement:
-		// Optimized for range(i, N) compilation
-		slot := c.ensureLocal(n.Identifier.Symbol)
-		
-		// Initialize loop counter to 0 
-		c.chunk.emit(OP_LOAD_CONST_0)
-		c.chunk.emit(OP_STORE_LOCAL, slot)
-		
-		// Compile range expression once
+		// for range(i, start, end, step) -> a hidden counter, end and step held in locals;
+		// i is a fresh copy of the counter each iteration, so assigning it does not steer the loop
+		c.compileBound(n.Start, OP_LOAD_CONST_0)
 		c.compileExpr(n.Range)
-		loopStart := len(c.chunk.Code)
-		
-		// loop condition and increment
-		c.chunk.emit(OP_FOR_LOOP_NEXT, slot) 
+		c.compileBound(n.Step, OP_LOAD_CONST_1)
+		c.beginBlock()
+		defer c.endBlock()
+		counter, endSlot, stepSlot := c.tempLocal(), c.tempLocal(), c.tempLocal()
+		for _, s := range []int{stepSlot, endSlot, counter} {
+			c.chunk.emit(OP_STORE_LOCAL, s)
+			c.chunk.emit(OP_POP)
+		}
+		first := c.scope().localsMax
+		jcheck := c.chunk.emit(OP_JUMP, -1)
+
+		// counter += step, skipped on entry; each iteration keeps its own i for closures
+		next := len(c.chunk.Code)
+		c.chunk.emit(OP_CLOSE_UPVALUES, first)
+		c.chunk.emit(OP_LOAD_LOCAL, counter)
+		c.chunk.emit(OP_LOAD_LOCAL, stepSlot)
+		c.chunk.emit(OP_ADD)
+		c.chunk.emit(OP_STORE_LOCAL, counter)
+		c.chunk.emit(OP_POP)
+		c.patch(jcheck, len(c.chunk.Code))
+		restore := c.at(n.Range)
+		jdone := c.chunk.emit(OP_FOR_RANGE_CHECK, -1, counter, endSlot, stepSlot)
+		restore()
+		slot := c.addLocal(n, n.Identifier.Symbol, ast.VarDecl)
+		c.chunk.emit(OP_LOAD_LOCAL, counter)
+		c.chunk.emit(OP_STORE_LOCAL, slot)
+		c.chunk.emit(OP_POP)
+
+		ctx := c.pushBreak(n.Label, next)
+		c.compileBlock(n.Body)
+		c.popBreak()
+		c.chunk.emit(OP_JUMP, next)
+		c.patch(jdone, len(c.chunk.Code))
+		c.patchBreaks(ctx, len(c.chunk.Code))
+	case *ast.DoWhileStatement:
+		// jump body; cond: test; body: ...; jump cond -> continue re-tests the condition
+		jbody := c.chunk.emit(OP_JUMP, -1)
+		cond := c.loopEntry()
+		c.compileExpr(n.Condition)
 		jfalse := c.chunk.emit(OP_JUMP_IF_FALSE, -1)
-		
-		// Compile body
+		c.patch(jbody, len(c.chunk.Code))
+		ctx := c.pushBreak(n.Label, cond)
 		c.compileBlock(n.Body)
-		
-		// Jump back to start
-		c.chunk.emit(OP_JUMP, loopStart)
+		c.popBreak()
+		c.chunk.emit(OP_JUMP, cond)
 		c.patch(jfalse, len(c.chunk.Code))
-		
-		// Clean up (range value) from stack
-		c.chunk.emit(OP_POP)
+		c.patchBreaks(ctx, len(c.chunk.Code))
+	case *ast.ForClauseStatement:
+		// init; jump cond; post: post; cond: test; body; jump post
+		c.beginBlock()
+		defer c.endBlock()
+		if n.Init != nil {
+			c.compileStmt(n.Init)
+		}
+		jcond := c.chunk.emit(OP_JUMP, -1)
+		next := c.loopEntry()
+		if n.Post != nil {
+			c.compileExpr(n.Post)
+			c.chunk.emit(OP_POP)
+		}
+		c.patch(jcond, len(c.chunk.Code))
+		jfalse := -1
+		if n.Condition != nil {
+			c.compileExpr(n.Condition)
+			jfalse = c.chunk.emit(OP_JUMP_IF_FALSE, -1)
+		}
+
+		ctx := c.pushBreak(n.Label, next)
+		c.compileBlock(n.Body)
+		c.popBreak()
+		c.chunk.emit(OP_JUMP, next)
+		if jfalse >= 0 {
+			c.patch(jfalse, len(c.chunk.Code))
+		}
+		c.patchBreaks(ctx, len(c.chunk.Code))
+	case *ast.ForInStatement:
+		c.compileForIn(n)
 	case *ast.FunctionDeclaration:
-		fn := c.compileFunction(n)
-		idx := c.chunk.addConst(fn)
-		if c.scope().isTopLevel {
+		if n.Name == "" {
+			c.emitClosure(n)
+			c.chunk.emit(OP_POP)
+			return
+		}
+		if c.isGlobalScope() {
 			nameIdx := c.chunk.addConst(&StringVal{Value: n.Name})
-			c.chunk.emit(OP_CONST, idx)
-			c.chunk.emit(OP_STORE_GLOBAL, nameIdx)
+			kindIdx := c.chunk.addConst(&StringVal{Value: string(ast.ConstDecl)})
+			c.emitClosure(n)
+			c.chunk.emit(OP_DEFINE_GLOBAL, nameIdx, kindIdx)
+			c.declare(n.Name, ast.ConstDecl)
 		} else {
-			slot := c.ensureLocal(n.Name)
-			c.chunk.emit(OP_CONST, idx)
+			// declared first so the body can call itself through an upvalue
+			slot := c.addLocal(n, n.Name, ast.ConstDecl)
+			c.emitClosure(n)
 			c.chunk.emit(OP_STORE_LOCAL, slot)
+			c.chunk.emit(OP_POP)
 		}
+	case *ast.SwitchStatement:
+		c.compileSwitch(n)
+	case *ast.BreakStatement:
+		ctx := c.jumpTarget(n.Label, false)
+		if ctx == nil {
+			c.fail(n, "break outside of a loop or switch")
+			return
+		}
+		c.leaveTries(ctx.tries)
+		ctx.breaks = append(ctx.breaks, c.chunk.emit(OP_JUMP, -1))
+	case *ast.ContinueStatement:
+		ctx := c.jumpTarget(n.Label, true)
+		if ctx == nil {
+			c.fail(n, "continue outside of a loop")
+			return
+		}
+		c.leaveTries(ctx.tries)
+		c.chunk.emit(OP_JUMP, ctx.continueAt)
 	case *ast.ReturnStatement:
 		c.compileExpr(n.Value)
+		if len(c.tries) > 0 {
+			// the value waits in a slot while enclosing finally blocks run
+			slot := c.tempLocal()
+			c.chunk.emit(OP_STORE_LOCAL, slot)
+			c.chunk.emit(OP_POP)
+			c.leaveTries(0)
+			c.chunk.emit(OP_LOAD_LOCAL, slot)
+		}
 		c.chunk.emit(OP_RET)
+	case *ast.ThrowStatement:
+		c.compileExpr(n.Value)
+		c.chunk.emit(OP_THROW)
 	case *ast.ImportStatement:
 		aliasIdx := c.chunk.addConst(&StringVal{Value: n.Alias})
 		pathIdx := c.chunk.addConst(&StringVal{Value: n.Path})
 		c.chunk.emit(OP_IMPORT, aliasIdx, pathIdx)
+		if c.isGlobalScope() {
+			c.declare(n.Alias, ast.ConstDecl)
+		}
 	case *ast.TryStatement:
-		// For now, try-catch is not optimized - fallback to interpreter
-		c.chunk.emit(OP_CONST, c.chunk.addConst(&NullVal{}))
+		c.compileTry(n)
+	case *ast.BlockStatement:
+		c.compileBlock(n)
 	default:
 		// expression statement
 		c.compileExpr(n.(ast.Expr))
@@ -140,64 +510,279 @@ func (c *Compiler) compileStmt(s ast.Stmt) {
 	}
 }
 
-// Constant folding optimization
-func (c *Compiler) foldConstants(left, right float64, op string) RuntimeVal {
-	switch op {
-	case "+": return &NumberVal{Value: left + right}
-	case "-": return &NumberVal{Value: left - right}
-	case "*": return &NumberVal{Value: left * right}
-	case "/":
-		if right == 0 { return nil }
-		return &NumberVal{Value: left / right}
-	case "%":
-		if right == 0 { return nil }
-		return &NumberVal{Value: float64(int(left) % int(right))}
-	case "==": return &BooleanVal{Value: left == right}
-	case "!=": return &BooleanVal{Value: left != right}
-	case "<": return &BooleanVal{Value: left < right}
-	case "<=": return &BooleanVal{Value: left <= right}
-	case ">": return &BooleanVal{Value: left > right}
-	case ">=": return &BooleanVal{Value: left >= right}
+func (c *Compiler) pushBreak(label string, continueAt int) *breakContext {
+	ctx := &breakContext{continueAt: continueAt, label: label, tries: len(c.tries)}
+	c.breaks = append(c.breaks, ctx)
+	return ctx
+}
+
+func (c *Compiler) popBreak() { c.breaks = c.breaks[:len(c.breaks)-1] }
+
+// jumpTarget -> context a break/continue leaves: the labeled loop, else the innermost
+// loop (or switch, for break); nil when there is none
+func (c *Compiler) jumpTarget(label string, isContinue bool) *breakContext {
+	for i := len(c.breaks) - 1; i >= 0; i-- {
+		ctx := c.breaks[i]
+		if label != "" {
+			if ctx.label == label {
+				return ctx
+			}
+			continue
+		}
+		if !isContinue || ctx.continueAt >= 0 {
+			return ctx
+		}
 	}
 	return nil
 }
 
-// Advanced pattern optimization
-func (c *Compiler) tryOptimizeBinaryPattern(n *ast.BinaryExpr) bool {
-	// x + 0 or 0 + x -> x
-	if n.Operator == "+" {
-		if leftNum, ok := n.Left.(*ast.NumericLiteral); ok && leftNum.Value == 0 {
-			c.compileExpr(n.Right)
-			return true
+func (c *Compiler) patchBreaks(ctx *breakContext, target int) {
+	for _, jump := range ctx.breaks {
+		c.patch(jump, target)
+	}
+}
+
+// leaveTries -> code for a jump out of the try statements above depth: innermost
+// first, each handler is removed and each finally block runs inline
+func (c *Compiler) leaveTries(depth int) {
+	open := c.tries
+	defer func() { c.tries = open }()
+	for i := len(open) - 1; i >= depth; i-- {
+		c.tries = open[:i]
+		if open[i].handler {
+			c.chunk.emit(OP_END_TRY)
+		}
+		if open[i].finally != nil {
+			c.compileBlock(open[i].finally)
+		}
+	}
+}
+
+// compileTry -> try body under a handler; the handler binds the error for catch, and
+// with a finally block the error path runs it and raises the error again:
+//
+//	TRY h1; try; END_TRY; JUMP done
+//	h1: [catch (under TRY h2 with finally); JUMP done]
+//	h2: [finally; THROW error]
+//	done: [finally]
+func (c *Compiler) compileTry(n *ast.TryStatement) {
+	c.tries = append(c.tries, &tryContext{handler: true, finally: n.FinallyBlock})
+	try := c.chunk.emit(OP_TRY, -1)
+	c.compileBlock(n.TryBlock)
+	c.tries = c.tries[:len(c.tries)-1]
+	c.chunk.emit(OP_END_TRY)
+	done := []int{c.chunk.emit(OP_JUMP, -1)}
+	c.patch(try, len(c.chunk.Code))
+
+	if n.CatchBlock != nil {
+		c.beginBlock()
+		if n.ErrorVar != "" {
+			c.chunk.emit(OP_STORE_LOCAL, c.addLocal(n, n.ErrorVar, ast.VarDecl))
+		}
+		c.chunk.emit(OP_POP)
+		rethrow := -1
+		if n.FinallyBlock != nil {
+			rethrow = c.chunk.emit(OP_TRY, -1)
+		}
+		c.tries = append(c.tries, &tryContext{handler: n.FinallyBlock != nil, finally: n.FinallyBlock})
+		c.compileBlock(n.CatchBlock)
+		c.tries = c.tries[:len(c.tries)-1]
+		c.endBlock()
+		if rethrow >= 0 {
+			c.chunk.emit(OP_END_TRY)
+		}
+		done = append(done, c.chunk.emit(OP_JUMP, -1))
+		if rethrow >= 0 {
+			c.patch(rethrow, len(c.chunk.Code))
+		}
+	}
+	if n.FinallyBlock != nil {
+		slot := c.tempLocal()
+		c.chunk.emit(OP_STORE_LOCAL, slot)
+		c.chunk.emit(OP_POP)
+		c.compileBlock(n.FinallyBlock)
+		c.chunk.emit(OP_LOAD_LOCAL, slot)
+		c.chunk.emit(OP_THROW)
+	}
+
+	for _, jump := range done {
+		c.patch(jump, len(c.chunk.Code))
+	}
+	if n.FinallyBlock != nil {
+		c.compileBlock(n.FinallyBlock)
+	}
+}
+
+// compileForIn -> the iterator lives in a hidden local; every iteration stores the next
+// item (or key and value) into fresh loop variables
+func (c *Compiler) compileForIn(n *ast.ForInStatement) {
+	restore := c.at(n.Collection)
+	c.compileExpr(n.Collection)
+	c.chunk.emit(OP_ITER)
+	restore()
+	c.beginBlock()
+	defer c.endBlock()
+	iter := c.tempLocal()
+	c.chunk.emit(OP_STORE_LOCAL, iter)
+	c.chunk.emit(OP_POP)
+
+	first := c.scope().localsMax
+	next := len(c.chunk.Code)
+	c.chunk.emit(OP_CLOSE_UPVALUES, first)
+	pair := 0
+	if n.Key != nil {
+		pair = 1
+	}
+	jdone := c.chunk.emit(OP_ITER_NEXT, -1, iter, pair)
+	if n.Key != nil {
+		key := c.addLocal(n.Key, n.Key.Symbol, ast.VarDecl)
+		value := c.addLocal(n.Value, n.Value.Symbol, ast.VarDecl)
+		c.chunk.emit(OP_STORE_LOCAL, value)
+		c.chunk.emit(OP_POP)
+		c.chunk.emit(OP_STORE_LOCAL, key)
+		c.chunk.emit(OP_POP)
+	} else {
+		c.chunk.emit(OP_STORE_LOCAL, c.addLocal(n.Value, n.Value.Symbol, ast.VarDecl))
+		c.chunk.emit(OP_POP)
+	}
+
+	ctx := c.pushBreak(n.Label, next)
+	c.compileBlock(n.Body)
+	c.popBreak()
+	c.chunk.emit(OP_JUMP, next)
+	c.patch(jdone, len(c.chunk.Code))
+	c.patchBreaks(ctx, len(c.chunk.Code))
+}
+
+// compileSwitch -> dense constant cases dispatch through OP_SWITCH, anything else
+// through a chain of equality tests; every case body ends by jumping to the exit
+func (c *Compiler) compileSwitch(n *ast.SwitchStatement) {
+	c.compileExpr(n.Discriminant)
+
+	fallback := -1
+	for i, clause := range n.Cases {
+		if len(clause.Values) == 0 && fallback < 0 {
+			fallback = i
 		}
-		if rightNum, ok := n.Right.(*ast.NumericLiteral); ok && rightNum.Value == 0 {
-			c.compileExpr(n.Left)
-			return true
+	}
+
+	var table *JumpTable
+	caseOf := map[string]int{} // jump table key -> case index
+	hits := map[int][]int{}    // case index -> OP_JUMPs into its body
+	var miss int
+	if keys := switchTableKeys(n); keys != nil {
+		table = &JumpTable{Targets: map[string]int{}}
+		caseOf = keys
+		c.chunk.Tables = append(c.chunk.Tables, table)
+		c.chunk.emit(OP_SWITCH, len(c.chunk.Tables)-1)
+	} else {
+		for i, clause := range n.Cases {
+			for _, value := range clause.Values {
+				c.chunk.emit(OP_DUP)
+				c.compileExpr(value)
+				c.chunk.emit(OP_CMP_EQ)
+				skip := c.chunk.emit(OP_JUMP_IF_FALSE, -1)
+				c.chunk.emit(OP_POP)
+				hits[i] = append(hits[i], c.chunk.emit(OP_JUMP, -1))
+				c.patch(skip, len(c.chunk.Code))
+			}
 		}
+		c.chunk.emit(OP_POP)
+		miss = c.chunk.emit(OP_JUMP, -1)
 	}
-	// x * 1 or 1 * x -> x
-	if n.Operator == "*" {
-		if leftNum, ok := n.Left.(*ast.NumericLiteral); ok && leftNum.Value == 1 {
-			c.compileExpr(n.Right)
-			return true
+
+	ctx := c.pushBreak("", -1)
+	starts := make([]int, len(n.Cases))
+	for i, clause := range n.Cases {
+		starts[i] = len(c.chunk.Code)
+		for _, jump := range hits[i] {
+			c.patch(jump, starts[i])
 		}
-		if rightNum, ok := n.Right.(*ast.NumericLiteral); ok && rightNum.Value == 1 {
-			c.compileExpr(n.Left)
-			return true
+		c.compileBlock(clause.Body)
+		ctx.breaks = append(ctx.breaks, c.chunk.emit(OP_JUMP, -1))
+	}
+	c.popBreak()
+	end := len(c.chunk.Code)
+	c.patchBreaks(ctx, end)
+
+	exit := end
+	if fallback >= 0 {
+		exit = starts[fallback]
+	}
+	if table != nil {
+		for key, i := range caseOf {
+			table.Targets[key] = starts[i]
 		}
+		table.Default = exit
+	} else {
+		c.patch(miss, exit)
 	}
-	// x * 0 or 0 * x -> 0
-	if n.Operator == "*" {
-		if leftNum, ok := n.Left.(*ast.NumericLiteral); ok && leftNum.Value == 0 {
-			c.chunk.emit(OP_LOAD_CONST_0)
-			return true
+}
+
+// switchTableKeys -> case index per key when every case value is a number or
+// string literal and the numeric ones are dense integers; nil otherwise
+func switchTableKeys(n *ast.SwitchStatement) map[string]int {
+	keys := map[string]int{}
+	var numbers []float64
+	for i, clause := range n.Cases {
+		for _, value := range clause.Values {
+			var key string
+			switch lit := value.(type) {
+			case *ast.NumericLiteral, *ast.IntegerLiteral:
+				num, _ := literalNumber(lit)
+				whole, ok := toInt(num)
+				if !ok {
+					return nil
+				}
+				numbers = append(numbers, float64(whole))
+				key, _ = switchKey(num)
+			case *ast.StringLiteral:
+				key, _ = switchKey(&StringVal{Value: lit.Value})
+			default:
+				return nil
+			}
+			if _, seen := keys[key]; !seen {
+				keys[key] = i // first case with the value wins
+			}
 		}
-		if rightNum, ok := n.Right.(*ast.NumericLiteral); ok && rightNum.Value == 0 {
-			c.chunk.emit(OP_LOAD_CONST_0)
-			return true
+	}
+	if len(keys) < 2 {
+		return nil
+	}
+	if len(numbers) > 0 {
+		lo, hi := numbers[0], numbers[0]
+		for _, v := range numbers {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
 		}
+		if hi-lo+1 > float64(2*len(numbers)) {
+			return nil
+		}
+	}
+	return keys
+}
+
+// literalNumber -> value of a numeric or integer literal
+func literalNumber(e ast.Expr) (RuntimeVal, bool) {
+	switch lit := e.(type) {
+	case *ast.NumericLiteral:
+		return &NumberVal{Value: lit.Value}, true
+	case *ast.IntegerLiteral:
+		return &IntVal{Value: lit.Value}, true
 	}
-	return false
+	return nil, false
+}
+
+// Constant folding optimization; a failing operation is left for runtime to raise
+func (c *Compiler) foldConstants(left, right RuntimeVal, op string) RuntimeVal {
+	if isArithmetic(op) {
+		value, err := numericOp(op, left, right)
+		if err != nil { return nil }
+		return value
+	}
+	if result, ok := compareNumbers(op, left, right); ok {
+		return &BooleanVal{Value: result}
+	}
+	return nil
 }
 
 // Constant folding pass
@@ -208,28 +793,38 @@ func (c *Compiler) constantFolding() {
 // Peephole optimization pass
 func (c *Compiler) peepholeOptimize() {
 	code := c.chunk.Code
-	for i := 0; i < len(code)-2; i++ {
-		// LOAD_CONST followed by POP -> remove both
-		if i+1 < len(code) && OpCode(code[i]) == OP_CONST && OpCode(code[i+2]) == OP_POP {
-			copy(code[i:], code[i+3:])
-			c.chunk.Code = code[:len(code)-3]
+	targets := c.chunk.jumpTargets()
+	keep := make([]bool, len(code))
+	for i := range keep {
+		keep[i] = true
+	}
+	for ip := 0; ip < len(code); {
+		op := OpCode(code[ip])
+		next := ip + 1 + op.operandCount()
+		// never fuse across a jump target
+		if next >= len(code) || targets[next] {
+			ip = next
 			continue
 		}
-		// LOAD_TRUE/FALSE followed by JUMP_IF_FALSE -> optimize
-		if OpCode(code[i]) == OP_LOAD_FALSE && OpCode(code[i+1]) == OP_JUMP_IF_FALSE {
+		nextOp := OpCode(code[next])
+		switch {
+		case op == OP_CONST && nextOp == OP_POP:
+			// LOAD_CONST followed by POP -> remove both
+			keep[ip], keep[ip+1], keep[next] = false, false, false
+			next++
+		case op == OP_LOAD_FALSE && nextOp == OP_JUMP_IF_FALSE:
 			// Always jump - convert to direct JUMP
-			code[i] = int(OP_JUMP)
-			copy(code[i+1:], code[i+2:])
-			c.chunk.Code = code[:len(code)-1]
-			continue
-		}
-		if OpCode(code[i]) == OP_LOAD_TRUE && OpCode(code[i+1]) == OP_JUMP_IF_FALSE {
+			keep[ip] = false
+			code[next] = int(OP_JUMP)
+			next += 2
+		case op == OP_LOAD_TRUE && nextOp == OP_JUMP_IF_FALSE:
 			// Never jump - remove both instructions
-			copy(code[i:], code[i+3:])
-			c.chunk.Code = code[:len(code)-3]
-			continue
+			keep[ip], keep[next], keep[next+1] = false, false, false
+			next += 2
 		}
+		ip = next
 	}
+	c.chunk.compact(keep)
 }
 
 // Dead code elimination
@@ -241,75 +836,108 @@ func (c *Compiler) deadCodeElimination() {
 	c.markReachable(code, reachable, 0)
 	
 	// Remove unreachable code
-	newCode := make([]int, 0, len(code))
-	for i, op := range code {
-		if reachable[i] {
-			newCode = append(newCode, op)
-		}
-	}
-	c.chunk.Code = newCode
+	c.chunk.compact(reachable)
 }
 
 func (c *Compiler) markReachable(code []int, reachable []bool, start int) {
 	for i := start; i < len(code); {
 		if reachable[i] { return } // Already visited
-		reachable[i] = true
-		
 		op := OpCode(code[i])
+		width := 1 + op.operandCount()
+		for j := i; j < i+width && j < len(code); j++ {
+			reachable[j] = true
+		}
+		
 		switch op {
 		case OP_JUMP:
-			if i+1 < len(code) {
-				c.markReachable(code, reachable, code[i+1])
-			}
+			c.markReachable(code, reachable, code[i+1])
 			return
-		case OP_JUMP_IF_FALSE:
-			if i+2 < len(code) {
-				c.markReachable(code, reachable, code[i+1])
-				i += 2
-			} else {
-				return
+		case OP_JUMP_IF_FALSE, OP_AND, OP_OR, OP_NULLISH, OP_JUMP_IF_NULL, OP_TRY, OP_ITER_NEXT,
+			OP_FOR_RANGE_CHECK:
+			c.markReachable(code, reachable, code[i+1])
+		case OP_SWITCH:
+			table := c.chunk.Tables[code[i+1]]
+			for _, target := range table.Targets {
+				c.markReachable(code, reachable, target)
 			}
-		case OP_RET:
+			c.markReachable(code, reachable, table.Default)
+			return
+		case OP_RET, OP_THROW, OP_FAIL:
 			return
-		case OP_CONST, OP_LOAD_GLOBAL, OP_STORE_GLOBAL, OP_LOAD_LOCAL, OP_STORE_LOCAL:
-			i += 2
-		default:
-			i++
 		}
+		i += width
 	}
 }
 
 func (c *Compiler) compileBlock(b *ast.BlockStatement) {
+	c.beginBlock()
+	c.reserve(b.Statements)
 	for _, stmt := range b.Statements {
 		c.compileStmt(stmt)
 	}
+	c.endBlock()
+}
+
+// loopEntry -> ip a loop re-enters at; it first closes the upvalues of the previous
+// iteration so closures keep the values they saw, as in the interpreter
+func (c *Compiler) loopEntry() int {
+	entry := len(c.chunk.Code)
+	c.chunk.emit(OP_CLOSE_UPVALUES, c.scope().localsMax)
+	return entry
 }
 
 func (c *Compiler) compileFunction(fd *ast.FunctionDeclaration) *VMFunction {
 	// compiler for function body with optimized chunk
-	inner := &Compiler{chunk: NewChunk()}
+	inner := &Compiler{chunk: NewChunk(), file: fd.File, enclosing: c}
 	inner.pushScope(false)
-	// Reserving locals for params
+	// params -> the first locals
 	for _, p := range fd.Params {
-		slot := inner.ensureLocal(p)
-		_ = slot
+		inner.addLocal(fd, p, ast.VarDecl)
+	}
+	// as in the interpreter, a body ending in an expression statement returns its value
+	inner.beginBlock()
+	inner.reserve(fd.Body.Statements)
+	for i, stmt := range fd.Body.Statements {
+		if expr, ok := stmt.(ast.Expr); ok && i == len(fd.Body.Statements)-1 && !isDeclaration(stmt) {
+			inner.compileExpr(expr)
+			inner.chunk.emit(OP_RET)
+			break
+		}
+		inner.compileStmt(stmt)
 	}
-	inner.compileBlock(fd.Body)
+	inner.endBlock()
 	inner.chunk.emit(OP_LOAD_NULL)
 	inner.chunk.emit(OP_RET)
-	return &VMFunction{Name: fd.Name, Arity: len(fd.Params), Chunk: inner.chunk, LocalsMax: inner.scope().localsMax}
+	if c.err == nil {
+		c.err = inner.err
+	}
+	return &VMFunction{Name: fd.Name, File: fd.File, Arity: len(fd.Params), Chunk: inner.chunk, LocalsMax: inner.scope().localsMax, Captures: inner.scope().captures, engine: c.root().engine}
+}
+
+// emitClosure -> push fd as a function value; one with free variables becomes a
+// closure over the current frame
+func (c *Compiler) emitClosure(fd *ast.FunctionDeclaration) {
+	fn := c.compileFunction(fd)
+	op := OP_CONST
+	if len(fn.Captures) > 0 {
+		op = OP_CLOSURE
+	}
+	c.chunk.emit(op, c.chunk.addConst(fn))
 }
 
 func (c *Compiler) compileExpr(e ast.Expr) {
+	defer c.at(e)()
 	switch n := e.(type) {
 	case *ast.NumericLiteral:
+		c.chunk.emit(OP_CONST, c.chunk.addConst(&NumberVal{Value: n.Value}))
+	case *ast.IntegerLiteral:
 		// Use opcodes for common constants
 		if n.Value == 0 {
 			c.chunk.emit(OP_LOAD_CONST_0)
 		} else if n.Value == 1 {
 			c.chunk.emit(OP_LOAD_CONST_1)
 		} else {
-			c.chunk.emit(OP_CONST, c.chunk.addConst(&NumberVal{Value: n.Value}))
+			c.chunk.emit(OP_CONST, c.chunk.addConst(&IntVal{Value: n.Value}))
 		}
 	case *ast.StringLiteral:
 		c.chunk.emit(OP_CONST, c.chunk.addConst(&StringVal{Value: n.Value}))
@@ -321,160 +949,260 @@ func (c *Compiler) compileExpr(e ast.Expr) {
 			c.chunk.emit(OP_LOAD_FALSE)
 		}
 	case *ast.Identifier:
-		if slot, ok := c.scope().locals[n.Symbol]; ok {
-			c.chunk.emit(OP_LOAD_LOCAL, slot)
-		} else {
-			nameIdx := c.chunk.addConst(&StringVal{Value: n.Symbol})
-			c.chunk.emit(OP_LOAD_GLOBAL, nameIdx)
-		}
+		c.emitLoad(n.Symbol)
 	case *ast.BinaryExpr:
 		// Constant folding optimization
-		if leftNum, ok1 := n.Left.(*ast.NumericLiteral); ok1 {
-			if rightNum, ok2 := n.Right.(*ast.NumericLiteral); ok2 {
-				if folded := c.foldConstants(leftNum.Value, rightNum.Value, n.Operator); folded != nil {
+		if leftNum, ok1 := literalNumber(n.Left); ok1 && c.root().optimizations {
+			if rightNum, ok2 := literalNumber(n.Right); ok2 {
+				if folded := c.foldConstants(leftNum, rightNum, n.Operator); folded != nil {
 					c.chunk.emit(OP_CONST, c.chunk.addConst(folded))
 					return
 				}
 			}
 		}
-		// Fast path for common patterns
-		if c.tryOptimizeBinaryPattern(n) {
+		if n.Operator == "&&" || n.Operator == "||" || n.Operator == "??" {
+			c.compileLogical(n)
 			return
 		}
 		c.compileExpr(n.Left)
 		c.compileExpr(n.Right)
+		c.emitBinary(n, n.Operator)
+	case *ast.AssignmentExpr:
+		c.compileAssignment(n)
+	case *ast.CallExpr, *ast.MemberExpr, *ast.IndexExpr:
+		var skips []int
+		c.compileChain(n, &skips)
+		for _, jump := range skips {
+			c.patch(jump, len(c.chunk.Code))
+		}
+	case *ast.NullLiteral:
+		c.chunk.emit(OP_LOAD_NULL)
+	case *ast.FunctionDeclaration:
+		c.emitClosure(n)
+	case *ast.ArrayLiteral:
+		for _, el := range n.Elements {
+			c.compileExpr(el)
+		}
+		c.chunk.emit(OP_MAKE_ARRAY, len(n.Elements))
+	case *ast.MapLiteral:
+		for _, prop := range n.Properties {
+			c.compileExpr(prop.Key)
+			c.compileExpr(prop.Value)
+		}
+		c.chunk.emit(OP_MAKE_MAP, len(n.Properties))
+	case *ast.UnaryExpr:
 		switch n.Operator {
-		case "+": c.chunk.emit(OP_ADD)
-		case "-": c.chunk.emit(OP_SUB)
-		case "*": c.chunk.emit(OP_MUL)
-		case "/": c.chunk.emit(OP_DIV)
-		case "%": c.chunk.emit(OP_MOD)
-		case "==": c.chunk.emit(OP_CMP_EQ)
-		case "!=": c.chunk.emit(OP_CMP_NE)
-		case "<":  c.chunk.emit(OP_CMP_LT)
-		case "<=": c.chunk.emit(OP_CMP_LE)
-		case ">":  c.chunk.emit(OP_CMP_GT)
-		case ">=": c.chunk.emit(OP_CMP_GE)
+		case "++", "--":
+			c.compileIncDec(n)
+		default:
+			c.compilePrefix(n)
 		}
-	case *ast.CallExpr:
-		// Checking for optimizable math function calls
-		if c.tryOptimizeMathCall(n) {
-			return
+	default:
+		c.fail(e, fmt.Sprintf("unsupported expression %T", e))
+	}
+}
+
+// binaryOpcodes -> opcode of each non short-circuit binary operator
+var binaryOpcodes = map[string]OpCode{
+	"+": OP_ADD, "-": OP_SUB, "*": OP_MUL, "/": OP_DIV, "%": OP_MOD, "div": OP_IDIV,
+	"&": OP_BIT_AND, "|": OP_BIT_OR, "^": OP_BIT_XOR, "<<": OP_SHL, ">>": OP_SHR,
+	"==": OP_CMP_EQ, "!=": OP_CMP_NE,
+	"<": OP_CMP_LT, "<=": OP_CMP_LE, ">": OP_CMP_GT, ">=": OP_CMP_GE,
+}
+
+// binaryOperators -> source operator of each binary opcode, for the VM's non-numeric path
+var binaryOperators = map[OpCode]string{}
+
+func init() {
+	for operator, op := range binaryOpcodes {
+		binaryOperators[op] = operator
+	}
+}
+
+func (c *Compiler) emitBinary(node ast.Stmt, operator string) {
+	op, ok := binaryOpcodes[operator]
+	if !ok {
+		c.fail(node, "unsupported operator "+operator)
+		return
+	}
+	c.chunk.emit(op)
+}
+
+// compileAssignment -> stores into an identifier, index or member target and
+// leaves the stored value on the stack; compound forms read the target first
+func (c *Compiler) compileAssignment(n *ast.AssignmentExpr) {
+	// value -> right-hand side, combined with the current value on the stack for op=
+	value := func() {
+		c.compileExpr(n.Value)
+		if n.Operator != "" {
+			c.emitBinary(n, n.Operator)
+		}
+	}
+	switch target := n.Assignee.(type) {
+	case *ast.Identifier:
+		c.checkAssignable(n, target.Symbol)
+		if n.Operator != "" {
+			c.emitLoad(target.Symbol)
+		}
+		value()
+		c.emitStore(target.Symbol)
+	case *ast.IndexExpr:
+		c.compileExpr(target.Object)
+		c.compileExpr(target.Index)
+		if n.Operator != "" {
+			c.chunk.emit(OP_DUP2)
+			c.chunk.emit(OP_GET_INDEX)
 		}
-		// Defaults function call
-		c.compileExpr(n.Callee)
+		value()
+		c.chunk.emit(OP_SET_INDEX)
+	case *ast.MemberExpr:
+		nameIdx := c.chunk.addConst(&StringVal{Value: target.Property.Symbol})
+		c.compileExpr(target.Object)
+		if n.Operator != "" {
+			c.chunk.emit(OP_DUP)
+			c.chunk.emit(OP_GET_PROP, nameIdx)
+		}
+		value()
+		c.chunk.emit(OP_SET_PROP, nameIdx)
+	default:
+		c.fail(n, "invalid assignment target")
+	}
+}
+
+// compileLogical -> short-circuit &&, || and ?? leaving the deciding operand on the stack
+func (c *Compiler) compileLogical(n *ast.BinaryExpr) {
+	c.compileExpr(n.Left)
+	op := OP_AND
+	switch n.Operator {
+	case "||":
+		op = OP_OR
+	case "??":
+		op = OP_NULLISH
+	}
+	jump := c.chunk.emit(op, -1)
+	c.compileExpr(n.Right)
+	c.patch(jump, len(c.chunk.Code))
+}
+
+// compileChain -> one link of a member/index/call chain; a ?. adds a jump to skips
+// that the caller patches past the whole chain, leaving null on the stack
+func (c *Compiler) compileChain(e ast.Expr, skips *[]int) {
+	defer c.at(e)()
+	switch n := e.(type) {
+	case *ast.CallExpr:
+		c.compileChain(n.Callee, skips)
 		for _, a := range n.Args { c.compileExpr(a) }
 		c.chunk.emit(OP_CALL, len(n.Args))
 	case *ast.MemberExpr:
-		c.compileExpr(n.Object)
+		c.compileChain(n.Object, skips)
+		if n.Optional {
+			*skips = append(*skips, c.chunk.emit(OP_JUMP_IF_NULL, -1))
+		}
 		nameIdx := c.chunk.addConst(&StringVal{Value: n.Property.Symbol})
 		c.chunk.emit(OP_GET_PROP, nameIdx)
-	case *ast.ArrayLiteral:
-		c.chunk.emit(OP_CONST, c.chunk.addConst(&NullVal{}))
-	case *ast.MapLiteral:
-		c.chunk.emit(OP_CONST, c.chunk.addConst(&NullVal{}))
-	case *ast.UnaryExpr:
-		// For now, unary expressions are not optimized - fallback to interpreter
-		c.chunk.emit(OP_CONST, c.chunk.addConst(&NullVal{}))
+	case *ast.IndexExpr:
+		c.compileChain(n.Object, skips)
+		if n.Optional {
+			*skips = append(*skips, c.chunk.emit(OP_JUMP_IF_NULL, -1))
+		}
+		c.compileExpr(n.Index)
+		c.chunk.emit(OP_GET_INDEX)
 	default:
-		c.chunk.emit(OP_CONST, c.chunk.addConst(&NullVal{}))
+		c.compileExpr(e)
+	}
+}
+
+// compilePrefix -> -x, +x, ~x and !x; negative numeric literals fold to a constant
+func (c *Compiler) compilePrefix(n *ast.UnaryExpr) {
+	if lit, ok := literalNumber(n.Operand); ok && n.Operator == "-" {
+		negated, _ := negate(lit)
+		c.chunk.emit(OP_CONST, c.chunk.addConst(negated))
+		return
+	}
+	c.compileExpr(n.Operand)
+	switch n.Operator {
+	case "-":
+		c.chunk.emit(OP_NEGATE)
+	case "+":
+		c.chunk.emit(OP_UNARY_PLUS)
+	case "~":
+		c.chunk.emit(OP_BIT_NOT)
+	case "!":
+		c.chunk.emit(OP_NOT)
+	}
+}
+
+// compileIncDec -> ++/-- on an identifier, leaving the new (prefix) or old (postfix) value
+func (c *Compiler) compileIncDec(n *ast.UnaryExpr) {
+	ident, ok := n.Operand.(*ast.Identifier)
+	if !ok {
+		c.fail(n, "increment/decrement target must be an identifier")
+		return
+	}
+	c.checkAssignable(n, ident.Symbol)
+	if b := c.resolve(ident.Symbol); b.scope == localBinding {
+		op := OP_INCREMENT_LOCAL
+		if n.Operator == "--" {
+			op = OP_DECREMENT_LOCAL
+		}
+		if n.Prefix {
+			c.chunk.emit(op, b.index)
+			c.chunk.emit(OP_LOAD_LOCAL, b.index)
+		} else {
+			c.chunk.emit(OP_LOAD_LOCAL, b.index)
+			c.chunk.emit(op, b.index)
+		}
+		return
+	}
+	c.emitLoad(ident.Symbol)
+	if !n.Prefix {
+		c.chunk.emit(OP_DUP)
+	}
+	if n.Operator == "--" {
+		c.chunk.emit(OP_DECREMENT)
+	} else {
+		c.chunk.emit(OP_INCREMENT)
+	}
+	c.emitStore(ident.Symbol)
+	if !n.Prefix {
+		c.chunk.emit(OP_POP)
 	}
 }
 
-func (c *Compiler) ensureLocal(name string) int {
-	if slot, ok := c.scope().locals[name]; ok { return slot }
+// tempLocal -> unnamed slot for compiler bookkeeping such as loop bounds
+func (c *Compiler) tempLocal() int {
 	s := c.scope()
 	slot := s.localsMax
-	s.locals[name] = slot
 	s.localsMax++
 	return slot
 }
 
+// compileBound -> optional for range bound, def when it is omitted
+func (c *Compiler) compileBound(e ast.Expr, def OpCode) {
+	if e == nil {
+		c.chunk.emit(def)
+		return
+	}
+	c.compileExpr(e)
+}
+
 func (c *Compiler) patch(jumpPos int, target int) {
 	// jumpPos points to the opcode; operand is at jumpPos+1
 	c.chunk.Code[jumpPos+1] = target
 }
 
-// math function calls to fast opcodes
-func (c *Compiler) tryOptimizeMathCall(call *ast.CallExpr) bool {
-	if memberExpr, ok := call.Callee.(*ast.MemberExpr); ok {
-		if ident, ok := memberExpr.Object.(*ast.Identifier); ok {
-			if ident.Symbol == "math" || ident.Symbol == "m" {
-				switch memberExpr.Property.Symbol {
-				case "pow":
-					if len(call.Args) == 2 {
-						c.compileExpr(call.Args[0]) // base
-						c.compileExpr(call.Args[1]) // exponent
-						c.chunk.emit(OP_POW)
-						return true
-					}
-				case "sqrt":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_SQRT)
-						return true
-					}
-				case "sin":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_SIN)
-						return true
-					}
-				case "cos":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_COS)
-						return true
-					}
-				case "log":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_LOG)
-						return true
-					}
-				case "exp":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_EXP)
-						return true
-					}
-				case "abs":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_ABS)
-						return true
-					}
-				case "floor":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_FLOOR)
-						return true
-					}
-				case "ceil":
-					if len(call.Args) == 1 {
-						c.compileExpr(call.Args[0])
-						c.chunk.emit(OP_CEIL)
-						return true
-					}
-				}
-			}
-		}
-	}
-	return false
-}
-
 // Peephole pass
 func (c *Compiler) optimize() {
 	code := c.chunk.Code
 	for i := 0; i < len(code)-2; i++ {
 		if OpCode(code[i]) == OP_CONST && code[i+1] < len(c.chunk.Consts) {
-			if num, ok := c.chunk.Consts[code[i+1]].(*NumberVal); ok && num.Value == 0 {
+			if num, ok := c.chunk.Consts[code[i+1]].(*IntVal); ok && num.Value == 0 {
 				code[i] = int(OP_LOAD_CONST_0)
 				copy(code[i+1:], code[i+2:])
 				c.chunk.Code = code[:len(code)-1]
 				continue
 			}
-			if num, ok := c.chunk.Consts[code[i+1]].(*NumberVal); ok && num.Value == 1 {
+			if num, ok := c.chunk.Consts[code[i+1]].(*IntVal); ok && num.Value == 1 {
 				code[i] = int(OP_LOAD_CONST_1)
 				copy(code[i+1:], code[i+2:])
 				c.chunk.Code = code[:len(code)-1]
@@ -500,7 +1228,7 @@ func (c *Compiler) optimize() {
 			code[i+1] == code[i+6] { // same slot
 			
 			if constIdx := code[i+3]; constIdx < len(c.chunk.Consts) {
-				if num, ok := c.chunk.Consts[constIdx].(*NumberVal); ok && num.Value == 1 {
+				if num, ok := c.chunk.Consts[constIdx].(*IntVal); ok && num.Value == 1 {
 					// Replace with increment opcode
 					code[i] = int(OP_INCREMENT_LOCAL)
 					copy(code[i+2:], code[i+7:])
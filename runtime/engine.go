@@ -0,0 +1,324 @@
+package runtime
+
+import (
+	"DYMS/ast"
+	"DYMS/lexer"
+	"DYMS/parser"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Engine is one isolated DYMS instance for a Go host: it owns its globals, the built-ins
+// and modules scripts may use and the engine running them, so several can run side by
+// side and a fresh one starts from a clean state.
+type Engine struct {
+	globals  *Environment
+	hybrid   *HybridEngine
+	opts     Options
+	stdout   io.Writer
+	stderr   io.Writer
+	builtins map[string]Function              // declared in the globals of the program and of each module file
+	native   map[string]func(*Engine) *MapVal // native modules scripts may import
+	modules  map[string]*MapVal               // modules imported so far, by name or absolute file path
+	files    []*fileModule                    // module files in the order they were loaded
+	loading  []*fileModule                    // files being run, the entry file given to RunFile first
+}
+
+// fileModule -> a .dy file imported as a module, run in its own globals
+type fileModule struct {
+	file   string // path as resolved from the importing file
+	key    string // absolute path, the module's identity
+	hybrid *HybridEngine
+}
+
+// Options configures a new Engine; the zero value exposes every built-in and runs
+// programs compiled on the VM with optimizations on.
+type Options struct {
+	Builtins   []string  // global functions to declare (println, printf, ...); nil declares all
+	Modules    []string  // native modules scripts may import; nil allows all registered ones
+	Interpret  bool      // run programs on the tree-walking interpreter instead of the VM
+	NoOptimize bool      // turn off compiler and interpreter optimizations
+	Tiering    bool      // interpret programs and move hot functions to the VM
+	Stdout     io.Writer // where println, printf and printlnml write; nil is os.Stdout
+	Stderr     io.Writer // where logln and systemout write; nil is os.Stderr
+}
+
+// NewEngine -> an engine with its own globals holding the chosen built-ins; naming a
+// built-in or module that does not exist is an error. Errors returned by the engine's
+// methods are *Error values
+func NewEngine(opts Options) (*Engine, error) {
+	e := &Engine{globals: NewEnvironment(nil), opts: opts, builtins: map[string]Function{},
+		native: map[string]func(*Engine) *MapVal{}, modules: map[string]*MapVal{}}
+	e.hybrid = e.newHybrid(e.globals)
+
+	stdout, stderr := opts.Stdout, opts.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	e.stdout, e.stderr = stdout, stderr
+	available := builtins(stdout, stderr)
+	names := opts.Builtins
+	if names == nil {
+		for name := range available {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		fn, ok := available[name]
+		if !ok {
+			return nil, NewError(fmt.Sprintf("unknown built-in: %s", name), 0, 0)
+		}
+		e.builtins[name] = fn
+	}
+	e.declareBuiltins(e.globals)
+
+	names = opts.Modules
+	if names == nil {
+		names = Modules()
+	}
+	for _, name := range names {
+		build, ok := registeredModule(name)
+		if !ok {
+			return nil, NewError(fmt.Sprintf("unknown module: %s", name), 0, 0)
+		}
+		e.native[name] = build
+	}
+	return e, nil
+}
+
+// newHybrid -> engine running code in globals with the options of e
+func (e *Engine) newHybrid(globals *Environment) *HybridEngine {
+	h := NewHybridEngine(globals)
+	h.host = e
+	h.SetPerformanceMode(!e.opts.Interpret)
+	h.SetOptimizations(!e.opts.NoOptimize)
+	h.SetTiering(e.opts.Tiering)
+	return h
+}
+
+func (e *Engine) declareBuiltins(globals *Environment) {
+	for name, fn := range e.builtins {
+		globals.DeclareVar(name, fn, ast.ConstDecl)
+	}
+}
+
+// Run -> runs source as a program in the engine's globals, returning its result
+func (e *Engine) Run(source string) (RuntimeVal, error) {
+	result, err := e.run(source, "<script>")
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RunFile -> runs the program in the file at path; tracebacks name path. While it runs,
+// a module importing path back is an import cycle
+func (e *Engine) RunFile(path string) (RuntimeVal, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, NewError(fmt.Sprintf("cannot read %s: %v", path, err), 0, 0)
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, NewError(fmt.Sprintf("cannot resolve %s: %v", path, err), 0, 0)
+	}
+	e.loading = append(e.loading, &fileModule{file: path, key: key, hybrid: e.hybrid})
+	result, rerr := e.run(string(source), path)
+	e.loading = e.loading[:len(e.loading)-1]
+	if rerr != nil {
+		return nil, rerr
+	}
+	return result, nil
+}
+
+func (e *Engine) run(source, file string) (RuntimeVal, *Error) {
+	program, err := parse(source, file)
+	if err != nil {
+		return nil, err
+	}
+	return e.hybrid.Execute(program)
+}
+
+// Eval -> value of source, usually a single expression, evaluated by the interpreter in
+// the engine's globals; with several statements the value is the last one's
+func (e *Engine) Eval(source string) (RuntimeVal, error) {
+	program, err := parse(source, "<eval>")
+	if err != nil {
+		return nil, err
+	}
+	var result RuntimeVal = fastNull()
+	for _, stmt := range program.Body {
+		if result, err = e.hybrid.executeSafe(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if result == nil {
+		return fastNull(), nil
+	}
+	return result, nil
+}
+
+// Set -> assigns the global name, declaring it as a var when it does not exist yet;
+// let and const bindings cannot be set
+func (e *Engine) Set(name string, value RuntimeVal) error {
+	var err *Error
+	if e.globals.Resolve(name) == nil {
+		_, err = e.globals.DeclareVar(name, value, ast.VarDecl)
+	} else {
+		_, err = e.globals.AssignVar(name, value)
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get -> value of the global name; ok is false when it is not defined
+func (e *Engine) Get(name string) (value RuntimeVal, ok bool) {
+	value = e.globals.LookupVar(name)
+	return value, value != nil
+}
+
+// Call -> calls the global function name with args; as with Run, a Go panic inside the
+// call comes back as an internal error
+func (e *Engine) Call(name string, args ...RuntimeVal) (result RuntimeVal, err error) {
+	fn, ok := e.Get(name)
+	if !ok {
+		return nil, NewError(fmt.Sprintf("undefined function: %s", name), 0, 0)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, NewError(fmt.Sprintf("internal error: %v", r), 0, 0)
+		}
+	}()
+	res, rerr := callValue(fn, args, e.globals, 0)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if res == nil {
+		return fastNull(), nil
+	}
+	return res, nil
+}
+
+// Stdout -> where the engine's output built-ins write, for native modules to write too
+func (e *Engine) Stdout() io.Writer { return e.stdout }
+
+// Stderr -> where logln and systemout write
+func (e *Engine) Stderr() io.Writer { return e.stderr }
+
+// TierReport -> the tier each function ended on, for engines created with Tiering; the
+// functions of each imported module file follow under its name
+func (e *Engine) TierReport() string {
+	report := e.hybrid.TierReport()
+	for _, m := range e.files {
+		if len(m.hybrid.functionStats) > 0 {
+			report += "\nmodule " + m.file + "\n" + m.hybrid.TierReport()
+		}
+	}
+	return report
+}
+
+// module -> the module import path names, imported at line of file: a .dy file when path
+// starts with ./, ../ or /, resolved from file's directory, and a native module otherwise.
+// Either is loaded on its first import and shared by later ones
+func (e *Engine) module(path, file string, line int) (*MapVal, *Error) {
+	if isFilePath(path) {
+		return e.fileModule(path, file, line)
+	}
+	if mod, ok := e.modules[path]; ok {
+		return mod, nil
+	}
+	build, ok := e.native[path]
+	if !ok {
+		return nil, NewError(fmt.Sprintf("unknown module: %s", path), 0, 0)
+	}
+	mod := build(e)
+	if mod == nil {
+		mod = &MapVal{Properties: map[string]RuntimeVal{}}
+	}
+	e.modules[path] = mod
+	return mod, nil
+}
+
+// fileModule -> the members exported by the module file path imported from file; the
+// file runs once, in its own globals, and importing a file that is still running is an
+// import cycle
+func (e *Engine) fileModule(path, from string, line int) (*MapVal, *Error) {
+	file := path
+	if !filepath.IsAbs(path) {
+		file = filepath.Join(filepath.Dir(from), path)
+	}
+	key, err := filepath.Abs(file)
+	if err != nil {
+		return nil, NewError(fmt.Sprintf("cannot resolve module %s: %v", path, err), 0, 0)
+	}
+	if mod, ok := e.modules[key]; ok {
+		return mod, nil
+	}
+	for i, m := range e.loading {
+		if m.key == key {
+			chain := []string{}
+			for _, outer := range e.loading[i:] {
+				chain = append(chain, outer.file)
+			}
+			return nil, NewError(fmt.Sprintf("import cycle: %s -> %s", strings.Join(chain, " -> "), file), 0, 0)
+		}
+	}
+	source, readErr := os.ReadFile(file)
+	if readErr != nil {
+		return nil, NewError(fmt.Sprintf("cannot read module %s: %v", path, readErr), 0, 0)
+	}
+
+	globals := NewEnvironment(nil)
+	e.declareBuiltins(globals)
+	m := &fileModule{file: file, key: key, hybrid: e.newHybrid(globals)}
+	m.hybrid.topLevel = "<module>"
+	program, rerr := parse(string(source), file)
+	if rerr == nil {
+		e.loading = append(e.loading, m)
+		_, rerr = m.hybrid.Execute(program)
+		e.loading = e.loading[:len(e.loading)-1]
+	}
+	if rerr != nil {
+		// the error leaves the module through the import at line
+		if len(rerr.Stack) == 0 {
+			return nil, rerr.unwind(m.hybrid.topLevel, file, line)
+		}
+		rerr.callLine = line
+		return nil, rerr
+	}
+
+	mod := &MapVal{Properties: map[string]RuntimeVal{}}
+	for _, name := range program.Exports {
+		mod.Properties[name] = globals.LookupVar(name)
+	}
+	e.modules[key] = mod
+	e.files = append(e.files, m)
+	return mod, nil
+}
+
+// isFilePath -> an import path naming a file rather than a native module
+func isFilePath(path string) bool {
+	return strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") || filepath.IsAbs(path)
+}
+
+// parse -> program in source, attributed to file; lexer and parser errors become
+// syntax errors at the same position
+func parse(source, file string) (*ast.Program, *Error) {
+	tokens, lexErr := lexer.Tokenize(source)
+	if lexErr != nil {
+		return nil, syntaxError(lexErr.Message, lexErr.Line, lexErr.Column)
+	}
+	program, parseErr := parser.NewWithFile(tokens, file).ParseProgram()
+	if parseErr != nil {
+		return nil, syntaxError(parseErr.Message, parseErr.Line, parseErr.Column)
+	}
+	return program, nil
+}
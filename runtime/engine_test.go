@@ -0,0 +1,237 @@
+package runtime_test
+
+import (
+	_ "DYMS/libraries" // registers the time and fmaths modules
+	"DYMS/runtime"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// engineModes -> options selecting each way an engine runs programs
+var engineModes = map[string]runtime.Options{
+	"vm":          {},
+	"interpreter": {Interpret: true},
+	"tiered":      {Tiering: true},
+}
+
+// newEngine -> engine with opts writing its output to out, failing the test on error
+func newEngine(t *testing.T, opts runtime.Options, out *bytes.Buffer) *runtime.Engine {
+	t.Helper()
+	opts.Stdout, opts.Stderr = out, out
+	engine, err := runtime.NewEngine(opts)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	return engine
+}
+
+func TestEngineRunSetGetCall(t *testing.T) {
+	for mode, opts := range engineModes {
+		t.Run(mode, func(t *testing.T) {
+			var out bytes.Buffer
+			engine := newEngine(t, opts, &out)
+			if err := engine.Set("limit", &runtime.IntVal{Value: 10}); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			var err error
+			_, err = engine.Run(`
+funct square(x) { return x * x }
+var total = limit + 5
+println("total", total)`)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if got := out.String(); got != "[println]: total\n[println]: 15\n" {
+				t.Errorf("output = %q", got)
+			}
+
+			total, ok := engine.Get("total")
+			if !ok || total.String() != "15" {
+				t.Errorf("Get(total) = %v, %v; want 15, true", total, ok)
+			}
+			if _, ok := engine.Get("missing"); ok {
+				t.Errorf("Get(missing) reported a value")
+			}
+			result, err := engine.Call("square", &runtime.IntVal{Value: 7})
+			if err != nil || result.String() != "49" {
+				t.Errorf("Call(square, 7) = %v, %v; want 49", result, err)
+			}
+			value, err := engine.Eval("limit + 1")
+			if err != nil || value.String() != "11" {
+				t.Errorf("Eval(limit + 1) = %v, %v; want 11", value, err)
+			}
+
+			if err := engine.Set("total", &runtime.IntVal{Value: 1}); err != nil {
+				t.Errorf("Set on an existing var: %v", err)
+			}
+			if _, err := engine.Run("const fixed = 1"); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if err := engine.Set("fixed", &runtime.IntVal{Value: 2}); err == nil {
+				t.Errorf("Set on a const succeeded")
+			}
+		})
+	}
+}
+
+func TestEngineErrors(t *testing.T) {
+	var out bytes.Buffer
+	engine := newEngine(t, runtime.Options{}, &out)
+
+	_, err := engine.Run("funct fail() { throw \"boom\" }\nfail()")
+	rerr, ok := err.(*runtime.Error)
+	if !ok {
+		t.Fatalf("Run error = %#v, want a *runtime.Error", err)
+	}
+	if rerr.Message != "boom" || !strings.Contains(rerr.Traceback(), "in fail") {
+		t.Errorf("Run error = %q, traceback:\n%s", rerr.Message, rerr.Traceback())
+	}
+	if _, err := engine.Call("nothing"); err == nil || !strings.Contains(err.Error(), "undefined function: nothing") {
+		t.Errorf("Call of an undefined function: %v", err)
+	}
+	if _, err := engine.Eval("1 +"); err == nil {
+		t.Errorf("Eval of a broken expression succeeded")
+	}
+	if _, err := engine.RunFile("testdata/missing.dy"); err == nil {
+		t.Errorf("RunFile of a missing file succeeded")
+	}
+}
+
+func TestEngineCallRecoversAndReturnsNull(t *testing.T) {
+	for mode, opts := range engineModes {
+		t.Run(mode, func(t *testing.T) {
+			var out bytes.Buffer
+			engine := newEngine(t, opts, &out)
+			explode, err := runtime.ToValue(func() int { panic("boom") })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := engine.Set("explode", explode); err != nil {
+				t.Fatal(err)
+			}
+			_, err = engine.Run(`
+funct h() { return explode() }
+funct f(x) {
+  if (x > 100) { return 1 }
+}
+funct g() { return f(1) }`)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if _, err := engine.Call("h"); err == nil || !strings.Contains(err.Error(), "internal error: boom") {
+				t.Errorf("Call(h) = %v, want an internal error", err)
+			}
+			for _, name := range []string{"f", "g"} {
+				result, err := engine.Call(name, &runtime.IntVal{Value: 1})
+				if err != nil || result == nil || result.Type() != runtime.NullType {
+					t.Errorf("Call(%s) = %#v, %v; want null", name, result, err)
+				}
+			}
+			// the engine keeps working after a recovered panic
+			if result, err := engine.Call("f", &runtime.IntVal{Value: 200}); err != nil || result.String() != "1" {
+				t.Errorf("Call(f, 200) = %v, %v; want 1", result, err)
+			}
+		})
+	}
+}
+
+func TestEngineStackOverflow(t *testing.T) {
+	for mode, opts := range engineModes {
+		var out bytes.Buffer
+		engine := newEngine(t, opts, &out)
+		_, err := engine.Run("funct r(n) {\n  return r(n + 1)\n}\nr(0)")
+		rerr, ok := err.(*runtime.Error)
+		if !ok || !strings.Contains(rerr.Message, "stack overflow") {
+			t.Fatalf("%s: error %v, want a stack overflow", mode, err)
+		}
+		// the recursion shows as three frames and a count
+		trace := rerr.Traceback()
+		if n := strings.Count(trace, "in r\n"); n != 3 || !strings.Contains(trace, "[Previous line repeated 9997 more times]") {
+			t.Errorf("%s: traceback with %d frames of r:\n%s", mode, n, trace)
+		}
+		if _, err := engine.Run(`println("recovered")`); err != nil || !strings.HasSuffix(out.String(), "recovered\n") {
+			t.Errorf("%s: run after the overflow: %v, %q", mode, err, out.String())
+		}
+	}
+}
+
+func TestEngineFiltersBuiltinsAndModules(t *testing.T) {
+	var out bytes.Buffer
+	engine := newEngine(t, runtime.Options{Builtins: []string{"println"}, Modules: []string{"time"}}, &out)
+	if _, err := engine.Run(`println("ok")`); err != nil {
+		t.Errorf("declared built-in: %v", err)
+	}
+	if _, err := engine.Run(`printf("%d", 1)`); err == nil || !strings.Contains(err.Error(), "printf") {
+		t.Errorf("left-out built-in: %v", err)
+	}
+	if _, err := engine.Run(`import "time" as t`); err != nil {
+		t.Errorf("allowed module: %v", err)
+	}
+	if _, err := engine.Run(`import "fmaths" as m`); err == nil || !strings.Contains(err.Error(), "unknown module: fmaths") {
+		t.Errorf("left-out module: %v", err)
+	}
+
+	if _, err := runtime.NewEngine(runtime.Options{Builtins: []string{"nope"}}); err == nil {
+		t.Errorf("NewEngine accepted an unknown built-in")
+	}
+	if _, err := runtime.NewEngine(runtime.Options{Modules: []string{"nope"}}); err == nil {
+		t.Errorf("NewEngine accepted an unknown module")
+	}
+}
+
+func TestEnginesAreIsolated(t *testing.T) {
+	var outA, outB bytes.Buffer
+	a := newEngine(t, runtime.Options{}, &outA)
+	b := newEngine(t, runtime.Options{Interpret: true}, &outB)
+
+	if _, err := a.Run(`var shared = "a"` + "\n" + `println(shared)`); err != nil {
+		t.Fatalf("Run on a: %v", err)
+	}
+	if _, ok := b.Get("shared"); ok {
+		t.Errorf("engine b sees a global of engine a")
+	}
+	if _, err := b.Run(`var shared = "b"` + "\n" + `println(shared)`); err != nil {
+		t.Fatalf("Run on b, redeclaring a's global: %v", err)
+	}
+	if got, _ := a.Get("shared"); got.String() != "a" {
+		t.Errorf("engine b overwrote a's global: %v", got)
+	}
+	if outA.String() != "[println]: a\n" || outB.String() != "[println]: b\n" {
+		t.Errorf("outputs mixed: a = %q, b = %q", outA.String(), outB.String())
+	}
+
+	// native modules are built once per engine
+	_, errA := a.Run(`import "fmaths" as m`)
+	_, errB := b.Run(`import "fmaths" as m`)
+	if errA != nil || errB != nil {
+		t.Fatalf("imports: %v, %v", errA, errB)
+	}
+	modA, _ := a.Get("m")
+	modB, _ := b.Get("m")
+	if modA == modB {
+		t.Errorf("two engines share one module value")
+	}
+}
+
+func TestEngineSyntaxError(t *testing.T) {
+	for mode, opts := range engineModes {
+		t.Run(mode, func(t *testing.T) {
+			var out bytes.Buffer
+			engine := newEngine(t, opts, &out)
+			_, err := engine.Run("let x = 1\nx = 2")
+			rerr, ok := err.(*runtime.Error)
+			if !ok || rerr.Kind != runtime.SyntaxErrorKind || rerr.Line != 2 || rerr.Column != 1 {
+				t.Fatalf("Run = %#v; want a SyntaxError at 2:1", err)
+			}
+			want := "Syntax error at 2:1: Cannot assign to immutable variable 'x' declared with let; use var for a mutable binding."
+			if got := err.Error(); got != want {
+				t.Errorf("Error() = %q; want %q", got, want)
+			}
+			if out.Len() != 0 {
+				t.Errorf("output = %q; want none", out.String())
+			}
+		})
+	}
+}
@@ -1,44 +1,76 @@
 package runtime
 
-import "fmt"
+import (
+	"DYMS/ast"
+	"fmt"
+)
 
 
 
 type Environment struct {
 	parent    *Environment
 	variables map[string]RuntimeVal
-	constants map[string]bool
+	kinds     map[string]ast.DeclKind
+	engine    *HybridEngine // engine running code in this scope, inherited by nested scopes
+	call      *UserFunction // function this scope is a call of, nil for blocks and globals
 }
 
 func NewEnvironment(parent *Environment) *Environment {
-	return &Environment{
+	env := &Environment{
 		parent:    parent,
 		variables: make(map[string]RuntimeVal),
-		constants: make(map[string]bool),
+		kinds:     make(map[string]ast.DeclKind),
 	}
+	if parent != nil {
+		env.engine = parent.engine
+	}
+	return env
+}
+
+// backEdge -> reports a loop iteration to the engine when it is tiering functions
+func (env *Environment) backEdge() {
+	if env.engine != nil && env.engine.tiering {
+		env.engine.loopIteration()
+	}
+}
+
+// optimizing -> whether interpreter optimizations may run in this scope
+func (env *Environment) optimizing() bool {
+	return env.engine == nil || env.engine.optimize
 }
 
-func (env *Environment) DeclareVar(name string, value RuntimeVal, isConstant bool) RuntimeVal {
+// module -> the module import path names, as the engine running this scope provides it;
+// the import is at line of file (error unlocated unless it comes from a module's code)
+func (env *Environment) module(path, file string, line int) (*MapVal, *Error) {
+	if env.engine != nil && env.engine.host != nil {
+		return env.engine.host.module(path, file, line)
+	}
+	return nil, NewError(fmt.Sprintf("unknown module: %s", path), 0, 0)
+}
+
+// DeclareVar -> errors (unlocated) if name already exists in this scope
+func (env *Environment) DeclareVar(name string, value RuntimeVal, kind ast.DeclKind) (RuntimeVal, *Error) {
 	if _, exists := env.variables[name]; exists {
-		panic(fmt.Sprintf("Cannot declare variable '%s'. It already exists.", name))
+		return nil, NewError(fmt.Sprintf("Cannot declare variable '%s'. It already exists.", name), 0, 0)
 	}
 	env.variables[name] = value
-	if isConstant {
-		env.constants[name] = true
+	if !kind.Mutable() {
+		env.kinds[name] = kind
 	}
-	return value
+	return value, nil
 }
 
-func (env *Environment) AssignVar(name string, value RuntimeVal) RuntimeVal {
-	if env.constants[name] {
-		panic(fmt.Sprintf("Cannot assign to constant variable '%s'.", name))
-	}
+// AssignVar -> errors (unlocated) for undefined or constant targets
+func (env *Environment) AssignVar(name string, value RuntimeVal) (RuntimeVal, *Error) {
 	target := env.Resolve(name)
 	if target == nil {
-		panic(fmt.Sprintf("Cannot assign to undefined variable '%s'.", name))
+		return nil, NewError(fmt.Sprintf("Cannot assign to undefined variable '%s'.", name), 0, 0)
+	}
+	if kind, immutable := target.kinds[name]; immutable {
+		return nil, NewError(ast.ImmutableMessage(name, kind), 0, 0)
 	}
 	target.variables[name] = value
-	return value
+	return value, nil
 }
 
 func (env *Environment) LookupVar(name string) RuntimeVal {
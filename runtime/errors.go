@@ -2,6 +2,21 @@ package runtime
 
 import (
 	"fmt"
+	"strings"
+)
+
+// StackFrame is one function activation an error unwound through.
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// Error kinds
+const (
+	RuntimeErrorKind = "RuntimeError" // raised by the interpreter/VM itself
+	ThrownErrorKind  = "Error"        // default kind for `throw`
+	SyntaxErrorKind  = "SyntaxError"  // reported by the lexer/parser before running
 )
 
 // Error represents a runtime error.
@@ -9,19 +24,91 @@ type Error struct {
 	Message string
 	Line    int
 	Column  int
+	Kind    string
+	Payload RuntimeVal   // value given to `throw`, nil for runtime errors
+	Stack   []StackFrame // innermost frame first
+	callLine int         // line of the call site in the frame being unwound into
 }
 
 func (e *Error) Error() string {
 	if e == nil {
 		return "Runtime error: unknown" 
 	}
+	label := "Runtime error"
+	if e.Kind == SyntaxErrorKind {
+		label = "Syntax error"
+	}
+	msg := e.Message
+	if e.Kind != "" && e.Kind != RuntimeErrorKind && e.Kind != SyntaxErrorKind {
+		msg = e.Kind + ": " + msg
+	}
 	if e.Line > 0 && e.Column > 0 {
-		return fmt.Sprintf("Runtime error at %d:%d: %s", e.Line, e.Column, e.Message) // include location
+		return fmt.Sprintf("%s at %d:%d: %s", label, e.Line, e.Column, msg) // include location
 	}
-	return fmt.Sprintf("Runtime error: %s", e.Message)
+	return fmt.Sprintf("%s: %s", label, msg)
 }
 
 // NewError creates a new runtime error.
 func NewError(message string, line int, column int) *Error {
-	return &Error{Message: message, Line: line, Column: column}
+	return &Error{Message: message, Line: line, Column: column, Kind: RuntimeErrorKind}
+}
+
+// syntaxError creates an error for source the lexer or parser rejected.
+func syntaxError(message string, line int, column int) *Error {
+	return &Error{Message: message, Line: line, Column: column, Kind: SyntaxErrorKind}
+}
+
+// at fills in the location of an error raised without one (e.g. by a built-in).
+func (e *Error) at(line int, column int) *Error {
+	if e != nil && e.Line == 0 {
+		e.Line = line
+		e.Column = column
+	}
+	return e
+}
+
+// unwind records that the error escaped a call to function (defined in file).
+// callLine is the line of the call expression in the caller; it becomes the
+// current line of the next frame recorded.
+func (e *Error) unwind(function string, file string, callLine int) *Error {
+	line := e.Line
+	if len(e.Stack) > 0 {
+		line = e.callLine
+	}
+	e.Stack = append(e.Stack, StackFrame{Function: function, File: file, Line: line})
+	e.callLine = callLine
+	return e
+}
+
+// Traceback formats the error Python-style, most recent call last; a frame repeated
+// more than three times in a row, as in deep recursion, is shown three times and counted.
+func (e *Error) Traceback() string {
+	if e == nil || len(e.Stack) == 0 {
+		return e.Error()
+	}
+	var b strings.Builder
+	b.WriteString("Traceback (most recent call last):\n")
+	repeats := 0
+	for i := len(e.Stack) - 1; i >= 0; i-- {
+		fr := e.Stack[i]
+		if i < len(e.Stack)-1 && fr == e.Stack[i+1] {
+			repeats++
+		} else {
+			writeRepeats(&b, repeats)
+			repeats = 0
+		}
+		if repeats < 3 {
+			b.WriteString(fmt.Sprintf("  File \"%s\", line %d, in %s\n", fr.File, fr.Line, fr.Function))
+		}
+	}
+	writeRepeats(&b, repeats)
+	b.WriteString(e.Error())
+	return b.String()
+}
+
+// writeRepeats -> notes the copies of a frame left out after its first three
+func writeRepeats(b *strings.Builder, repeats int) {
+	if repeats > 2 {
+		b.WriteString(fmt.Sprintf("  [Previous line repeated %d more times]\n", repeats-2))
+	}
 }
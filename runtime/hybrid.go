@@ -2,6 +2,10 @@ package runtime
 
 import (
 	"DYMS/ast"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 // HybridEngine combines VM and interpreter
@@ -13,90 +17,93 @@ type HybridEngine struct {
 	interpreterCallCount int
 	performanceMode      bool
 	functionStats        map[string]*FunctionStats
-	loopComplexityThreshold int
+	optimize             bool
+	tiering              bool
+	hotCallThreshold     int              // interpreted calls before a function is compiled
+	hotLoopThreshold     int              // or loop iterations run by its interpreted calls
+	tierSamples          int              // VM calls timed before the faster tier is picked
+	profiling            []*FunctionStats // interpreted calls in progress, innermost last
+	idleVMs              []*VM            // VMs free to run tiered calls
+	host                 *Engine          // engine this runs for, nil when used on its own
+	topLevel             string           // frame name of a program's top level in tracebacks
+	file                 string           // file of the program run last, for its top-level frame
+	depth                int              // interpreted calls and calls on an idle VM in progress
 }
 
 // FunctionStats tracks performance metrics for functions
 type FunctionStats struct {
+	Name         string
 	CallCount    int
+	LoopCount    int   // loop iterations run by its interpreted calls
+	VMCalls      int   // calls timed on the VM (ones made from VM code are not timed)
 	VMTime       int64 
+	InterpreterCalls int
 	InterpreterTime int64
 	PreferVM     bool
+	Reason       string // why it cannot be compiled, "" when it can
+	compiled     *VMFunction
 }
 
 // NewHybridEngine creates a new hybrid execution system
 func NewHybridEngine(globalEnv *Environment) *HybridEngine {
-	return &HybridEngine{
+	h := &HybridEngine{
 		vm:                      NewVM(globalEnv),
 		interpreter:             globalEnv,
 		compiler:                NewCompiler(),
 		vmCallCount:             0,
 		interpreterCallCount:    0,
 		performanceMode:         true,
+		optimize:                true,
 		functionStats:           make(map[string]*FunctionStats),
-		loopComplexityThreshold: 5, 
+		hotCallThreshold:        50,
+		hotLoopThreshold:        1000,
+		tierSamples:             20,
+		topLevel:                "<main>",
 	}
+	globalEnv.engine = h
+	return h
 }
 
 func (h *HybridEngine) SetPerformanceMode(enabled bool) {
 	h.performanceMode = enabled
 }
 
-func (h *HybridEngine) GetStats() (vmCalls, interpreterCalls int) {
-	return h.vmCallCount, h.interpreterCallCount
+// SetOptimizations -> compiler passes and interpreter loop summaries; a program's
+// output is the same with them off, only slower
+func (h *HybridEngine) SetOptimizations(enabled bool) {
+	h.optimize = enabled
 }
 
-func (h *HybridEngine) shouldUseVM(node ast.Stmt) bool {
-	if !h.performanceMode {
-		return false
-	}
-	
-	// Simple expressions/math operations should prefer VM
-	// for fast executions
-	switch n := node.(type) {
-	case *ast.BinaryExpr:
-		return h.isMathExpression(n)
-	case *ast.NumericLiteral, *ast.Identifier:
-		return true
-	case *ast.ForStatement:
-		return h.isSimpleLoop(n)
-	case *ast.FunctionDeclaration:
-		return h.isPureFunction(n)
-	default:
-		return false
-	}
+// SetTiering -> in tiered mode programs run in the interpreter and hot functions are
+// compiled to the VM, which then runs them while it is measured to be faster
+func (h *HybridEngine) SetTiering(enabled bool) {
+	h.tiering = enabled
 }
 
-func (h *HybridEngine) isMathExpression(expr *ast.BinaryExpr) bool {
-	switch expr.Operator {
-	case "+", "-", "*", "/", "%":
-		return true
-	case "==", "!=", "<", ">", "<=", ">=":
-		return true 
-	default:
-		return false
-	}
+func (h *HybridEngine) GetStats() (vmCalls, interpreterCalls int) {
+	return h.vmCallCount, h.interpreterCallCount
 }
 
-// isSimpleLoop determines if loop is simple enough for VM
-func (h *HybridEngine) isSimpleLoop(stmt *ast.ForStatement) bool {
-	if stmt.Body == nil {
-		return true
+// Execute runs node, turning any Go panic escaping the runtime into a DYMS error
+func (h *HybridEngine) Execute(node ast.Stmt) (RuntimeVal, *Error) {
+	if program, ok := node.(*ast.Program); ok {
+		return h.executeProgram(program)
 	}
-	statementCount := len(stmt.Body.Statements)
-	return statementCount <= h.loopComplexityThreshold
+	return h.executeSafe(node)
 }
 
-func (h *HybridEngine) isPureFunction(fn *ast.FunctionDeclaration) bool {
-	if fn.Body == nil {
-		return false
-	}
-	// heuristic
-	return len(fn.Body.Statements) <= 3
+// executeSafe -> execute with a recover for the statement
+func (h *HybridEngine) executeSafe(node ast.Stmt) (result RuntimeVal, err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, errorAt(node, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+	return h.execute(node)
 }
 
 // Executes whether to use VM or interpreter based on heuristics
-func (h *HybridEngine) Execute(node ast.Stmt) (RuntimeVal, *Error) {
+func (h *HybridEngine) execute(node ast.Stmt) (RuntimeVal, *Error) {
 	switch n := node.(type) {
 	case *ast.Program:
 		return h.executeProgram(n)
@@ -104,13 +111,6 @@ func (h *HybridEngine) Execute(node ast.Stmt) (RuntimeVal, *Error) {
 		return h.executeFunctionDeclaration(n)
 	case *ast.CallExpr:
 		return h.executeCallExpr(n)
-	case *ast.BinaryExpr:
-		if h.shouldUseVM(n) {
-			h.vmCallCount++
-			return h.executeBinaryExprVM(n)
-		}
-		h.interpreterCallCount++
-		return evalBinaryExpr(n, h.interpreter)
 	case *ast.ForStatement, *ast.WhileStatement:
 		return h.executeLoop(n)
 	case *ast.BreakStatement, *ast.ContinueStatement:
@@ -128,15 +128,20 @@ func (h *HybridEngine) Execute(node ast.Stmt) (RuntimeVal, *Error) {
 	}
 }
 
-// execution of program with a hybrid approach
+// execution of program: compiled to bytecode and run on the VM, or walked statement
+// by statement by the interpreter (the reference implementation) when performance mode
+// is off or functions are tiered
 func (h *HybridEngine) executeProgram(program *ast.Program) (RuntimeVal, *Error) {
+	if h.performanceMode && !h.tiering {
+		return h.runVM(program)
+	}
 	var lastResult RuntimeVal
 	var err *Error
-	
+	h.file = program.File
 	for _, stmt := range program.Body {
-		lastResult, err = h.Execute(stmt)
+		lastResult, err = h.executeSafe(stmt)
 		if err != nil {
-			return nil, err
+			return nil, err.unwind(h.topLevel, program.File, 0)
 		}
 		if _, isRet := lastResult.(*ReturnVal); isRet {
 			return lastResult.(*ReturnVal).Inner, nil
@@ -145,12 +150,34 @@ func (h *HybridEngine) executeProgram(program *ast.Program) (RuntimeVal, *Error)
 	return lastResult, nil
 }
 
+// runVM -> compiles program and runs it on the VM, turning a Go panic into a DYMS error
+func (h *HybridEngine) runVM(program *ast.Program) (result RuntimeVal, err *Error) {
+	h.compiler = NewCompiler()
+	h.compiler.optimizations = h.optimize
+	h.compiler.engine = h
+	fn, err := h.compiler.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+	fn.Name = h.topLevel
+	h.vmCallCount++
+	defer func() {
+		if r := recover(); r != nil {
+			h.vm = NewVM(h.interpreter) // the stack and frames are unusable after a panic
+			result, err = nil, NewError(fmt.Sprintf("internal error: %v", r), 0, 0)
+		}
+	}()
+	return h.vm.Run(fn)
+}
+
 // Functions to use interpreter for reliability and VM for pure math functions
 func (h *HybridEngine) executeFunctionDeclaration(fd *ast.FunctionDeclaration) (RuntimeVal, *Error) {
 	// For now, use interpreter for all functions for reliability
 	// Would change to more hybrid solution
-	uf := &UserFunction{Params: fd.Params, Body: fd.Body, Env: h.interpreter}
-	h.interpreter.DeclareVar(fd.Name, uf, true)
+	uf := &UserFunction{Name: fd.Name, File: fd.File, Params: fd.Params, Body: fd.Body, Env: h.interpreter}
+	if _, err := h.interpreter.DeclareVar(fd.Name, uf, ast.ConstDecl); err != nil {
+		return nil, locate(err, fd)
+	}
 	return uf, nil
 }
 
@@ -159,19 +186,6 @@ func (h *HybridEngine) executeCallExpr(call *ast.CallExpr) (RuntimeVal, *Error)
 	return Evaluate(call, h.interpreter)
 }
 
-// Binary expressions use interpreter evaluation
-func (h *HybridEngine) executeBinaryExpr(expr *ast.BinaryExpr) (RuntimeVal, *Error) {
-	// Use interpreter for all binary expressions
-	return evalBinaryExpr(expr, h.interpreter)
-}
-
-// executeBinaryExprVM attempts to compile and run on VM
-func (h *HybridEngine) executeBinaryExprVM(expr *ast.BinaryExpr) (RuntimeVal, *Error) {
-	// For now, fallingback to interpreter bcuz VM compilation will be complex
-	// For futute enhancement: i would compile simple math expressions to bytecode
-	return evalBinaryExpr(expr, h.interpreter)
-}
-
 // Loops use optimized interpreter for reliability
 func (h *HybridEngine) executeLoop(stmt ast.Stmt) (RuntimeVal, *Error) {
 	switch loop := stmt.(type) {
@@ -180,7 +194,154 @@ func (h *HybridEngine) executeLoop(stmt ast.Stmt) (RuntimeVal, *Error) {
 	case *ast.WhileStatement:
 		return evalWhileStatement(loop, h.interpreter)
 	}
-	return nil, NewError("unknown loop type", 0, 0)
+	return nil, errorAt(stmt, "unknown loop type")
+}
+
+// statsFor -> profile of f, shared by every function value made from the same definition
+func (h *HybridEngine) statsFor(f *UserFunction) *FunctionStats {
+	if f.stats != nil {
+		return f.stats
+	}
+	name := fmt.Sprintf("%s:%d", f.frameName(), f.Body.(*ast.BlockStatement).Pos().Line)
+	stats, ok := h.functionStats[name]
+	if !ok {
+		stats = &FunctionStats{Name: name}
+		if f.Env != h.interpreter {
+			// compiled code reaches free variables as globals of the VM
+			stats.Reason = "closes over a local scope"
+		}
+		h.functionStats[name] = stats
+	}
+	f.stats = stats
+	return stats
+}
+
+// callFunction -> calls f on the tier its profile prefers, compiling it once it is hot;
+// errors come back unwound through the call made at line
+func (h *HybridEngine) callFunction(f *UserFunction, args []RuntimeVal, line int) (RuntimeVal, *Error) {
+	stats := h.statsFor(f)
+	stats.CallCount++
+	if stats.compiled == nil && stats.Reason == "" &&
+		(stats.CallCount > h.hotCallThreshold || stats.LoopCount > h.hotLoopThreshold) {
+		h.tierUp(f, stats)
+	}
+
+	start := time.Now()
+	if stats.PreferVM {
+		h.vmCallCount++
+		res, err := h.callCompiled(stats.compiled, args, line)
+		stats.VMCalls++
+		stats.VMTime += int64(time.Since(start))
+		if stats.VMCalls == h.tierSamples && stats.InterpreterCalls > 0 {
+			// keep whichever tier has the lower mean time per call
+			stats.PreferVM = stats.VMTime/int64(stats.VMCalls) <= stats.InterpreterTime/int64(stats.InterpreterCalls)
+		}
+		return res, err
+	}
+
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	h.interpreterCallCount++
+	depth := len(h.profiling)
+	h.profiling = append(h.profiling, stats)
+	res, err := callUserFunction(f, args)
+	h.profiling = h.profiling[:depth]
+	stats.InterpreterCalls++
+	stats.InterpreterTime += int64(time.Since(start))
+	if err != nil {
+		return nil, err.unwind(f.frameName(), f.File, line)
+	}
+	return res, nil
+}
+
+// tierUp -> compiles f for the VM, or records why it stays interpreted
+func (h *HybridEngine) tierUp(f *UserFunction, stats *FunctionStats) {
+	c := NewCompiler()
+	c.optimizations = h.optimize
+	c.engine = h
+	fn, err := c.compileUserFunction(f)
+	if err != nil {
+		stats.Reason = "compile error: " + err.Message
+		return
+	}
+	stats.compiled = fn
+	stats.PreferVM = true
+	if len(h.idleVMs) == 0 {
+		// allocated now so the first timed call does not pay for it
+		h.idleVMs = append(h.idleVMs, NewVM(h.interpreter))
+	}
+}
+
+// loopIteration -> counts a loop back-edge against the innermost interpreted call
+func (h *HybridEngine) loopIteration() {
+	if n := len(h.profiling); n > 0 {
+		h.profiling[n-1].LoopCount++
+	}
+}
+
+// enter -> counts a call that nests Go calls, an interpreted one or one run on an idle
+// VM; past maxCallDepth it is a stack overflow error instead
+func (h *HybridEngine) enter() *Error {
+	if h.depth >= maxCallDepth {
+		return stackOverflow()
+	}
+	h.depth++
+	return nil
+}
+
+// leave -> ends a call counted by enter
+func (h *HybridEngine) leave() { h.depth-- }
+
+// callCompiled -> runs a compiled function or closure on an idle VM
+func (h *HybridEngine) callCompiled(callee RuntimeVal, args []RuntimeVal, line int) (RuntimeVal, *Error) {
+	if err := h.enter(); err != nil {
+		return nil, err
+	}
+	defer h.leave()
+	var vm *VM
+	if n := len(h.idleVMs); n > 0 {
+		vm, h.idleVMs = h.idleVMs[n-1], h.idleVMs[:n-1]
+	} else {
+		vm = NewVM(h.interpreter)
+	}
+	res, err := vm.Call(callee, args, line)
+	h.idleVMs = append(h.idleVMs, vm)
+	return res, err
 }
 
+// TierReport -> table of the functions called in tiered mode and the tier each ended on
+func (h *HybridEngine) TierReport() string {
+	names := make([]string, 0, len(h.functionStats))
+	for name := range h.functionStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-24s %10s %10s %12s %12s  %s\n", "function", "calls", "loops", "interp/call", "vm/call", "tier")
+	for _, name := range names {
+		stats := h.functionStats[name]
+		tier := "interpreter"
+		switch {
+		case stats.Reason != "":
+			tier = "interpreter (" + stats.Reason + ")"
+		case stats.PreferVM:
+			tier = "vm"
+		case stats.compiled != nil:
+			tier = "interpreter (vm measured slower)"
+		}
+		fmt.Fprintf(&b, "%-24s %10d %10d %12s %12s  %s\n", name, stats.CallCount, stats.LoopCount,
+			meanDuration(stats.InterpreterTime, stats.InterpreterCalls), meanDuration(stats.VMTime, stats.VMCalls), tier)
+	}
+	return b.String()
+}
 
+// meanDuration -> total/calls as a duration, "-" without calls
+func meanDuration(total int64, calls int) string {
+	if calls == 0 {
+		return "-"
+	}
+	return time.Duration(total / int64(calls)).String()
+}
@@ -3,10 +3,7 @@ package runtime
 import (
 	"DYMS/ast"
 	"fmt"
-	"log"
-	"math"
-	"sync"
-	"time"
+	"io"
 )
 
 // Function represents built-in function.
@@ -15,123 +12,97 @@ type Function func(args ...RuntimeVal) (RuntimeVal, *Error)
 func (f Function) Type() ValueType { return FunctionType }
 func (f Function) String() string  { return "[function]" }
 
-var GlobalEnv = NewEnvironment(nil)
+// Runtime value constructors. Every call returns a new value: a value may be shared by
+// variables, array elements and closures, so none is ever mutated or reused
+func fastNumber(v float64) *NumberVal { return &NumberVal{Value: v} }
 
-// Fast memory pools for runtime values
-var (
-	numberPool = sync.Pool{New: func() interface{} { return &NumberVal{} }}
-	stringPool = sync.Pool{New: func() interface{} { return &StringVal{} }}
-	boolPool   = sync.Pool{New: func() interface{} { return &BooleanVal{} }}
-	nullPool   = sync.Pool{New: func() interface{} { return &NullVal{} }}
-)
-
-// Fast runtime value constructors
-func fastNumber(v float64) *NumberVal {
-	n := numberPool.Get().(*NumberVal)
-	n.Value = v
-	return n
-}
-
-func fastString(v string) *StringVal {
-	s := stringPool.Get().(*StringVal)
-	s.Value = v
-	return s
-}
-
-func fastBool(v bool) *BooleanVal {
-	b := boolPool.Get().(*BooleanVal)
-	b.Value = v
-	return b
-}
+func fastString(v string) *StringVal { return &StringVal{Value: v} }
 
-func fastNull() *NullVal {
-	return nullPool.Get().(*NullVal)
-}
-
-// Release values back to pool
-func releaseNumber(n *NumberVal) { numberPool.Put(n) }
-func releaseString(s *StringVal) { stringPool.Put(s) }
-func releaseBool(b *BooleanVal) { boolPool.Put(b) }
-func releaseNull(n *NullVal) { nullPool.Put(n) }
+func fastBool(v bool) *BooleanVal { return &BooleanVal{Value: v} }
 
-func init() {
-	log.SetFlags(0)
+func fastNull() *NullVal { return &NullVal{} }
 
-	m := builtinModules()
-	// to expose a modules map under "__modules__"
-	_ = m
-
-	GlobalEnv.DeclareVar("systemout", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		for _, arg := range args {
-			log.Println(Pretty(arg))
-		}
-		return nil, nil
-	}), true)
-GlobalEnv.DeclareVar("println", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		for _, arg := range args {
-			if s, ok := arg.(*StringVal); ok {
-				fmt.Printf("[println]: %s\n", Unescape(s.Value))
-			} else {
-				fmt.Printf("[println]: %s\n", formatValue(arg))
+// builtins -> global functions an engine declares, by name; the output ones write to
+// stdout, and systemout and logln to stderr
+func builtins(stdout, stderr io.Writer) map[string]Function {
+	return map[string]Function{
+		"systemout": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			for _, arg := range args {
+				fmt.Fprintln(stderr, Pretty(arg))
 			}
-		}
-		return nil, nil
-	}), true)
-	GlobalEnv.DeclareVar("printf", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) > 0 {
-			format, ok := args[0].(*StringVal)
-			if ok {
-				var values []interface{}
-				for _, arg := range args[1:] {
-					if f, isFloat := arg.(*NumberVal); isFloat {
-						values = append(values, int(f.Value))
-					} else if s, isStr := arg.(*StringVal); isStr {
-						values = append(values, s.Value)
-					} else {
-						values = append(values, Pretty(arg))
-					}
+			return nil, nil
+		},
+		"println": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			for _, arg := range args {
+				if s, ok := arg.(*StringVal); ok {
+					fmt.Fprintf(stdout, "[println]: %s\n", Unescape(s.Value))
+				} else {
+					fmt.Fprintf(stdout, "[println]: %s\n", formatValue(arg))
 				}
-// interpret basic escapes in the format string
-				fmtStr := Unescape(format.Value)
-				fmt.Printf(fmtStr, values...)
-			} else {
-				fmt.Println("First argument to printf must be a string")
 			}
-		}
-		return nil, nil
-	}), true)
-	GlobalEnv.DeclareVar("logln", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		for _, arg := range args {
-			log.Print("[logln]: ", formatValue(arg), " \n")
-		}
-		return nil, nil
-	}), true)
+			return nil, nil
+		},
+		"printf": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			if len(args) > 0 {
+				format, ok := args[0].(*StringVal)
+				if ok {
+	// interpret basic escapes in the format string
+					fmtStr := Unescape(format.Value)
+					fmt.Fprintf(stdout, fmtStr, printfArgs(fmtStr, args[1:])...)
+				} else {
+					fmt.Fprintln(stdout, "First argument to printf must be a string")
+				}
+			}
+			return nil, nil
+		},
+		"logln": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			for _, arg := range args {
+				fmt.Fprint(stderr, "[logln]: ", formatValue(arg), " \n")
+			}
+			return nil, nil
+		},
 
-	// pretty(value)
-	GlobalEnv.DeclareVar("pretty", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return &StringVal{Value: ""}, nil
-		}
-		return &StringVal{Value: Pretty(args[0])}, nil
-	}), true)
+		// pretty(value)
+		"pretty": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			if len(args) < 1 {
+				return &StringVal{Value: ""}, nil
+			}
+			return &StringVal{Value: Pretty(args[0])}, nil
+		},
 
-	// prettyml(value)
-	GlobalEnv.DeclareVar("prettyml", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return &StringVal{Value: ""}, nil
-		}
-		return &StringVal{Value: PrettyMultiline(args[0])}, nil
-	}), true)
+		// prettyml(value)
+		"prettyml": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			if len(args) < 1 {
+				return &StringVal{Value: ""}, nil
+			}
+			return &StringVal{Value: PrettyMultiline(args[0])}, nil
+		},
 
-	// printlnml(value)
-	GlobalEnv.DeclareVar("printlnml", Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			fmt.Println()
+		// printlnml(value)
+		"printlnml": func(args ...RuntimeVal) (RuntimeVal, *Error) {
+			if len(args) < 1 {
+				fmt.Fprintln(stdout)
+				return nil, nil
+			}
+			fmt.Fprintln(stdout, PrettyMultiline(args[0]))
 			return nil, nil
-		}
-		fmt.Println(PrettyMultiline(args[0]))
-		return nil, nil
-	}), true)
+		},
+	}
+}
+
+// errorAt creates a runtime error located at node
+func errorAt(node ast.Stmt, message string) *Error {
+	if node == nil {
+		return NewError(message, 0, 0)
+	}
+	pos := node.Pos()
+	return NewError(message, pos.Line, pos.Column)
+}
+
+// locate attributes an unlocated error (from a built-in or helper) to node
+func locate(err *Error, node ast.Stmt) *Error {
+	pos := node.Pos()
+	return err.at(pos.Line, pos.Column)
 }
 
 // Evaluator
@@ -139,6 +110,8 @@ func Evaluate(stmt ast.Stmt, scope *Environment) (RuntimeVal, *Error) {
 	switch s := stmt.(type) {
 	case *ast.NumericLiteral:
 		return fastNumber(s.Value), nil
+	case *ast.IntegerLiteral:
+		return fastInt(s.Value), nil
 	case *ast.StringLiteral:
 		return fastString(s.Value), nil
 	case *ast.BooleanLiteral:
@@ -156,65 +129,49 @@ func Evaluate(stmt ast.Stmt, scope *Environment) (RuntimeVal, *Error) {
 		if err != nil {
 			return nil, err
 		}
-		return scope.DeclareVar(s.Identifier, value, s.Constant), nil
-	case *ast.CallExpr:
-		fn, err := Evaluate(s.Callee, scope)
+		declared, err := scope.DeclareVar(s.Identifier, value, s.DeclKind)
 		if err != nil {
-			return nil, err
-		}
-		args := make([]RuntimeVal, len(s.Args))
-		for i, arg := range s.Args {
-			args[i], err = Evaluate(arg, scope)
-			if err != nil {
-				return nil, err
-			}
-		}
-	switch f := fn.(type) {
-	case Function:
-		return f(args...)
-	case *UserFunction:
-			callEnv := NewEnvironment(f.Env)
-			for idx, name := range f.Params {
-				var val RuntimeVal
-				if idx < len(args) { val = args[idx] } else { val = fastNull() }
-				callEnv.DeclareVar(name, val, false)
-			}
-			res, err := evalBlockStatement(f.Body.(*ast.BlockStatement), callEnv)
-			if err != nil { return nil, err }
-			if rv, ok := res.(*ReturnVal); ok { return rv.Inner, nil }
-			return res, nil
-		default:
-			return nil, NewError(fmt.Sprintf("not a function: %T", fn), 0, 0)
+			return nil, locate(err, s)
 		}
+		return declared, nil
+	case *ast.CallExpr, *ast.MemberExpr, *ast.IndexExpr:
+		val, _, err := evalChain(s, scope)
+		return val, err
 	case *ast.Identifier:
 		val := scope.LookupVar(s.Symbol)
 		if val == nil {
-			return nil, NewError(fmt.Sprintf("undefined variable: %s", s.Symbol), 0, 0)
+			return nil, errorAt(s, fmt.Sprintf("undefined variable: %s", s.Symbol))
 		}
 		return val, nil
-	case *ast.MemberExpr:
-		obj, err := Evaluate(s.Object, scope)
-		if err != nil {
-			return nil, err
-		}
-		return evalMember(obj, s.Property.Symbol)
+	case *ast.NullLiteral:
+		return fastNull(), nil
 	case *ast.BlockStatement:
 		return evalBlockStatement(s, scope)
 	case *ast.IfStatement:
 		return evalIfStatement(s, scope)
 	case *ast.ForStatement:
 		return evalForStatement(s, scope)
+	case *ast.ForInStatement:
+		return evalForInStatement(s, scope)
+	case *ast.ForClauseStatement:
+		return evalForClauseStatement(s, scope)
 	case *ast.WhileStatement:
 		return evalWhileStatement(s, scope)
+	case *ast.DoWhileStatement:
+		return evalDoWhileStatement(s, scope)
+	case *ast.SwitchStatement:
+		return evalSwitchStatement(s, scope)
 	case *ast.AssignmentExpr:
 		return evalAssignmentExpr(s, scope)
 	case *ast.ImportStatement:
 		return evalImport(s, scope)
 	case *ast.FunctionDeclaration:
-		uf := &UserFunction{Params: s.Params, Body: s.Body, Env: scope}
+		uf := &UserFunction{Name: s.Name, File: s.File, Params: s.Params, Body: s.Body, Env: scope}
 		if s.Name != "" {
 			// Function declaration with name - declare in scope
-			scope.DeclareVar(s.Name, uf, true)
+			if _, err := scope.DeclareVar(s.Name, uf, ast.ConstDecl); err != nil {
+				return nil, locate(err, s)
+			}
 		}
 		// Return the function (for both declarations and expressions)
 		return uf, nil
@@ -226,50 +183,251 @@ func Evaluate(stmt ast.Stmt, scope *Environment) (RuntimeVal, *Error) {
 		return evalUnaryExpr(s, scope)
 	case *ast.TryStatement:
 		return evalTryStatement(s, scope)
+	case *ast.ThrowStatement:
+		val, err := Evaluate(s.Value, scope)
+		if err != nil {
+			return nil, err
+		}
+		return nil, locate(thrownError(val), s)
 	case *ast.BreakStatement:
-		return &BreakVal{}, nil
+		return &BreakVal{Label: s.Label}, nil
 	case *ast.ContinueStatement:
-		return &ContinueVal{}, nil
+		return &ContinueVal{Label: s.Label}, nil
 	default:
-		return nil, NewError(fmt.Sprintf("unknown statement type: %T", s), 0, 0)
+		return nil, errorAt(stmt, fmt.Sprintf("unknown statement type: %T", s))
+	}
+}
+
+// evalChain -> evaluates one link of a member/index/call chain; short reports that a ?.
+// met null, which skips the rest of the chain so a?.b.c is null when a is
+func evalChain(node ast.Stmt, scope *Environment) (val RuntimeVal, short bool, err *Error) {
+	switch s := node.(type) {
+	case *ast.MemberExpr:
+		obj, short, err := evalChain(s.Object, scope)
+		if err != nil || short {
+			return obj, short, err
+		}
+		if _, isNull := obj.(*NullVal); isNull && s.Optional {
+			return obj, true, nil
+		}
+		val, err := evalMember(obj, s.Property.Symbol)
+		if err != nil {
+			return nil, false, locate(err, s)
+		}
+		return val, false, nil
+	case *ast.IndexExpr:
+		obj, short, err := evalChain(s.Object, scope)
+		if err != nil || short {
+			return obj, short, err
+		}
+		if _, isNull := obj.(*NullVal); isNull && s.Optional {
+			return obj, true, nil
+		}
+		idx, err := Evaluate(s.Index, scope)
+		if err != nil {
+			return nil, false, err
+		}
+		val, err := evalIndex(obj, idx)
+		if err != nil {
+			return nil, false, locate(err, s)
+		}
+		return val, false, nil
+	case *ast.CallExpr:
+		fn, short, err := evalChain(s.Callee, scope)
+		if err != nil || short {
+			return fn, short, err
+		}
+		val, err := evalCall(s, fn, scope)
+		return val, false, err
+	}
+	val, err = Evaluate(node, scope)
+	return val, false, err
+}
+
+// evalCall -> evaluates the arguments of s and calls fn with them
+func evalCall(s *ast.CallExpr, fn RuntimeVal, scope *Environment) (RuntimeVal, *Error) {
+	var err *Error
+	args := make([]RuntimeVal, len(s.Args))
+	for i, arg := range s.Args {
+		args[i], err = Evaluate(arg, scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res, err := callValue(fn, args, scope, s.Pos().Line)
+	if err != nil {
+		return nil, locate(err, s)
+	}
+	return res, nil
+}
+
+// callValue -> calls fn with args from code in scope at line; errors of built-ins and
+// non-functions come back unlocated
+func callValue(fn RuntimeVal, args []RuntimeVal, scope *Environment, line int) (RuntimeVal, *Error) {
+	switch f := fn.(type) {
+	case Function:
+		res, err := f(args...)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			return fastNull(), nil
+		}
+		return res, nil
+	case *UserFunction:
+		return invokeUserFunction(f, args, line)
+	case *VMFunction, *VMClosure:
+		// functions compiled by the VM can escape into interpreted code
+		if engine := compiledBy(f); engine != nil {
+			return engine.callCompiled(f, args, line)
+		}
+		if scope != nil && scope.engine != nil {
+			return scope.engine.callCompiled(f, args, line)
+		}
+	}
+	return nil, NewError(fmt.Sprintf("not a function: %T", fn), 0, 0)
+}
+
+// invokeUserFunction -> calls f, through the engine when it is tiering functions;
+// errors come back unwound through the call made at line. Past maxCallDepth nested
+// calls it raises a stack overflow error instead of exhausting the Go stack
+func invokeUserFunction(f *UserFunction, args []RuntimeVal, line int) (RuntimeVal, *Error) {
+	if engine := f.Env.engine; engine != nil {
+		if engine.tiering {
+			return engine.callFunction(f, args, line)
+		}
+		if err := engine.enter(); err != nil {
+			return nil, err
+		}
+		defer engine.leave()
+	}
+	res, err := callUserFunction(f, args)
+	if err != nil {
+		return nil, err.unwind(f.frameName(), f.File, line)
+	}
+	return res, nil
+}
+
+// callUserFunction -> evaluates the body of f in a new scope binding its params
+// (missing args are null); as in the compiler, the result is the returned value, the
+// value of a final expression statement, or null
+func callUserFunction(f *UserFunction, args []RuntimeVal) (RuntimeVal, *Error) {
+	callEnv := NewEnvironment(f.Env)
+	callEnv.call = f
+	for idx, name := range f.Params {
+		var val RuntimeVal
+		if idx < len(args) { val = args[idx] } else { val = fastNull() }
+		if _, err := callEnv.DeclareVar(name, val, ast.VarDecl); err != nil {
+			return nil, err
+		}
+	}
+	res, err := evalBlockStatement(f.Body.(*ast.BlockStatement), callEnv)
+	if err != nil {
+		return nil, err
+	}
+	if rv, ok := res.(*ReturnVal); ok {
+		if rv.Inner == nil {
+			return fastNull(), nil
+		}
+		return rv.Inner, nil
 	}
+	body := f.Body.(*ast.BlockStatement).Statements
+	if n := len(body); n > 0 && res != nil {
+		if _, ok := body[n-1].(ast.Expr); ok && !isDeclaration(body[n-1]) {
+			return res, nil
+		}
+	}
+	return fastNull(), nil
 }
 
 func evalAssignmentExpr(node *ast.AssignmentExpr, scope *Environment) (RuntimeVal, *Error) {
-	if ident, ok := node.Assignee.(*ast.Identifier); ok {
-		// Fast path for x = x + literal pattern
-		if binExpr, ok := node.Value.(*ast.BinaryExpr); ok {
-			if leftIdent, ok := binExpr.Left.(*ast.Identifier); ok && leftIdent.Symbol == ident.Symbol {
-				if binExpr.Operator == "+" {
-					if numLit, ok := binExpr.Right.(*ast.NumericLiteral); ok {
-						// Pattern: x = x + number_literal
-						current := scope.LookupVar(ident.Symbol)
-						if currentNum, ok := current.(*NumberVal); ok {
-							currentNum.Value += numLit.Value
-							return currentNum, nil
-						}
-					} else if rightIdent, ok := binExpr.Right.(*ast.Identifier); ok {
-						// Pattern: x = x + y
-						current := scope.LookupVar(ident.Symbol)
-						if currentNum, ok := current.(*NumberVal); ok {
-							rightVal := scope.LookupVar(rightIdent.Symbol)
-							if rightNum, ok := rightVal.(*NumberVal); ok {
-								currentNum.Value += rightNum.Value
-								return currentNum, nil
-							}
-						}
-					}
-				}
+	switch target := node.Assignee.(type) {
+	case *ast.Identifier:
+		var current RuntimeVal
+		if node.Operator != "" {
+			if current = scope.LookupVar(target.Symbol); current == nil {
+				return nil, errorAt(target, fmt.Sprintf("undefined variable: %s", target.Symbol))
+			}
+		}
+		value, err := assignedValue(node, current, scope)
+		if err != nil {
+			return nil, err
+		}
+		assigned, err := scope.AssignVar(target.Symbol, value)
+		if err != nil {
+			return nil, locate(err, node)
+		}
+		return assigned, nil
+	case *ast.IndexExpr:
+		obj, err := Evaluate(target.Object, scope)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := Evaluate(target.Index, scope)
+		if err != nil {
+			return nil, err
+		}
+		var current RuntimeVal
+		if node.Operator != "" {
+			if current, err = evalIndex(obj, idx); err != nil {
+				return nil, locate(err, target)
 			}
 		}
-		
-		value, err := Evaluate(node.Value, scope)
+		value, err := assignedValue(node, current, scope)
 		if err != nil {
 			return nil, err
 		}
-		return scope.AssignVar(ident.Symbol, value), nil
+		if err := setIndex(obj, idx, value); err != nil {
+			return nil, locate(err, target)
+		}
+		return value, nil
+	case *ast.MemberExpr:
+		obj, err := Evaluate(target.Object, scope)
+		if err != nil {
+			return nil, err
+		}
+		var current RuntimeVal
+		if node.Operator != "" {
+			if current, err = evalMember(obj, target.Property.Symbol); err != nil {
+				return nil, locate(err, target)
+			}
+		}
+		value, err := assignedValue(node, current, scope)
+		if err != nil {
+			return nil, err
+		}
+		if err := setMember(obj, target.Property.Symbol, value); err != nil {
+			return nil, locate(err, target)
+		}
+		return value, nil
+	}
+	return nil, errorAt(node, fmt.Sprintf("invalid assignment target: %T", node.Assignee))
+}
+
+// assignedValue -> the value an assignment stores: the right-hand side, combined
+// with the target's current value for compound forms like +=
+func assignedValue(node *ast.AssignmentExpr, current RuntimeVal, scope *Environment) (RuntimeVal, *Error) {
+	value, err := Evaluate(node.Value, scope)
+	if err != nil {
+		return nil, err
 	}
-	return nil, NewError(fmt.Sprintf("invalid assignment target: %T", node.Assignee), 0, 0)
+	if node.Operator == "" {
+		return value, nil
+	}
+	result, err := binaryOp(node.Operator, current, value)
+	if err != nil {
+		return nil, locate(err, node)
+	}
+	return result, nil
+}
+
+// assignNumber -> stores a fast-path arithmetic result through AssignVar so let/const still hold
+func assignNumber(scope *Environment, node ast.Stmt, name string, value RuntimeVal) (RuntimeVal, *Error) {
+	assigned, err := scope.AssignVar(name, value)
+	if err != nil {
+		return nil, locate(err, node)
+	}
+	return assigned, nil
 }
 
 func evalProgram(program *ast.Program, scope *Environment) (RuntimeVal, *Error) {
@@ -288,32 +446,9 @@ func evalProgram(program *ast.Program, scope *Environment) (RuntimeVal, *Error)
 }
 
 func evalBlockStatement(block *ast.BlockStatement, scope *Environment) (RuntimeVal, *Error) {
-	// Fast path for single statement blocks
-	if len(block.Statements) == 1 {
-		stmt := block.Statements[0]
-		// Ultra-fast path for common assignment patterns
-		if assign, ok := stmt.(*ast.AssignmentExpr); ok {
-			if ident, ok := assign.Assignee.(*ast.Identifier); ok {
-				if binExpr, ok := assign.Value.(*ast.BinaryExpr); ok {
-					// Pattern: x = x + something
-					if leftIdent, ok := binExpr.Left.(*ast.Identifier); ok && leftIdent.Symbol == ident.Symbol {
-						if binExpr.Operator == "+" {
-							current := scope.LookupVar(ident.Symbol)
-							if currentNum, ok := current.(*NumberVal); ok {
-								rightVal, err := Evaluate(binExpr.Right, scope)
-								if err != nil { return nil, err }
-								if rightNum, ok := rightVal.(*NumberVal); ok {
-									// Fast add and assign
-									currentNum.Value += rightNum.Value
-									return currentNum, nil
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-		return Evaluate(stmt, scope)
+	// Fast path for single statement blocks (declarations need their own scope)
+	if len(block.Statements) == 1 && !isDeclaration(block.Statements[0]) {
+		return Evaluate(block.Statements[0], scope)
 	}
 	
 	// Fast path for empty blocks
@@ -342,6 +477,15 @@ func evalBlockStatement(block *ast.BlockStatement, scope *Environment) (RuntimeV
 	return lastResult, nil
 }
 
+// isDeclaration -> statement that binds a name in the current scope
+func isDeclaration(stmt ast.Stmt) bool {
+	switch stmt.(type) {
+	case *ast.VarDeclaration, *ast.FunctionDeclaration, *ast.ImportStatement:
+		return true
+	}
+	return false
+}
+
 func evalIfStatement(stmt *ast.IfStatement, scope *Environment) (RuntimeVal, *Error) {
 	condition, err := Evaluate(stmt.Condition, scope)
 	if err != nil {
@@ -357,102 +501,201 @@ func evalIfStatement(stmt *ast.IfStatement, scope *Environment) (RuntimeVal, *Er
 	return nil, nil
 }
 
-func evalForStatement(stmt *ast.ForStatement, scope *Environment) (RuntimeVal, *Error) {
-	rangeVal, err := Evaluate(stmt.Range, scope)
+// evalSwitchStatement -> runs the first case holding a value == the discriminant (else
+// default), comparing as the compiled switch does; break leaves the switch
+func evalSwitchStatement(stmt *ast.SwitchStatement, scope *Environment) (RuntimeVal, *Error) {
+	value, err := Evaluate(stmt.Discriminant, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	if rng, ok := rangeVal.(*NumberVal); ok {
-		// Fast path: check if loop body is empty or simple
-		if len(stmt.Body.Statements) == 0 {
-			// Empty loop - just burn cycles efficiently
-			count := int(rng.Value)
-			for i := 0; i < count; i++ {
-				// Minimal work
+	var match, fallback *ast.SwitchCase
+cases:
+	for _, clause := range stmt.Cases {
+		if len(clause.Values) == 0 {
+			if fallback == nil {
+				fallback = clause
 			}
-			return fastNull(), nil
+			continue
 		}
-		
-		// Ultra-fast path for simple assignment patterns
-		if len(stmt.Body.Statements) == 1 {
-			if assign, ok := stmt.Body.Statements[0].(*ast.AssignmentExpr); ok {
-				if ident, ok := assign.Assignee.(*ast.Identifier); ok {
-					if binExpr, ok := assign.Value.(*ast.BinaryExpr); ok {
-						if leftIdent, ok := binExpr.Left.(*ast.Identifier); ok && leftIdent.Symbol == ident.Symbol {
-							// Pattern: x = x + i or x = x + 1
-							if binExpr.Operator == "+" {
-								accumVar := scope.LookupVar(ident.Symbol)
-								if accumNum, ok := accumVar.(*NumberVal); ok {
-									count := int(rng.Value)
-									// Check if adding iterator variable
-									if rightIdent, ok := binExpr.Right.(*ast.Identifier); ok && rightIdent.Symbol == stmt.Identifier.Symbol {
-										// sum = sum + i pattern - ultra fast
-										for i := 0; i < count; i++ {
-											accumNum.Value += float64(i)
-										}
-										return accumNum, nil
-									} else if numLit, ok := binExpr.Right.(*ast.NumericLiteral); ok {
-										// x = x + constant pattern
-										accumNum.Value += numLit.Value * float64(count)
-										return accumNum, nil
-									} else if modExpr, ok := binExpr.Right.(*ast.BinaryExpr); ok {
-										// Pattern: sum = sum + (i % n)
-										if modExpr.Operator == "%" {
-											if leftMod, ok := modExpr.Left.(*ast.Identifier); ok && leftMod.Symbol == stmt.Identifier.Symbol {
-												if rightMod, ok := modExpr.Right.(*ast.NumericLiteral); ok {
-													// Ultra-fast modulo pattern
-													modVal := int(rightMod.Value)
-													for i := 0; i < count; i++ {
-														accumNum.Value += float64(i % modVal)
-													}
-													return accumNum, nil
-												}
-											}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
+		for _, expr := range clause.Values {
+			candidate, err := Evaluate(expr, scope)
+			if err != nil {
+				return nil, err
+			}
+			equal, err := binaryOp("==", value, candidate)
+			if err != nil {
+				return nil, locate(err, expr)
+			}
+			if isTruthy(equal) {
+				match = clause
+				break cases
 			}
 		}
-		
-		// Optimized environment handling
-		forScope := NewEnvironment(scope)
-		counterVar := fastNumber(0)
-		forScope.DeclareVar(stmt.Identifier.Symbol, counterVar, false)
-		
-		count := int(rng.Value)
-		for i := 0; i < count; i++ {
-			// Create a fresh scope for each iteration to handle let declarations
-			iterScope := NewEnvironment(forScope)
-			// Reuse number object to avoid allocations
-			counterVar.Value = float64(i)
-			iterScope.variables[stmt.Identifier.Symbol] = counterVar
-			
-			result, err := evalBlockStatement(stmt.Body, iterScope)
+	}
+	if match == nil {
+		match = fallback
+	}
+	if match == nil {
+		return fastNull(), nil
+	}
+
+	result, err := evalBlockStatement(match.Body, scope)
+	if err != nil {
+		return nil, err
+	}
+	if b, isBreak := result.(*BreakVal); isBreak && b.Label == "" {
+		return fastNull(), nil
+	}
+	return result, nil
+}
+
+// evalForStatement -> for range(i, start, end, step): counts from start toward end, stopping
+// before it, with i bound afresh in each iteration's scope
+func evalForStatement(stmt *ast.ForStatement, scope *Environment) (RuntimeVal, *Error) {
+	start, err := rangeBound(stmt.Start, 0, scope)
+	if err != nil {
+		return nil, err
+	}
+	end, err := rangeBound(stmt.Range, 0, scope)
+	if err != nil {
+		return nil, err
+	}
+	step, err := rangeBound(stmt.Step, 1, scope)
+	if err != nil {
+		return nil, err
+	}
+	if by, _ := toFloat(step); by == 0 {
+		return nil, errorAt(stmt.Step, "for range step cannot be 0")
+	}
+	if scope.optimizing() {
+		if done, err := summarizeRange(stmt, start, end, step, scope); done || err != nil {
+			return fastNull(), err
+		}
+	}
+
+	next := rangeCounter(start, end, step)
+	for i, more := next(); more; i, more = next() {
+		iterScope := NewEnvironment(scope)
+		iterScope.DeclareVar(stmt.Identifier.Symbol, i, ast.VarDecl)
+		iterScope.backEdge()
+		result, err := evalBlockStatement(stmt.Body, iterScope)
+		if err != nil {
+			return nil, err
+		}
+		if done, exit := loopExit(result, stmt.Label); done {
+			return exit, nil
+		}
+	}
+	return fastNull(), nil
+}
+
+// rangeBound -> number or integer a for range bound evaluates to, def when it is omitted
+func rangeBound(expr ast.Expr, def int64, scope *Environment) (RuntimeVal, *Error) {
+	if expr == nil {
+		return fastInt(def), nil
+	}
+	val, err := Evaluate(expr, scope)
+	if err != nil {
+		return nil, err
+	}
+	if !isNumeric(val) {
+		return nil, errorAt(expr, "for loop range must be a number")
+	}
+	return val, nil
+}
+
+// evalForInStatement -> one iteration per element, character or map entry, each in a fresh scope
+func evalForInStatement(stmt *ast.ForInStatement, scope *Environment) (RuntimeVal, *Error) {
+	coll, err := Evaluate(stmt.Collection, scope)
+	if err != nil {
+		return nil, err
+	}
+	it, err := newIterator(coll)
+	if err != nil {
+		return nil, locate(err, stmt.Collection)
+	}
+
+	for {
+		key, value, ok := it.next()
+		if !ok {
+			break
+		}
+		iterScope := NewEnvironment(scope)
+		iterScope.backEdge()
+		if stmt.Key != nil {
+			iterScope.DeclareVar(stmt.Key.Symbol, key, ast.VarDecl)
+			iterScope.DeclareVar(stmt.Value.Symbol, value, ast.VarDecl)
+		} else {
+			iterScope.DeclareVar(stmt.Value.Symbol, it.single(key, value), ast.VarDecl)
+		}
+		result, err := evalBlockStatement(stmt.Body, iterScope)
+		if err != nil {
+			return nil, err
+		}
+		if done, exit := loopExit(result, stmt.Label); done {
+			return exit, nil
+		}
+	}
+	return fastNull(), nil
+}
+
+// evalForClauseStatement -> for (init; condition; post); continue still runs post
+func evalForClauseStatement(stmt *ast.ForClauseStatement, scope *Environment) (RuntimeVal, *Error) {
+	loopScope := NewEnvironment(scope)
+	if stmt.Init != nil {
+		if _, err := Evaluate(stmt.Init, loopScope); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		if stmt.Condition != nil {
+			condition, err := Evaluate(stmt.Condition, loopScope)
 			if err != nil {
 				return nil, err
 			}
-			if _, isBreak := result.(*BreakVal); isBreak {
+			if !isTruthy(condition) {
 				break
 			}
-			if _, isContinue := result.(*ContinueVal); isContinue {
-				continue
-			}
-			if _, isReturn := result.(*ReturnVal); isReturn {
-				return result, nil
+		}
+		loopScope.backEdge()
+		result, err := evalBlockStatement(stmt.Body, loopScope)
+		if err != nil {
+			return nil, err
+		}
+		if done, exit := loopExit(result, stmt.Label); done {
+			return exit, nil
+		}
+		if stmt.Post != nil {
+			if _, err := Evaluate(stmt.Post, loopScope); err != nil {
+				return nil, err
 			}
 		}
-	} else {
-		return nil, NewError("for loop range must be a number", 0, 0)
 	}
-
 	return fastNull(), nil
 }
 
+// loopExit -> whether a body result ends the loop labeled label, and what the loop then
+// yields: null after its own break, otherwise the return or the labeled break/continue
+// aimed at an outer loop, which keeps propagating
+func loopExit(result RuntimeVal, label string) (bool, RuntimeVal) {
+	switch r := result.(type) {
+	case *ReturnVal:
+		return true, result
+	case *BreakVal:
+		if r.Label == "" || r.Label == label {
+			return true, fastNull()
+		}
+		return true, result
+	case *ContinueVal:
+		if r.Label != "" && r.Label != label {
+			return true, result
+		}
+	}
+	return false, nil
+}
+
 func evalWhileStatement(stmt *ast.WhileStatement, scope *Environment) (RuntimeVal, *Error) {
 	for {
 		condition, err := Evaluate(stmt.Condition, scope)
@@ -463,19 +706,38 @@ func evalWhileStatement(stmt *ast.WhileStatement, scope *Environment) (RuntimeVa
 		if !isTruthy(condition) {
 			break
 		}
+		scope.backEdge()
 
 		result, err := evalBlockStatement(stmt.Body, scope)
 		if err != nil {
 			return nil, err
 		}
-		if _, isBreak := result.(*BreakVal); isBreak {
-			break
+		if done, exit := loopExit(result, stmt.Label); done {
+			return exit, nil
 		}
-		if _, isContinue := result.(*ContinueVal); isContinue {
-			continue
+	}
+
+	return nil, nil
+}
+
+// evalDoWhileStatement -> body first, then the condition decides whether to go again
+func evalDoWhileStatement(stmt *ast.DoWhileStatement, scope *Environment) (RuntimeVal, *Error) {
+	for {
+		scope.backEdge()
+		result, err := evalBlockStatement(stmt.Body, scope)
+		if err != nil {
+			return nil, err
 		}
-		if _, isReturn := result.(*ReturnVal); isReturn {
-			return result, nil
+		if done, exit := loopExit(result, stmt.Label); done {
+			return exit, nil
+		}
+
+		condition, err := Evaluate(stmt.Condition, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !isTruthy(condition) {
+			break
 		}
 	}
 
@@ -503,7 +765,7 @@ func evalMapLiteral(lit *ast.MapLiteral, scope *Environment) (RuntimeVal, *Error
 		}
 		strKey, ok := key.(*StringVal)
 		if !ok {
-			return nil, NewError(fmt.Sprintf("map key must be a string, got %T", key), 0, 0)
+			return nil, errorAt(prop.Key, fmt.Sprintf("map key must be a string, got %s", key.Type()))
 		}
 
 		value, err := Evaluate(prop.Value, scope)
@@ -520,64 +782,55 @@ func evalBinaryExpr(expr *ast.BinaryExpr, scope *Environment) (RuntimeVal, *Erro
 	if err != nil {
 		return nil, err
 	}
+	// Short-circuit: && yields the first falsy operand, || the first truthy one, ?? the first non-null
+	switch expr.Operator {
+	case "??":
+		if _, isNull := leftVal.(*NullVal); !isNull {
+			return leftVal, nil
+		}
+		return Evaluate(expr.Right, scope)
+	case "&&":
+		if !isTruthy(leftVal) {
+			return leftVal, nil
+		}
+		return Evaluate(expr.Right, scope)
+	case "||":
+		if isTruthy(leftVal) {
+			return leftVal, nil
+		}
+		return Evaluate(expr.Right, scope)
+	}
 	rightVal, err := Evaluate(expr.Right, scope)
 	if err != nil {
 		return nil, err
 	}
-
-	// Fast numeric operations with pooled values
-	if leftNum, okLeft := leftVal.(*NumberVal); okLeft {
-		if rightNum, okRight := rightVal.(*NumberVal); okRight {
-			switch expr.Operator {
-			case "+":
-				return fastNumber(leftNum.Value + rightNum.Value), nil
-			case "-":
-				return fastNumber(leftNum.Value - rightNum.Value), nil
-			case "*":
-				return fastNumber(leftNum.Value * rightNum.Value), nil
-			case "/":
-				if rightNum.Value == 0 {
-					return nil, NewError("division by zero", 0, 0)
-				}
-				return fastNumber(leftNum.Value / rightNum.Value), nil
-			case "%":
-				if rightNum.Value == 0 {
-					return nil, NewError("modulo by zero", 0, 0)
-				}
-				return fastNumber(float64(int(leftNum.Value) % int(rightNum.Value))), nil
-			case "==":
-				return fastBool(leftNum.Value == rightNum.Value), nil
-			case "!=":
-				return fastBool(leftNum.Value != rightNum.Value), nil
-			case "<":
-				return fastBool(leftNum.Value < rightNum.Value), nil
-			case "<=":
-				return fastBool(leftNum.Value <= rightNum.Value), nil
-			case ">":
-				return fastBool(leftNum.Value > rightNum.Value), nil
-			case ">=":
-				return fastBool(leftNum.Value >= rightNum.Value), nil
-			}
-		}
+	result, err := binaryOp(expr.Operator, leftVal, rightVal)
+	if err != nil {
+		return nil, locate(err, expr)
 	}
+	return result, nil
+}
 
-	// handling logical operations
-	if leftBool, okLeft := leftVal.(*BooleanVal); okLeft {
-		if rightBool, okRight := rightVal.(*BooleanVal); okRight {
-			switch expr.Operator {
-			case "&&":
-				return fastBool(leftBool.Value && rightBool.Value), nil
-			case "||":
-				return fastBool(leftBool.Value || rightBool.Value), nil
-			}
+// binaryOp -> applies a non short-circuit binary operator to evaluated operands (error unlocated)
+func binaryOp(op string, leftVal, rightVal RuntimeVal) (RuntimeVal, *Error) {
+
+	// Fast numeric operations
+	if isNumeric(leftVal) && isNumeric(rightVal) {
+		if isArithmetic(op) {
+			return numericOp(op, leftVal, rightVal)
+		}
+		if result, ok := compareNumbers(op, leftVal, rightVal); ok {
+			return fastBool(result), nil
 		}
+	} else if op == "&" || op == "|" || op == "^" || op == "<<" || op == ">>" {
+		return bitwiseOp(op, leftVal, rightVal)
 	}
 
 	// handling string operations
 	if leftStr, okLeft := leftVal.(*StringVal); okLeft {
 		switch r := rightVal.(type) {
 		case *StringVal:
-			switch expr.Operator {
+			switch op {
 			case "+":
 				// Fast string concat using builder for large strings
 				if len(leftStr.Value) > 100 || len(r.Value) > 100 {
@@ -592,10 +845,10 @@ func evalBinaryExpr(expr *ast.BinaryExpr, scope *Environment) (RuntimeVal, *Erro
 			case "!=":
 				return fastBool(leftStr.Value != r.Value), nil
 			default:
-				return nil, NewError(fmt.Sprintf("unknown operator %s for string operands", expr.Operator), 0, 0)
+				return nil, NewError(fmt.Sprintf("unknown operator %s for string operands", op), 0, 0)
 			}
 		default:
-			if expr.Operator == "+" {
+			if op == "+" {
 				return fastString(leftStr.Value + rightVal.String()), nil
 			}
 		}
@@ -604,19 +857,19 @@ func evalBinaryExpr(expr *ast.BinaryExpr, scope *Environment) (RuntimeVal, *Erro
 	// Handle null comparisons
 	if _, leftNull := leftVal.(*NullVal); leftNull {
 		if _, rightNull := rightVal.(*NullVal); rightNull {
-			switch expr.Operator {
+			switch op {
 			case "==": return fastBool(true), nil
 			case "!=": return fastBool(false), nil
 			}
 		} else {
-			switch expr.Operator {
+			switch op {
 			case "==": return fastBool(false), nil
 			case "!=": return fastBool(true), nil
 			}
 		}
 	}
 	if _, rightNull := rightVal.(*NullVal); rightNull {
-		switch expr.Operator {
+		switch op {
 		case "==": return fastBool(false), nil
 		case "!=": return fastBool(true), nil
 		}
@@ -625,7 +878,7 @@ func evalBinaryExpr(expr *ast.BinaryExpr, scope *Environment) (RuntimeVal, *Erro
 	// handling boolean equality
 	if leftBool, okLeft := leftVal.(*BooleanVal); okLeft {
 		if rightBool, okRight := rightVal.(*BooleanVal); okRight {
-			switch expr.Operator {
+			switch op {
 			case "==":
 				return fastBool(leftBool.Value == rightBool.Value), nil
 			case "!=":
@@ -635,307 +888,133 @@ func evalBinaryExpr(expr *ast.BinaryExpr, scope *Environment) (RuntimeVal, *Erro
 	}
 
 	// Handle mixed type comparisons for ==, !=
-	if expr.Operator == "==" {
+	if op == "==" {
 		return fastBool(false), nil // Different types are never equal
 	}
-	if expr.Operator == "!=" {
+	if op == "!=" {
 		return fastBool(true), nil // Different types are never equal
 	}
 
-	return nil, NewError(fmt.Sprintf("unknown operator %s for types %s and %s", expr.Operator, leftVal.Type(), rightVal.Type()), 0, 0)
+	return nil, NewError(fmt.Sprintf("unknown operator %s for types %s and %s", op, leftVal.Type(), rightVal.Type()), 0, 0)
 }
 
 func isTruthy(val RuntimeVal) bool {
 	if val == nil {
 		return false
 	}
+	if _, ok := val.(*NullVal); ok {
+		return false
+	}
 	if b, ok := val.(*BooleanVal); ok {
 		return b.Value
 	}
 	if n, ok := val.(*NumberVal); ok {
 		return n.Value != 0
 	}
+	if i, ok := val.(*IntVal); ok {
+		return i.Value != 0
+	}
 	if s, ok := val.(*StringVal); ok {
 		return s.Value != ""
 	}
 	return true
 }
 
-// Module-system
-func builtinModules() map[string]*MapVal {
-	mods := map[string]*MapVal{}
-	
-	// time module
-	timeMod := &MapVal{Properties: map[string]RuntimeVal{}}
-	timeMod.Properties["now"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		ns := time.Now().UnixNano()
-		secs := float64(ns) / 1e9
-		return &NumberVal{Value: secs}, nil
-	})
-	timeMod.Properties["millis"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		ns := time.Now().UnixNano()
-		ms := float64(ns) / 1e6
-		return &NumberVal{Value: ms}, nil
-	})
-	timeMod.Properties["nanos"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		ns := time.Now().UnixNano()
-		return &NumberVal{Value: float64(ns)}, nil
-	})
-	mods["time"] = timeMod
-	
-	// fmaths module = advanced mathematical functions  
-	fmathsMod := &MapVal{Properties: map[string]RuntimeVal{}}
-	
-	// basic powers and roots
-	fmathsMod.Properties["pow"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 2 {
-			return nil, NewError("pow requires 2 arguments", 0, 0)
-		}
-		x, ok1 := args[0].(*NumberVal)
-		y, ok2 := args[1].(*NumberVal)
-		if !ok1 || !ok2 {
-			return nil, NewError("pow requires numeric arguments", 0, 0)
-		}
-		return &NumberVal{Value: math.Pow(x.Value, y.Value)}, nil
-	})
-	
-	fmathsMod.Properties["sqrt"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("sqrt requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("sqrt requires numeric argument", 0, 0)
-		}
-		if x.Value < 0 {
-			return nil, NewError("sqrt of negative number", 0, 0)
-		}
-		return &NumberVal{Value: math.Sqrt(x.Value)}, nil
-	})
-	
-	// trig functions
-	fmathsMod.Properties["sin"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("sin requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("sin requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Sin(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["cos"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("cos requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("cos requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Cos(x.Value)}, nil
-	})
-	
-	// Logs functions  
-	fmathsMod.Properties["log"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("log requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("log requires numeric argument", 0, 0)
-		}
-		if x.Value <= 0 {
-			return nil, NewError("log of non-positive number", 0, 0)
-		}
-		return &NumberVal{Value: math.Log(x.Value)}, nil
-	})
-	
-	// Expon functions
-	fmathsMod.Properties["exp"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("exp requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("exp requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Exp(x.Value)}, nil
-	})
-	
-	// Util functions
-	fmathsMod.Properties["abs"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("abs requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("abs requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Abs(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["floor"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("floor requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("floor requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Floor(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["ceil"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("ceil requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("ceil requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Ceil(x.Value)}, nil
-	})
-	
-	// additional math functions
-	fmathsMod.Properties["tan"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("tan requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("tan requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Tan(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["log10"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("log10 requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("log10 requires numeric argument", 0, 0)
-		}
-		if x.Value <= 0 {
-			return nil, NewError("log10 of non-positive number", 0, 0)
-		}
-		return &NumberVal{Value: math.Log10(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["log2"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("log2 requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("log2 requires numeric argument", 0, 0)
-		}
-		if x.Value <= 0 {
-			return nil, NewError("log2 of non-positive number", 0, 0)
-		}
-		return &NumberVal{Value: math.Log2(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["round"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 1 {
-			return nil, NewError("round requires 1 argument", 0, 0)
-		}
-		x, ok := args[0].(*NumberVal)
-		if !ok {
-			return nil, NewError("round requires numeric argument", 0, 0)
-		}
-		return &NumberVal{Value: math.Round(x.Value)}, nil
-	})
-	
-	fmathsMod.Properties["min"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 2 {
-			return nil, NewError("min requires at least 2 arguments", 0, 0)
-		}
-		minVal := math.Inf(1)
-		for _, arg := range args {
-			if num, ok := arg.(*NumberVal); ok {
-				if num.Value < minVal {
-					minVal = num.Value
-				}
-			} else {
-				return nil, NewError("min requires numeric arguments", 0, 0)
-			}
-		}
-		return &NumberVal{Value: minVal}, nil
-	})
-	
-	fmathsMod.Properties["max"] = Function(func(args ...RuntimeVal) (RuntimeVal, *Error) {
-		if len(args) < 2 {
-			return nil, NewError("max requires at least 2 arguments", 0, 0)
-		}
-		maxVal := math.Inf(-1)
-		for _, arg := range args {
-			if num, ok := arg.(*NumberVal); ok {
-				if num.Value > maxVal {
-					maxVal = num.Value
-				}
-			} else {
-				return nil, NewError("max requires numeric arguments", 0, 0)
-			}
-		}
-		return &NumberVal{Value: maxVal}, nil
-	})
-	
-	// Mathematical constants
-	fmathsMod.Properties["pi"] = &NumberVal{Value: math.Pi}
-	fmathsMod.Properties["e"] = &NumberVal{Value: math.E}
-	fmathsMod.Properties["phi"] = &NumberVal{Value: 1.618033988749894}
-	
-	mods["fmaths"] = fmathsMod
-	
-	return mods
-}
-
 func evalImport(imp *ast.ImportStatement, scope *Environment) (RuntimeVal, *Error) {
-	mods := builtinModules()
-	mod, ok := mods[imp.Path]
-	if !ok {
-		return nil, NewError(fmt.Sprintf("unknown module: %s", imp.Path), 0, 0)
+	mod, err := scope.module(imp.Path, imp.File, imp.Line)
+	if err != nil {
+		return nil, locate(err, imp)
+	}
+	if _, err := scope.DeclareVar(imp.Alias, mod, ast.ConstDecl); err != nil {
+		return nil, locate(err, imp)
 	}
-	scope.DeclareVar(imp.Alias, mod, true)
 	return mod, nil
 }
 
 func evalUnaryExpr(expr *ast.UnaryExpr, scope *Environment) (RuntimeVal, *Error) {
+	switch expr.Operator {
+	case "-", "+", "~", "!":
+		return evalPrefixOperator(expr, scope)
+	}
+
 	// Only identifiers are valid targets for ++/--
 	operand, ok := expr.Operand.(*ast.Identifier)
 	if !ok {
-		return nil, NewError("increment/decrement target must be an identifier", 0, 0)
+		return nil, errorAt(expr, "increment/decrement target must be an identifier")
 	}
 
 	current := scope.LookupVar(operand.Symbol)
-	num, ok := current.(*NumberVal)
-	if !ok {
-		return nil, NewError("increment/decrement requires numeric variable", 0, 0)
+	if current == nil {
+		return nil, errorAt(operand, fmt.Sprintf("undefined variable: %s", operand.Symbol))
+	}
+	if !isNumeric(current) {
+		return nil, errorAt(expr, "increment/decrement requires numeric variable")
 	}
 
-	if expr.Operator == "++" {
-		newVal := fastNumber(num.Value + 1)
-		scope.AssignVar(operand.Symbol, newVal)
-		if expr.Prefix { return newVal, nil }
-		return num, nil
-	} else if expr.Operator == "--" {
-		newVal := fastNumber(num.Value - 1)
-		scope.AssignVar(operand.Symbol, newVal)
-		if expr.Prefix { return newVal, nil }
-		return num, nil
+	var newVal RuntimeVal
+	switch expr.Operator {
+	case "++":
+		newVal, _ = numericOp("+", current, fastInt(1))
+	case "--":
+		newVal, _ = numericOp("-", current, fastInt(1))
+	default:
+		return nil, errorAt(expr, "unknown unary operator")
+	}
+	if _, err := scope.AssignVar(operand.Symbol, newVal); err != nil {
+		return nil, locate(err, expr)
+	}
+	if expr.Prefix { return newVal, nil }
+	return current, nil
+}
+
+// evalPrefixOperator -> -x and +x on numbers, ~x on integers, !x on any value's truthiness
+func evalPrefixOperator(expr *ast.UnaryExpr, scope *Environment) (RuntimeVal, *Error) {
+	val, err := Evaluate(expr.Operand, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch expr.Operator {
+	case "!":
+		return fastBool(!isTruthy(val)), nil
+	case "~":
+		result, err := bitwiseNot(val)
+		if err != nil {
+			return nil, locate(err, expr)
+		}
+		return result, nil
+	}
+	if !isNumeric(val) {
+		return nil, errorAt(expr, fmt.Sprintf("unary %s requires a number, got %s", expr.Operator, val.Type()))
+	}
+	if expr.Operator == "-" {
+		negated, _ := negate(val)
+		return negated, nil
 	}
-	return nil, NewError("unknown unary operator", 0, 0)
+	return val, nil
 }
 
 func evalTryStatement(ts *ast.TryStatement, scope *Environment) (RuntimeVal, *Error) {
 	// Evaluate try block; on error, bind to catch var and run catch block.
 	res, err := evalBlockStatement(ts.TryBlock, scope)
-	if err == nil { return res, nil }
-	catchScope := NewEnvironment(scope)
-	catchScope.DeclareVar(ts.ErrorVar, &StringVal{Value: err.Message}, false)
-	return evalBlockStatement(ts.CatchBlock, catchScope)
+	if err != nil && ts.CatchBlock != nil {
+		catchScope := NewEnvironment(scope)
+		catchScope.variables[ts.ErrorVar] = &ErrorVal{Err: err, frame: catchFrame(err, scope)}
+		res, err = evalBlockStatement(ts.CatchBlock, catchScope)
+	}
+	if ts.FinallyBlock == nil {
+		return res, err
+	}
+	// finally always runs; a pending error, return, break or continue resumes after it
+	// unless the finally block raises or transfers control itself.
+	finRes, finErr := evalBlockStatement(ts.FinallyBlock, scope)
+	if finErr != nil {
+		return nil, finErr
+	}
+	switch finRes.(type) {
+	case *ReturnVal, *BreakVal, *ContinueVal:
+		return finRes, nil
+	}
+	return res, err
 }
 
 func evalMember(obj RuntimeVal, prop string) (RuntimeVal, *Error) {
@@ -946,7 +1025,179 @@ func evalMember(obj RuntimeVal, prop string) (RuntimeVal, *Error) {
 			return nil, NewError(fmt.Sprintf("unknown property '%s'", prop), 0, 0)
 		}
 		return val, nil
+	case *ErrorVal:
+		if val, ok := errorProperty(o.Err, o.frame, prop); ok {
+			return val, nil
+		}
+		return nil, NewError(fmt.Sprintf("unknown property '%s'", prop), 0, 0)
 	default:
 		return nil, NewError(fmt.Sprintf("cannot access property '%s' on %s", prop, obj.Type()), 0, 0)
 	}
 }
+
+// setMember -> obj.prop = value, adding the key when the map does not have it yet
+func setMember(obj RuntimeVal, prop string, value RuntimeVal) *Error {
+	m, ok := obj.(*MapVal)
+	if !ok {
+		return NewError(fmt.Sprintf("cannot set property '%s' on %s", prop, obj.Type()), 0, 0)
+	}
+	m.Properties[prop] = value
+	return nil
+}
+
+// thrownError -> error raised by `throw val`; rethrowing a caught error keeps it intact
+func thrownError(val RuntimeVal) *Error {
+	switch v := val.(type) {
+	case *ErrorVal:
+		return v.Err
+	case *StringVal:
+		return &Error{Message: v.Value, Kind: ThrownErrorKind, Payload: v}
+	case *MapVal:
+		err := &Error{Message: Pretty(v), Kind: ThrownErrorKind, Payload: v}
+		if msg, ok := v.Properties["message"]; ok {
+			err.Message = msg.String()
+		}
+		if kind, ok := v.Properties["kind"].(*StringVal); ok {
+			err.Kind = kind.Value
+		}
+		return err
+	default:
+		return &Error{Message: Pretty(val), Kind: ThrownErrorKind, Payload: val}
+	}
+}
+
+// errorProperty -> field of an error caught in frame; map payload fields are exposed directly
+func errorProperty(err *Error, frame StackFrame, prop string) (RuntimeVal, bool) {
+	switch prop {
+	case "message":
+		return &StringVal{Value: err.Message}, true
+	case "kind":
+		return &StringVal{Value: err.Kind}, true
+	case "line":
+		return &IntVal{Value: int64(err.Line)}, true
+	case "column":
+		return &IntVal{Value: int64(err.Column)}, true
+	case "stack":
+		return stackValue(err, frame), true
+	case "value":
+		if err.Payload == nil {
+			return &NullVal{}, true
+		}
+		return err.Payload, true
+	}
+	if m, ok := err.Payload.(*MapVal); ok {
+		val, ok := m.Properties[prop]
+		return val, ok
+	}
+	return nil, false
+}
+
+// catchFrame -> frame of the function running scope, as a traceback would show it for
+// err: at the line of the call err unwound from, or at err's own line if raised there
+func catchFrame(err *Error, scope *Environment) StackFrame {
+	line := err.Line
+	if len(err.Stack) > 0 {
+		line = err.callLine
+	}
+	for env := scope; env != nil; env = env.parent {
+		if env.call != nil {
+			return StackFrame{Function: env.call.frameName(), File: env.call.File, Line: line}
+		}
+	}
+	if scope.engine != nil {
+		return StackFrame{Function: scope.engine.topLevel, File: scope.engine.file, Line: line}
+	}
+	return StackFrame{Function: "<main>", Line: line}
+}
+
+// stackValue -> frames of err as maps, most recent call last, ending with the frame that
+// caught it, so they match the traceback err would have had uncaught
+func stackValue(err *Error, caught StackFrame) *ArrayVal {
+	frames := make([]RuntimeVal, 0, len(err.Stack)+1)
+	stack := append(append([]StackFrame{}, err.Stack...), caught)
+	for i := len(stack) - 1; i >= 0; i-- {
+		fr := stack[i]
+		frames = append(frames, &MapVal{Properties: map[string]RuntimeVal{
+			"function": &StringVal{Value: fr.Function},
+			"file":     &StringVal{Value: fr.File},
+			"line":     &IntVal{Value: int64(fr.Line)},
+		}})
+	}
+	return &ArrayVal{Elements: frames}
+}
+
+// arrayIndex -> validates idx as an in-range integer index; a float holding a whole number will do
+func arrayIndex(idx RuntimeVal, length int) (int, *Error) {
+	if !isNumeric(idx) {
+		return 0, NewError(fmt.Sprintf("array index must be a number, got %s", idx.Type()), 0, 0)
+	}
+	i, ok := toInt(idx)
+	if !ok {
+		return 0, NewError(fmt.Sprintf("array index must be an integer, got %s", formatNumber(idx)), 0, 0)
+	}
+	if i < 0 || i >= int64(length) {
+		return 0, NewError(fmt.Sprintf("index %d out of range (length %d)", i, length), 0, 0)
+	}
+	return int(i), nil
+}
+
+func evalIndex(obj RuntimeVal, idx RuntimeVal) (RuntimeVal, *Error) {
+	switch o := obj.(type) {
+	case *ArrayVal:
+		i, err := arrayIndex(idx, len(o.Elements))
+		if err != nil {
+			return nil, err
+		}
+		return o.Elements[i], nil
+	case *StringVal:
+		chars := []rune(o.Value)
+		i, err := arrayIndex(idx, len(chars))
+		if err != nil {
+			return nil, err
+		}
+		return &StringVal{Value: string(chars[i])}, nil
+	case *MapVal:
+		key, ok := idx.(*StringVal)
+		if !ok {
+			return nil, NewError(fmt.Sprintf("map key must be a string, got %s", idx.Type()), 0, 0)
+		}
+		val, ok := o.Properties[key.Value]
+		if !ok {
+			return nil, NewError(fmt.Sprintf("unknown key '%s'", key.Value), 0, 0)
+		}
+		return val, nil
+	case *ErrorVal:
+		key, ok := idx.(*StringVal)
+		if !ok {
+			return nil, NewError(fmt.Sprintf("error key must be a string, got %s", idx.Type()), 0, 0)
+		}
+		val, ok := errorProperty(o.Err, o.frame, key.Value)
+		if !ok {
+			return nil, NewError(fmt.Sprintf("unknown key '%s'", key.Value), 0, 0)
+		}
+		return val, nil
+	default:
+		return nil, NewError(fmt.Sprintf("cannot index %s", obj.Type()), 0, 0)
+	}
+}
+
+func setIndex(obj RuntimeVal, idx RuntimeVal, value RuntimeVal) *Error {
+	switch o := obj.(type) {
+	case *ArrayVal:
+		i, err := arrayIndex(idx, len(o.Elements))
+		if err != nil {
+			return err
+		}
+		o.Elements[i] = value
+		return nil
+	case *MapVal:
+		key, ok := idx.(*StringVal)
+		if !ok {
+			return NewError(fmt.Sprintf("map key must be a string, got %s", idx.Type()), 0, 0)
+		}
+		o.Properties[key.Value] = value
+		return nil
+	default:
+		return NewError(fmt.Sprintf("cannot assign index on %s", obj.Type()), 0, 0)
+	}
+}
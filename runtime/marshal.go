@@ -0,0 +1,510 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Go <-> DYMS value conversion for hosts. Go values map onto DYMS values much as
+// encoding/json maps them onto JSON: bools, strings, integers (*IntVal), floats
+// (*NumberVal), slices and arrays (*ArrayVal), maps with string or integer keys and
+// structs (*MapVal), nil pointers, slices, maps and funcs (null). Struct fields use the
+// name in their `dyms:"name"` tag, or the field name; `dyms:"-"` skips a field and
+// `dyms:",omitempty"` leaves it out of the map when it is the zero value. Go funcs become
+// functions scripts can call, and DYMS functions become Go funcs Go code can call.
+// A RuntimeVal converts to itself either way.
+
+var (
+	runtimeValType = reflect.TypeOf((*RuntimeVal)(nil)).Elem()
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	functionType   = reflect.TypeOf(Function(nil))
+	anyType        = reflect.TypeOf((*any)(nil)).Elem()
+	anyFuncType    = reflect.TypeOf((func(...any) (any, error))(nil))
+)
+
+// ToValue -> DYMS value of a Go value
+func ToValue(v any) (RuntimeVal, error) {
+	val, err := toValue(reflect.ValueOf(v), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// FromValue -> stores val in the Go value target points to, converted to its type; null
+// stores the zero value and a target of type any gets the natural Go type (int64,
+// float64, string, bool, []any, map[string]any, func(...any) (any, error))
+func FromValue(val RuntimeVal, target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return NewError(fmt.Sprintf("FromValue needs a non-nil pointer, got %T", target), 0, 0)
+	}
+	if val == nil {
+		val = fastNull()
+	}
+	if err := fromValue(val, rv.Elem(), "", nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// visit -> a pointer, map or slice being converted; meeting it again inside itself is a
+// cycle, which has no DYMS form
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func toValue(rv reflect.Value, path string, seen map[visit]bool) (RuntimeVal, *Error) {
+	if !rv.IsValid() || (nilable(rv) && rv.IsNil()) {
+		return fastNull(), nil
+	}
+	if rv.Type().Implements(runtimeValType) {
+		return rv.Interface().(RuntimeVal), nil
+	}
+	if k := rv.Kind(); k == reflect.Pointer || k == reflect.Map || (k == reflect.Slice && rv.Len() > 0) {
+		v := visit{ptr: rv.Pointer(), typ: rv.Type()}
+		if k == reflect.Slice {
+			v.len = rv.Len()
+		}
+		if seen[v] {
+			return nil, conversionError(path, fmt.Sprintf("cycle through %s has no DYMS form", rv.Type()))
+		}
+		if seen == nil {
+			seen = map[visit]bool{}
+		}
+		seen[v] = true
+		defer delete(seen, v)
+	}
+	switch rv.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		return toValue(rv.Elem(), path, seen)
+	case reflect.Bool:
+		return fastBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fastInt(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u > math.MaxInt64 {
+			return fastNumber(float64(u)), nil // too big for an integer, as when + overflows
+		}
+		return fastInt(int64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return fastNumber(rv.Float()), nil
+	case reflect.String:
+		return fastString(rv.String()), nil
+	case reflect.Slice, reflect.Array:
+		elements := make([]RuntimeVal, rv.Len())
+		for i := range elements {
+			elem, err := toValue(rv.Index(i), fmt.Sprintf("%s[%d]", path, i), seen)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = elem
+		}
+		return &ArrayVal{Elements: elements}, nil
+	case reflect.Map:
+		props := make(map[string]RuntimeVal, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, ok := mapKey(iter.Key())
+			if !ok {
+				return nil, conversionError(path, fmt.Sprintf("map keys of type %s have no DYMS form", rv.Type().Key()))
+			}
+			elem, err := toValue(iter.Value(), path+"."+key, seen)
+			if err != nil {
+				return nil, err
+			}
+			props[key] = elem
+		}
+		return &MapVal{Properties: props}, nil
+	case reflect.Struct:
+		props := map[string]RuntimeVal{}
+		for _, f := range structFields(rv.Type()) {
+			field := rv.Field(f.index)
+			if f.omitEmpty && field.IsZero() {
+				continue
+			}
+			elem, err := toValue(field, path+"."+f.name, seen)
+			if err != nil {
+				return nil, err
+			}
+			props[f.name] = elem
+		}
+		return &MapVal{Properties: props}, nil
+	case reflect.Func:
+		if rv.Type().ConvertibleTo(functionType) {
+			return rv.Convert(functionType).Interface().(Function), nil
+		}
+		if !validResults(rv.Type()) {
+			return nil, conversionError(path, fmt.Sprintf("%s must return nothing, a value, an error or a value and an error", rv.Type()))
+		}
+		return goFunction(rv), nil
+	}
+	return nil, conversionError(path, fmt.Sprintf("cannot convert Go %s to a DYMS value", rv.Type()))
+}
+
+func fromValue(val RuntimeVal, rv reflect.Value, path string, seen map[RuntimeVal]bool) *Error {
+	t := rv.Type()
+	if reflect.TypeOf(val).AssignableTo(t) && t != anyType {
+		rv.Set(reflect.ValueOf(val))
+		return nil
+	}
+	if e, ok := val.(*ErrorVal); ok && reflect.TypeOf(e.Err).AssignableTo(t) {
+		rv.Set(reflect.ValueOf(e.Err)) // a caught error converts to a Go error
+		return nil
+	}
+	if _, ok := val.(*NullVal); ok {
+		rv.Set(reflect.Zero(t))
+		return nil
+	}
+	mismatch := func() *Error {
+		return conversionError(path, fmt.Sprintf("cannot convert %s to %s", val.Type(), t))
+	}
+	switch val.(type) {
+	case *ArrayVal, *MapVal:
+		// an array or map holding itself would fill Go values forever; interface and
+		// pointer targets convert val itself again, so only the others mark it
+		if k := t.Kind(); k != reflect.Interface && k != reflect.Pointer {
+			if seen[val] {
+				return conversionError(path, fmt.Sprintf("%s contains itself", val.Type()))
+			}
+			if seen == nil {
+				seen = map[RuntimeVal]bool{}
+			}
+			seen[val] = true
+			defer delete(seen, val)
+		}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return mismatch()
+		}
+		natural := naturalType(val)
+		if natural == nil {
+			rv.Set(reflect.ValueOf(val))
+			return nil
+		}
+		elem := reflect.New(natural).Elem()
+		if err := fromValue(val, elem, path, seen); err != nil {
+			return err
+		}
+		rv.Set(elem)
+	case reflect.Bool:
+		b, ok := val.(*BooleanVal)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetBool(b.Value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := toInt(val)
+		if !ok {
+			return mismatch()
+		}
+		if rv.OverflowInt(i) {
+			return conversionError(path, fmt.Sprintf("%d overflows %s", i, t))
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := toInt(val)
+		if !ok {
+			return mismatch()
+		}
+		if i < 0 || rv.OverflowUint(uint64(i)) {
+			return conversionError(path, fmt.Sprintf("%d overflows %s", i, t))
+		}
+		rv.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat(val)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetFloat(f)
+	case reflect.String:
+		s, ok := val.(*StringVal)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetString(s.Value)
+	case reflect.Slice, reflect.Array:
+		arr, ok := val.(*ArrayVal)
+		if !ok {
+			return mismatch()
+		}
+		if t.Kind() == reflect.Array {
+			if len(arr.Elements) > t.Len() {
+				return conversionError(path, fmt.Sprintf("%d elements do not fit %s", len(arr.Elements), t))
+			}
+			rv.Set(reflect.Zero(t))
+		} else {
+			rv.Set(reflect.MakeSlice(t, len(arr.Elements), len(arr.Elements)))
+		}
+		for i, elem := range arr.Elements {
+			if err := fromValue(elem, rv.Index(i), fmt.Sprintf("%s[%d]", path, i), seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := val.(*MapVal)
+		if !ok {
+			return mismatch()
+		}
+		result := reflect.MakeMapWithSize(t, len(m.Properties))
+		for name, prop := range m.Properties {
+			key := reflect.New(t.Key()).Elem()
+			if err := setMapKey(key, name, path); err != nil {
+				return err
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err := fromValue(prop, elem, path+"."+name, seen); err != nil {
+				return err
+			}
+			result.SetMapIndex(key, elem)
+		}
+		rv.Set(result)
+	case reflect.Struct:
+		m, ok := val.(*MapVal)
+		if !ok {
+			return mismatch()
+		}
+		for _, f := range structFields(t) {
+			if prop, found := m.Properties[f.name]; found {
+				if err := fromValue(prop, rv.Field(f.index), path+"."+f.name, seen); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Pointer:
+		ptr := reflect.New(t.Elem())
+		if err := fromValue(val, ptr.Elem(), path, seen); err != nil {
+			return err
+		}
+		rv.Set(ptr)
+	case reflect.Func:
+		if val.Type() != FunctionType {
+			return mismatch()
+		}
+		if !validResults(t) {
+			return conversionError(path, fmt.Sprintf("%s must return nothing, a value, an error or a value and an error", t))
+		}
+		rv.Set(dymsFunction(val, t))
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// goFunction -> a Go func scripts can call: arguments are converted to its parameter
+// types (missing ones from null), its result back to a DYMS value, and a non-nil error
+// result is raised as a DYMS error
+func goFunction(fn reflect.Value) Function {
+	t := fn.Type()
+	fixed := t.NumIn()
+	if t.IsVariadic() {
+		fixed--
+	}
+	return func(args ...RuntimeVal) (RuntimeVal, *Error) {
+		if !t.IsVariadic() && len(args) > fixed {
+			return nil, NewError(fmt.Sprintf("expected %d arguments, got %d", fixed, len(args)), 0, 0)
+		}
+		in := make([]reflect.Value, 0, len(args))
+		for i := 0; i < fixed || i < len(args); i++ {
+			var param reflect.Type
+			if i < fixed {
+				param = t.In(i)
+			} else {
+				param = t.In(fixed).Elem() // only variadic funcs get here
+			}
+			var arg RuntimeVal = fastNull()
+			if i < len(args) {
+				arg = args[i]
+			}
+			value := reflect.New(param).Elem()
+			if err := fromValue(arg, value, fmt.Sprintf("argument %d", i+1), nil); err != nil {
+				return nil, err
+			}
+			in = append(in, value)
+		}
+		out := fn.Call(in)
+		if n := len(out); n > 0 && t.Out(n-1) == errorType {
+			if !out[n-1].IsNil() {
+				return nil, asError(out[n-1].Interface().(error))
+			}
+			out = out[:n-1]
+		}
+		if len(out) == 0 {
+			return fastNull(), nil
+		}
+		return toValue(out[0], "result", nil)
+	}
+}
+
+// dymsFunction -> a Go func of type t calling the DYMS function fn: arguments are
+// converted to DYMS values and the result to t's first result. A DYMS error is returned
+// as t's error result; a func without one panics with it
+func dymsFunction(fn RuntimeVal, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		args := make([]RuntimeVal, 0, len(in))
+		var err *Error
+		for i := 0; i < len(in) && err == nil; i++ {
+			if t.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < in[i].Len() && err == nil; j++ {
+					var arg RuntimeVal
+					arg, err = toValue(in[i].Index(j), fmt.Sprintf("argument %d", i+j+1), nil)
+					args = append(args, arg)
+				}
+				break
+			}
+			var arg RuntimeVal
+			arg, err = toValue(in[i], fmt.Sprintf("argument %d", i+1), nil)
+			args = append(args, arg)
+		}
+		var res RuntimeVal
+		if err == nil {
+			res, err = callFromGo(fn, args)
+		}
+		if res == nil {
+			res = fastNull()
+		}
+
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.New(t.Out(i)).Elem()
+		}
+		hasErr := len(out) > 0 && t.Out(len(out)-1) == errorType
+		if err == nil && len(out) > 0 && !(hasErr && len(out) == 1) {
+			err = fromValue(res, out[0], "result", nil)
+		}
+		if err != nil {
+			if !hasErr {
+				panic(err)
+			}
+			out[len(out)-1].Set(reflect.ValueOf(err))
+		}
+		return out
+	})
+}
+
+// callFromGo -> calls the function value fn for Go code; compiled functions run in the
+// engine that compiled them
+func callFromGo(fn RuntimeVal, args []RuntimeVal) (RuntimeVal, *Error) {
+	return callValue(fn, args, nil, 0)
+}
+
+// naturalType -> Go type a value converts to when the target is any; nil for values
+// without one, which are stored as they are
+func naturalType(val RuntimeVal) reflect.Type {
+	switch val.(type) {
+	case *IntVal:
+		return reflect.TypeOf(int64(0))
+	case *NumberVal:
+		return reflect.TypeOf(float64(0))
+	case *StringVal:
+		return reflect.TypeOf("")
+	case *BooleanVal:
+		return reflect.TypeOf(false)
+	case *ArrayVal:
+		return reflect.TypeOf([]any(nil))
+	case *MapVal:
+		return reflect.TypeOf(map[string]any(nil))
+	case Function, *UserFunction, *VMFunction, *VMClosure:
+		return anyFuncType
+	}
+	return nil
+}
+
+// structField -> exported struct field and the map key it is stored under
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("dyms")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}
+
+// mapKey -> a Go map key as a DYMS map key; only strings and integers have one
+func mapKey(k reflect.Value) (string, bool) {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), true
+	}
+	return "", false
+}
+
+// setMapKey -> stores the DYMS map key name in the Go map key k
+func setMapKey(k reflect.Value, name, path string) *Error {
+	switch k.Kind() {
+	case reflect.String:
+		k.SetString(name)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, err := strconv.ParseInt(name, 10, 64); err == nil && !k.OverflowInt(i) {
+			k.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u, err := strconv.ParseUint(name, 10, 64); err == nil && !k.OverflowUint(u) {
+			k.SetUint(u)
+			return nil
+		}
+	}
+	return conversionError(path, fmt.Sprintf("cannot convert map key %q to %s", name, k.Type()))
+}
+
+// validResults -> t returns nothing, a value, an error, or a value and an error
+func validResults(t reflect.Type) bool {
+	switch t.NumOut() {
+	case 0, 1:
+		return true
+	case 2:
+		return t.Out(1) == errorType
+	}
+	return false
+}
+
+func nilable(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+// asError -> err as a DYMS error; a *Error passes through so its kind and stack survive
+func asError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return NewError(err.Error(), 0, 0)
+}
+
+// conversionError -> msg about the part of a value at path ("" for the whole value)
+func conversionError(path, msg string) *Error {
+	if path == "" {
+		return NewError(msg, 0, 0)
+	}
+	return NewError(strings.TrimPrefix(path, ".")+": "+msg, 0, 0)
+}
@@ -0,0 +1,291 @@
+package runtime_test
+
+import (
+	"DYMS/runtime"
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+type tagged struct {
+	Name    string  `dyms:"name"`
+	Label   string  `dyms:"label,omitempty"`
+	Secret  string  `dyms:"-"`
+	Score   float64 `dyms:"score"`
+	Tags    []string
+	Origin  *point `dyms:"origin,omitempty"`
+	private int
+}
+
+type node struct {
+	Value int
+	Next  *node
+}
+
+func TestToValue(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-5), "-5"},
+		{uint32(7), "7"},
+		{2.5, "2.5"},
+		{"hi", `"hi"`},
+		{(*point)(nil), "null"},
+		{[]int{1, 2}, "[1, 2]"},
+		{[2]string{"a", "b"}, `["a", "b"]`},
+		{map[int]bool{3: true}, `{"3": true}`},
+		{&point{1, 2}, `{"X": 1, "Y": 2}`},
+		{tagged{Name: "n", Secret: "s", Score: 1.5, Tags: []string{"t"}, private: 1}, `{"Tags": ["t"], "name": "n", "score": 1.5}`},
+		{tagged{Label: "l", Origin: &point{}}, `{"Tags": null, "label": "l", "name": "", "origin": {"X": 0, "Y": 0}, "score": 0}`},
+	}
+	for _, tt := range tests {
+		val, err := runtime.ToValue(tt.in)
+		if err != nil {
+			t.Errorf("ToValue(%#v): %v", tt.in, err)
+			continue
+		}
+		if got := runtime.Pretty(val); got != tt.want {
+			t.Errorf("ToValue(%#v) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	// integers stay integers; a uint64 too big for one becomes a number
+	if val, _ := runtime.ToValue(int64(math.MaxInt64)); val.Type() != runtime.IntegerType {
+		t.Errorf("ToValue(MaxInt64) is a %s", val.Type())
+	}
+	if val, _ := runtime.ToValue(uint64(math.MaxUint64)); val.Type() != runtime.NumberType {
+		t.Errorf("ToValue(MaxUint64) is a %s", val.Type())
+	}
+
+	for _, in := range []any{make(chan int), map[float64]int{1: 1}, []any{1, func(int) (int, int) { return 0, 0 }}} {
+		if _, err := runtime.ToValue(in); err == nil {
+			t.Errorf("ToValue(%T) succeeded", in)
+		}
+	}
+}
+
+func TestToValueCycles(t *testing.T) {
+	list := &node{Value: 1}
+	list.Next = &node{Value: 2, Next: list}
+	_, err := runtime.ToValue(list)
+	if err == nil || !strings.Contains(err.Error(), "Next.Next: cycle") {
+		t.Errorf("pointer cycle: %v", err)
+	}
+
+	m := map[string]any{}
+	m["self"] = m
+	if _, err := runtime.ToValue(m); err == nil || !strings.Contains(err.Error(), "self: cycle") {
+		t.Errorf("map cycle: %v", err)
+	}
+
+	s := []any{1, nil}
+	s[1] = s
+	if _, err := runtime.ToValue(s); err == nil || !strings.Contains(err.Error(), "[1]: cycle") {
+		t.Errorf("slice cycle: %v", err)
+	}
+
+	// a value reached twice without a cycle converts
+	shared := &point{1, 2}
+	val, err := runtime.ToValue([]*point{shared, shared})
+	if err != nil || runtime.Pretty(val) != `[{"X": 1, "Y": 2}, {"X": 1, "Y": 2}]` {
+		t.Errorf("shared pointer: %v, %v", val, err)
+	}
+}
+
+func TestFromValue(t *testing.T) {
+	in := tagged{Name: "n", Score: 2, Tags: []string{"a", "b"}, Origin: &point{3, 4}}
+	val, err := runtime.ToValue(in)
+	if err != nil {
+		t.Fatalf("ToValue: %v", err)
+	}
+	var out tagged
+	if err := runtime.FromValue(val, &out); err != nil {
+		t.Fatalf("FromValue: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	var natural any
+	arr, _ := runtime.ToValue([]any{int64(1), 1.5, "s", true, nil, map[string]any{"k": int64(2)}})
+	if err := runtime.FromValue(arr, &natural); err != nil {
+		t.Fatalf("FromValue into any: %v", err)
+	}
+	want := []any{int64(1), 1.5, "s", true, nil, map[string]any{"k": int64(2)}}
+	if !reflect.DeepEqual(natural, want) {
+		t.Errorf("FromValue into any = %#v, want %#v", natural, want)
+	}
+
+	var keyed map[int]string
+	if err := runtime.FromValue(&runtime.MapVal{Properties: map[string]runtime.RuntimeVal{"7": &runtime.StringVal{Value: "x"}}}, &keyed); err != nil || keyed[7] != "x" {
+		t.Errorf("FromValue into map[int]string = %v, %v", keyed, err)
+	}
+
+	n := 5
+	if err := runtime.FromValue(&runtime.NullVal{}, &n); err != nil || n != 0 {
+		t.Errorf("FromValue(null) = %d, %v; want the zero value", n, err)
+	}
+}
+
+func TestFromValueErrors(t *testing.T) {
+	big := &runtime.IntVal{Value: 300}
+	tests := []struct {
+		val    runtime.RuntimeVal
+		target any
+		want   string
+	}{
+		{big, new(int8), "300 overflows int8"},
+		{&runtime.IntVal{Value: -1}, new(uint), "-1 overflows uint"},
+		{&runtime.StringVal{Value: "x"}, new(int), "cannot convert String to int"},
+		{&runtime.ArrayVal{Elements: []runtime.RuntimeVal{big, big, big}}, new([2]int), "3 elements do not fit [2]int"},
+		{&runtime.MapVal{Properties: map[string]runtime.RuntimeVal{"k": big}}, new(map[int]int), `cannot convert map key "k" to int`},
+		{&runtime.ArrayVal{Elements: []runtime.RuntimeVal{&runtime.MapVal{Properties: map[string]runtime.RuntimeVal{"X": &runtime.StringVal{Value: "x"}}}}}, new([]point), "[0].X: cannot convert String to int"},
+	}
+	for _, tt := range tests {
+		err := runtime.FromValue(tt.val, tt.target)
+		if err == nil || err.Error() != "Runtime error: "+tt.want {
+			t.Errorf("FromValue(%s, %T) = %v, want %q", runtime.Pretty(tt.val), tt.target, err, tt.want)
+		}
+	}
+
+	var n int
+	if err := runtime.FromValue(big, n); err == nil {
+		t.Errorf("FromValue into a non-pointer succeeded")
+	}
+
+	// an array holding itself has no Go form
+	self := &runtime.ArrayVal{}
+	self.Elements = []runtime.RuntimeVal{self}
+	var nested []any
+	if err := runtime.FromValue(self, &nested); err == nil || !strings.Contains(err.Error(), "contains itself") {
+		t.Errorf("FromValue of a cyclic array: %v", err)
+	}
+}
+
+func TestGoFunctionsInScripts(t *testing.T) {
+	var out bytes.Buffer
+	engine, err := runtime.NewEngine(runtime.Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(name string, fn any) {
+		val, err := runtime.ToValue(fn)
+		if err != nil {
+			t.Fatalf("ToValue(%s): %v", name, err)
+		}
+		engine.Set(name, val)
+	}
+	set("add", func(a, b int) int { return a + b })
+	set("join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	set("check", func(n int) (int, error) {
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		return n, nil
+	})
+	set("origin", func() point { return point{} })
+
+	_, err = engine.Run(`
+println(add(2, 3))
+println(join("-", "a", "b", "c"))
+println(origin().X)
+try { check(-1) } catch (e) { println(e.message) }
+try { add("x", 1) } catch (e) { println(e.message) }
+try { add(1, 2, 3) } catch (e) { println(e.message) }`)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := "[println]: 5\n[println]: a-b-c\n[println]: 0\n[println]: negative\n" +
+		"[println]: argument 1: cannot convert String to int\n[println]: expected 2 arguments, got 3\n"
+	if got := out.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestScriptFunctionsInGo(t *testing.T) {
+	for mode, opts := range engineModes {
+		t.Run(mode, func(t *testing.T) {
+			engine, err := runtime.NewEngine(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = engine.Run(`
+funct scale(p, k) { return {"X": p.X * k, "Y": p.Y * k} }
+funct fail(msg) { throw msg }
+funct small(n) {
+  if (n > 100) { return n }
+}`)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			scaleVal, _ := engine.Get("scale")
+			failVal, _ := engine.Get("fail")
+
+			var scale func(point, int) (point, error)
+			if err := runtime.FromValue(scaleVal, &scale); err != nil {
+				t.Fatalf("FromValue(scale): %v", err)
+			}
+			if p, err := scale(point{1, 2}, 3); err != nil || p != (point{3, 6}) {
+				t.Errorf("scale = %v, %v", p, err)
+			}
+
+			var fail func(string) error
+			if err := runtime.FromValue(failVal, &fail); err != nil {
+				t.Fatalf("FromValue(fail): %v", err)
+			}
+			if err := fail("boom"); err == nil || !strings.Contains(err.Error(), "boom") {
+				t.Errorf("fail = %v", err)
+			}
+
+			// a function ending in an if that does not run returns null, the zero value
+			smallVal, _ := engine.Get("small")
+			var small func(int) (int, error)
+			if err := runtime.FromValue(smallVal, &small); err != nil {
+				t.Fatalf("FromValue(small): %v", err)
+			}
+			if n, err := small(1); err != nil || n != 0 {
+				t.Errorf("small(1) = %d, %v; want 0", n, err)
+			}
+			if n, err := small(500); err != nil || n != 500 {
+				t.Errorf("small(500) = %d, %v; want 500", n, err)
+			}
+			var smallAny func(...any) (any, error)
+			if err := runtime.FromValue(smallVal, &smallAny); err != nil {
+				t.Fatalf("FromValue(small) into a loose func: %v", err)
+			}
+			if res, err := smallAny(1); err != nil || res != nil {
+				t.Errorf("loose small(1) = %#v, %v; want nil", res, err)
+			}
+
+			var loose any
+			if err := runtime.FromValue(scaleVal, &loose); err != nil {
+				t.Fatalf("FromValue(scale) into any: %v", err)
+			}
+			res, err := loose.(func(...any) (any, error))(map[string]any{"X": 2, "Y": 0}, 2)
+			if err != nil || !reflect.DeepEqual(res, map[string]any{"X": int64(4), "Y": int64(0)}) {
+				t.Errorf("loose scale = %#v, %v", res, err)
+			}
+
+			var noErr func(string)
+			if err := runtime.FromValue(failVal, &noErr); err != nil {
+				t.Fatalf("FromValue(fail) without error: %v", err)
+			}
+			defer func() {
+				if recover() == nil {
+					t.Errorf("a func without an error result did not panic")
+				}
+			}()
+			noErr("boom")
+		})
+	}
+}
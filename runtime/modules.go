@@ -0,0 +1,55 @@
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Native modules. A Go package adds a module scripts can import by registering it,
+// usually from an init function:
+//
+//	func init() { runtime.RegisterModule("strings", stringsModule) }
+//
+// The module is built the first time a script running in an engine imports it, once per
+// engine, so members may keep per-engine state or write to the engine's Stdout.
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]func(*Engine) *MapVal{}
+)
+
+// RegisterModule -> makes name importable by engines created from now on, with members
+// built by build; registering a name twice panics, as a program linking two packages
+// that claim the same module is broken
+func RegisterModule(name string, build func(*Engine) *MapVal) {
+	if name == "" || build == nil {
+		panic("RegisterModule: module needs a name and a build function")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("RegisterModule: module %s registered twice", name))
+	}
+	registry[name] = build
+}
+
+// Modules -> names of the registered native modules, sorted
+func Modules() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registeredModule -> build function of the native module name
+func registeredModule(name string) (func(*Engine) *MapVal, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	build, ok := registry[name]
+	return build, ok
+}
@@ -0,0 +1,159 @@
+package runtime_test
+
+import (
+	"DYMS/runtime"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles -> creates files (path relative to a temp dir -> source) and returns the dir
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// runFile -> output and error of running dir/name on a new engine with opts
+func runFile(t *testing.T, opts runtime.Options, dir, name string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	opts.Stdout, opts.Stderr = &out, &out
+	engine, err := runtime.NewEngine(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.RunFile(filepath.Join(dir, name))
+	return out.String(), err
+}
+
+func TestFileModulesResolveFromTheImportingFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.dy":       "import \"./lib/shapes.dy\" as shapes\nprintln(shapes.area(3, 4), shapes.name)",
+		"lib/shapes.dy": "import \"../util/unit.dy\" as u\nlet hidden = 1\nexport const name = \"shapes\"\nexport funct area(w, h) { return w * h * u.unit * hidden }",
+		"util/unit.dy":  "export let unit = 2",
+	})
+	for mode, opts := range engineModes {
+		out, err := runFile(t, opts, dir, "main.dy")
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if out != "[println]: 24\n[println]: shapes\n" {
+			t.Errorf("%s: output %q", mode, out)
+		}
+	}
+
+	dir = writeFiles(t, map[string]string{
+		"main.dy": "import \"./lib.dy\" as l\nprintln(l.hidden)",
+		"lib.dy":  "let hidden = 1",
+	})
+	if _, err := runFile(t, runtime.Options{}, dir, "main.dy"); err == nil || !strings.Contains(err.Error(), "hidden") {
+		t.Errorf("reading a name the module did not export: %v", err)
+	}
+}
+
+func TestFileModulesRunOnce(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.dy":      "import \"./a.dy\" as a\nimport \"./b.dy\" as b\nimport \"./shared.dy\" as s\na.s.bump()\nb.s.bump()\nprintln(s.count())",
+		"a.dy":         "import \"./shared.dy\" as shared\nexport let s = shared",
+		"b.dy":         "import \"./sub/../shared.dy\" as shared\nexport let s = shared",
+		"shared.dy":    "println(\"loading shared\")\nexport var n = 0\nexport funct bump() { n++ }\nexport funct count() { return n }",
+		"counter.dy":   "import \"./shared.dy\" as s\ns.bump()\nprintln(s.n, s.count())\ns.n = 99\nprintln(s.n, s.count())",
+		"sub/empty.dy": "",
+	})
+	for mode, opts := range engineModes {
+		out, err := runFile(t, opts, dir, "main.dy")
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if out != "[println]: loading shared\n[println]: 2\n" {
+			t.Errorf("%s: output %q", mode, out)
+		}
+
+		// members are copies of the exports: bump changes the module's n, not s.n
+		out, err = runFile(t, opts, dir, "counter.dy")
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if want := "[println]: loading shared\n[println]: 0\n[println]: 1\n[println]: 99\n[println]: 1\n"; out != want {
+			t.Errorf("%s: output %q, want %q", mode, out, want)
+		}
+	}
+}
+
+func TestFileModuleCycles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.dy":     "import \"./b.dy\" as b",
+		"b.dy":     "import \"./a.dy\" as a",
+		"entry.dy": "println(\"entry runs\")\nimport \"./back.dy\" as back",
+		"back.dy":  "import \"./entry.dy\" as entry",
+		"self.dy":  "import \"./self.dy\" as me",
+	})
+	tests := []struct {
+		file, chain, out string
+	}{
+		{"a.dy", "a.dy -> b.dy -> a.dy", ""},
+		{"entry.dy", "entry.dy -> back.dy -> entry.dy", "[println]: entry runs\n"},
+		{"self.dy", "self.dy -> self.dy", ""},
+	}
+	for _, tt := range tests {
+		out, err := runFile(t, runtime.Options{}, dir, tt.file)
+		if out != tt.out {
+			t.Errorf("%s: output %q, want %q", tt.file, out, tt.out)
+		}
+		if err == nil {
+			t.Errorf("%s: no import cycle reported", tt.file)
+			continue
+		}
+		chain := strings.ReplaceAll(err.Error(), dir+string(filepath.Separator), "")
+		if !strings.Contains(chain, "import cycle: "+tt.chain) {
+			t.Errorf("%s: error %q, want the chain %s", tt.file, chain, tt.chain)
+		}
+	}
+}
+
+func TestFileModuleErrorTracebacks(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.dy":   "import \"./lib.dy\" as lib\nprintln(\"start\")\nlib.check(-1)",
+		"lib.dy":    "export funct check(n) {\n  if (n < 0) {\n    throw \"negative\"\n  }\n  return n\n}",
+		"broken.dy": "import \"./fails.dy\" as f",
+		"fails.dy":  "let x = 1\nlet y = missing + x",
+	})
+	for mode, opts := range engineModes {
+		_, err := runFile(t, opts, dir, "main.dy")
+		rerr, ok := err.(*runtime.Error)
+		if !ok {
+			t.Fatalf("%s: error %v", mode, err)
+		}
+		trace := strings.ReplaceAll(rerr.Traceback(), dir+string(filepath.Separator), "")
+		for _, frame := range []string{`File "main.dy", line 3, in <main>`, `File "lib.dy", line 3, in check`} {
+			if !strings.Contains(trace, frame) {
+				t.Errorf("%s: traceback lacks %s:\n%s", mode, frame, trace)
+			}
+		}
+
+		// an error while loading a module unwinds through the import
+		_, err = runFile(t, opts, dir, "broken.dy")
+		rerr, ok = err.(*runtime.Error)
+		if !ok {
+			t.Fatalf("%s: error %v", mode, err)
+		}
+		trace = strings.ReplaceAll(rerr.Traceback(), dir+string(filepath.Separator), "")
+		for _, frame := range []string{`File "broken.dy", line 1, in <main>`, `File "fails.dy", line 2, in <module>`, "missing"} {
+			if !strings.Contains(trace, frame) {
+				t.Errorf("%s: traceback lacks %s:\n%s", mode, frame, trace)
+			}
+		}
+	}
+}
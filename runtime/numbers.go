@@ -0,0 +1,337 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Number semantics. Integer literals, counters and indexes are *IntVal (int64), anything
+// written with a decimal point or computed with / is a *NumberVal (float64). Integers stay
+// integers under + - * % div and the bitwise operators; an operation with a float operand
+// gives a float, and so does + - * div << overflowing int64, so a result is never silently
+// wrapped. div and % floor, so a == (a div b) * b + a % b and a % b has the sign of b.
+// Bitwise operators take integers and floats holding an exact integer.
+
+func fastInt(v int64) *IntVal { return &IntVal{Value: v} }
+
+// toFloat -> value of a number or integer as a float; ok is false for anything else
+func toFloat(v RuntimeVal) (float64, bool) {
+	switch n := v.(type) {
+	case *NumberVal:
+		return n.Value, true
+	case *IntVal:
+		return float64(n.Value), true
+	}
+	return 0, false
+}
+
+// isNumeric -> a number or an integer
+func isNumeric(v RuntimeVal) bool {
+	switch v.(type) {
+	case *NumberVal, *IntVal:
+		return true
+	}
+	return false
+}
+
+// toInt -> value of an integer, or of a float holding an exact integer in int64 range
+func toInt(v RuntimeVal) (int64, bool) {
+	switch n := v.(type) {
+	case *IntVal:
+		return n.Value, true
+	case *NumberVal:
+		if n.Value == math.Trunc(n.Value) && n.Value >= -(1<<63) && n.Value < 1<<63 {
+			return int64(n.Value), true
+		}
+	}
+	return 0, false
+}
+
+// formatNumber -> a number as printed: integers in full, floats in their shortest form
+func formatNumber(v RuntimeVal) string {
+	if i, ok := v.(*IntVal); ok {
+		return strconv.FormatInt(i.Value, 10)
+	}
+	f, _ := toFloat(v)
+	return fmt.Sprintf("%v", f)
+}
+
+// isArithmetic -> operator numericOp implements
+func isArithmetic(op string) bool {
+	switch op {
+	case "+", "-", "*", "/", "%", "div", "&", "|", "^", "<<", ">>":
+		return true
+	}
+	return false
+}
+
+// numericOp -> arithmetic operator applied to two numbers or integers (error unlocated);
+// the one definition of number arithmetic, shared by every optimization that precomputes it
+func numericOp(op string, left, right RuntimeVal) (RuntimeVal, *Error) {
+	switch op {
+	case "&", "|", "^", "<<", ">>":
+		return bitwiseOp(op, left, right)
+	}
+	if l, ok := left.(*IntVal); ok {
+		if r, ok := right.(*IntVal); ok {
+			return intOp(op, l.Value, r.Value)
+		}
+	}
+	l, lok := toFloat(left)
+	r, rok := toFloat(right)
+	if !lok || !rok {
+		return nil, NewError(fmt.Sprintf("unknown operator %s for types %s and %s", op, left.Type(), right.Type()), 0, 0)
+	}
+	value, err := floatOp(op, l, r)
+	if err != nil {
+		return nil, err
+	}
+	return fastNumber(value), nil
+}
+
+// floatOp -> arithmetic operator applied to two floats
+func floatOp(op string, left, right float64) (float64, *Error) {
+	switch op {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/":
+		if right == 0 {
+			return 0, NewError("division by zero", 0, 0)
+		}
+		return left / right, nil
+	case "div":
+		if right == 0 {
+			return 0, NewError("division by zero", 0, 0)
+		}
+		return math.Floor(left / right), nil
+	case "%":
+		if right == 0 {
+			return 0, NewError("modulo by zero", 0, 0)
+		}
+		mod := math.Mod(left, right)
+		if mod == 0 {
+			return math.Copysign(0, right), nil
+		}
+		if (mod < 0) != (right < 0) {
+			mod += right
+		}
+		return mod, nil
+	}
+	return 0, NewError(fmt.Sprintf("unknown operator %s", op), 0, 0)
+}
+
+// intOp -> arithmetic operator applied to two integers; / and overflowing results are floats
+func intOp(op string, left, right int64) (RuntimeVal, *Error) {
+	switch op {
+	case "+":
+		sum := left + right
+		if (left >= 0) == (right >= 0) && (sum >= 0) != (left >= 0) {
+			return fastNumber(float64(left) + float64(right)), nil
+		}
+		return fastInt(sum), nil
+	case "-":
+		diff := left - right
+		if (left >= 0) != (right >= 0) && (diff >= 0) != (left >= 0) {
+			return fastNumber(float64(left) - float64(right)), nil
+		}
+		return fastInt(diff), nil
+	case "*":
+		if left == 0 || right == 0 {
+			return fastInt(0), nil
+		}
+		product := left * right
+		if product/right != left || (left == -1 && right == math.MinInt64) || (right == -1 && left == math.MinInt64) {
+			return fastNumber(float64(left) * float64(right)), nil
+		}
+		return fastInt(product), nil
+	case "/":
+		if right == 0 {
+			return nil, NewError("division by zero", 0, 0)
+		}
+		return fastNumber(float64(left) / float64(right)), nil
+	case "div":
+		if right == 0 {
+			return nil, NewError("division by zero", 0, 0)
+		}
+		if left == math.MinInt64 && right == -1 {
+			return fastNumber(-float64(left)), nil
+		}
+		quotient := left / right
+		if left%right != 0 && (left < 0) != (right < 0) {
+			quotient--
+		}
+		return fastInt(quotient), nil
+	case "%":
+		if right == 0 {
+			return nil, NewError("modulo by zero", 0, 0)
+		}
+		mod := left % right
+		if mod != 0 && (mod < 0) != (right < 0) {
+			mod += right
+		}
+		return fastInt(mod), nil
+	}
+	return nil, NewError(fmt.Sprintf("unknown operator %s", op), 0, 0)
+}
+
+// bitwiseOp -> & | ^ << >> on integers; shifts count in bits, >> keeps the sign and a <<
+// overflowing int64 gives a float, as * does
+func bitwiseOp(op string, left, right RuntimeVal) (RuntimeVal, *Error) {
+	l, ok := toInt(left)
+	if !ok {
+		return nil, bitwiseOperandError(op, left)
+	}
+	r, ok := toInt(right)
+	if !ok {
+		return nil, bitwiseOperandError(op, right)
+	}
+	switch op {
+	case "&":
+		return fastInt(l & r), nil
+	case "|":
+		return fastInt(l | r), nil
+	case "^":
+		return fastInt(l ^ r), nil
+	}
+	if r < 0 {
+		return nil, NewError(fmt.Sprintf("negative shift count %d", r), 0, 0)
+	}
+	if op == "<<" {
+		if l == 0 {
+			return fastInt(0), nil
+		}
+		if (l<<uint64(r))>>uint64(r) == l {
+			return fastInt(l << uint64(r)), nil
+		}
+		return fastNumber(math.Ldexp(float64(l), int(min(r, 1<<20)))), nil
+	}
+	return fastInt(l >> uint64(r)), nil
+}
+
+// bitwiseNot -> ~x on an integer
+func bitwiseNot(v RuntimeVal) (RuntimeVal, *Error) {
+	i, ok := toInt(v)
+	if !ok {
+		return nil, bitwiseOperandError("~", v)
+	}
+	return fastInt(^i), nil
+}
+
+func bitwiseOperandError(op string, v RuntimeVal) *Error {
+	if isNumeric(v) {
+		return NewError(fmt.Sprintf("bitwise %s requires integers, got %s", op, formatNumber(v)), 0, 0)
+	}
+	return NewError(fmt.Sprintf("bitwise %s requires integers, got %s", op, v.Type()), 0, 0)
+}
+
+// negate -> -x on a number or integer; -MinInt64 does not fit and becomes a float
+func negate(v RuntimeVal) (RuntimeVal, bool) {
+	switch n := v.(type) {
+	case *IntVal:
+		if n.Value == math.MinInt64 {
+			return fastNumber(-float64(n.Value)), true
+		}
+		return fastInt(-n.Value), true
+	case *NumberVal:
+		return fastNumber(-n.Value), true
+	}
+	return nil, false
+}
+
+// compareNumbers -> comparison operator applied to two numbers or integers; integers compare
+// exactly, anything else as floats. ok is false when either operand is not numeric
+func compareNumbers(op string, left, right RuntimeVal) (result bool, ok bool) {
+	if l, isInt := left.(*IntVal); isInt {
+		if r, isInt := right.(*IntVal); isInt {
+			switch op {
+			case "==":
+				return l.Value == r.Value, true
+			case "!=":
+				return l.Value != r.Value, true
+			case "<":
+				return l.Value < r.Value, true
+			case "<=":
+				return l.Value <= r.Value, true
+			case ">":
+				return l.Value > r.Value, true
+			case ">=":
+				return l.Value >= r.Value, true
+			}
+			return false, false
+		}
+	}
+	l, lok := toFloat(left)
+	r, rok := toFloat(right)
+	if !lok || !rok {
+		return false, false
+	}
+	switch op {
+	case "==":
+		return l == r, true
+	case "!=":
+		return l != r, true
+	case "<":
+		return l < r, true
+	case "<=":
+		return l <= r, true
+	case ">":
+		return l > r, true
+	case ">=":
+		return l >= r, true
+	}
+	return false, false
+}
+
+// rangeCounter -> successive values of a for range counter, from start toward end in steps,
+// stopping before end: integers when start and step are, floats otherwise. next reports
+// false once the counter is done; a counter that would overflow int64 is done too
+func rangeCounter(start, end, step RuntimeVal) (next func() (RuntimeVal, bool)) {
+	i, iok := start.(*IntVal)
+	s, sok := step.(*IntVal)
+	if iok && sok {
+		cur, by, first := i.Value, s.Value, true
+		endInt, endIsInt := end.(*IntVal)
+		endFloat, _ := toFloat(end)
+		return func() (RuntimeVal, bool) {
+			if !first {
+				moved := cur + by
+				if (moved > cur) != (by > 0) {
+					return nil, false
+				}
+				cur = moved
+			}
+			first = false
+			var more bool
+			if endIsInt {
+				more = (by > 0 && cur < endInt.Value) || (by < 0 && cur > endInt.Value)
+			} else {
+				more = (by > 0 && float64(cur) < endFloat) || (by < 0 && float64(cur) > endFloat)
+			}
+			if !more {
+				return nil, false
+			}
+			return fastInt(cur), true
+		}
+	}
+	cur, _ := toFloat(start)
+	by, _ := toFloat(step)
+	stop, _ := toFloat(end)
+	first := true
+	return func() (RuntimeVal, bool) {
+		value := start // the first value is start itself, integer or not
+		if !first {
+			cur += by
+			value = fastNumber(cur)
+		}
+		first = false
+		if (by > 0 && cur < stop) || (by < 0 && cur > stop) {
+			return value, true
+		}
+		return nil, false
+	}
+}
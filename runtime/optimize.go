@@ -0,0 +1,99 @@
+package runtime
+
+import "DYMS/ast"
+
+// Interpreter optimizations. Each replaces interpreting a construct with computing its
+// effect directly, and fires only once it has shown the effect is exactly what the
+// interpreter would produce: the same arithmetic (numericOp), counter values
+// (rangeCounter), assignments and errors.
+// Turning them off (SetOptimizations(false)) must never change a program's output.
+
+// summarizeRange -> runs a for range loop whose body is the single accumulation
+// `x = x op e` or `x op= e` without interpreting the body. It fires only when x is a
+// variable other than the loop's holding a number or integer and e reads nothing but numeric
+// literals and the loop variable, so no iteration has a side effect besides the running
+// total. The total is assigned once, as a new value, so aliases of the old one keep it.
+// An empty body is skipped outright. done is false when the loop still has to be
+// interpreted; nothing has changed then.
+func summarizeRange(stmt *ast.ForStatement, start, end, step RuntimeVal, scope *Environment) (bool, *Error) {
+	if len(stmt.Body.Statements) == 0 {
+		return true, nil
+	}
+	if len(stmt.Body.Statements) != 1 {
+		return false, nil
+	}
+	assign, ok := stmt.Body.Statements[0].(*ast.AssignmentExpr)
+	if !ok {
+		return false, nil
+	}
+	target, ok := assign.Assignee.(*ast.Identifier)
+	if !ok || target.Symbol == stmt.Identifier.Symbol {
+		return false, nil
+	}
+	op, term := assign.Operator, assign.Value
+	if op == "" {
+		bin, ok := assign.Value.(*ast.BinaryExpr)
+		if !ok {
+			return false, nil
+		}
+		if left, ok := bin.Left.(*ast.Identifier); !ok || left.Symbol != target.Symbol {
+			return false, nil
+		}
+		op, term = bin.Operator, bin.Right
+	}
+	if !isArithmetic(op) {
+		return false, nil
+	}
+	total, ran := scope.LookupVar(target.Symbol), false
+	if total == nil || !isNumeric(total) {
+		return false, nil
+	}
+
+	next := rangeCounter(start, end, step)
+	for i, more := next(); more; i, more = next() {
+		value, ok := pureValue(term, stmt.Identifier.Symbol, i)
+		if !ok {
+			// not pure, or an iteration fails: the interpreter raises the error in place
+			return false, nil
+		}
+		next, err := numericOp(op, total, value)
+		if err != nil {
+			return false, nil
+		}
+		total, ran = next, true
+	}
+	if !ran {
+		return true, nil
+	}
+	// a binding that cannot be assigned fails here as the first iteration would
+	_, err := assignNumber(scope, assign, target.Symbol, total)
+	return true, err
+}
+
+// pureValue -> e computed with the loop variable at i; ok is false for anything but
+// numeric literals, the loop variable and arithmetic on them, or when the arithmetic fails
+func pureValue(e ast.Expr, loopVar string, i RuntimeVal) (RuntimeVal, bool) {
+	switch n := e.(type) {
+	case *ast.NumericLiteral:
+		return fastNumber(n.Value), true
+	case *ast.IntegerLiteral:
+		return fastInt(n.Value), true
+	case *ast.Identifier:
+		return i, n.Symbol == loopVar
+	case *ast.BinaryExpr:
+		if !isArithmetic(n.Operator) {
+			return nil, false
+		}
+		left, ok := pureValue(n.Left, loopVar, i)
+		if !ok {
+			return nil, false
+		}
+		right, ok := pureValue(n.Right, loopVar, i)
+		if !ok {
+			return nil, false
+		}
+		value, err := numericOp(n.Operator, left, right)
+		return value, err == nil
+	}
+	return nil, false
+}
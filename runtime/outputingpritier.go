@@ -12,8 +12,8 @@ func Pretty(v RuntimeVal) string {
 		return "null"
 	}
 	switch t := v.(type) {
-	case *NumberVal:
-		return fmt.Sprintf("%v", t.Value)
+	case *NumberVal, *IntVal:
+		return formatNumber(t)
 	case *StringVal:
 		return fmt.Sprintf("\"%s\"", t.Value) // quote strings
 	case *BooleanVal:
@@ -52,8 +52,8 @@ func prettyML(v RuntimeVal, indent int) string {
 	switch t := v.(type) {
 	case nil:
 		return indentStr + "null"
-	case *NumberVal:
-		return indentStr + fmt.Sprintf("%v", t.Value)
+	case *NumberVal, *IntVal:
+		return indentStr + formatNumber(t)
 	case *StringVal:
 		return indentStr + fmt.Sprintf("\"%s\"", t.Value)
 	case *BooleanVal:
@@ -123,3 +123,67 @@ func Unescape(s string) string {
 func formatValue(v RuntimeVal) string {
 	return Pretty(v)
 }
+
+// printfArgs -> Go values for printf's arguments, each suited to the verb consuming it:
+// integer verbs take integers (floats truncated), float verbs floats, %s a number's
+// printed form; strings pass as text and anything else in its pretty form
+func printfArgs(format string, args []RuntimeVal) []interface{} {
+	verbs := printfVerbs(format)
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		verb := 'v'
+		if i < len(verbs) {
+			verb = verbs[i]
+		}
+		switch a := arg.(type) {
+		case *StringVal:
+			values[i] = a.Value
+		case *IntVal, *NumberVal:
+			values[i] = printfNumber(a, verb)
+		default:
+			values[i] = Pretty(arg)
+		}
+	}
+	return values
+}
+
+// printfNumber -> n as the Go value verb formats
+func printfNumber(n RuntimeVal, verb rune) interface{} {
+	f, _ := toFloat(n)
+	switch verb {
+	case 'd', 'b', 'o', 'O', 'x', 'X', 'c', 'U', '*':
+		if i, ok := n.(*IntVal); ok {
+			return i.Value
+		}
+		return int64(f)
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		return f
+	case 's', 'q':
+		return formatNumber(n)
+	}
+	if i, ok := n.(*IntVal); ok {
+		return i.Value
+	}
+	return f
+}
+
+// printfVerbs -> verb of each argument format consumes, in order; a * width or
+// precision consumes one of its own
+func printfVerbs(format string) []rune {
+	var verbs []rune
+	runes := []rune(format)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '%' {
+			continue
+		}
+		for i++; i < len(runes) && strings.ContainsRune("+-# 0123456789.*", runes[i]); i++ {
+			if runes[i] == '*' {
+				verbs = append(verbs, '*')
+			}
+		}
+		if i < len(runes) && runes[i] != '%' {
+			verbs = append(verbs, runes[i])
+		}
+	}
+	return verbs
+}
@@ -1,11 +1,16 @@
 package runtime
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
 
 type ValueType string
 
 const (
 	NumberType   ValueType = "Number"
+	IntegerType  ValueType = "Integer"
 	StringType   ValueType = "String"
 	BooleanType  ValueType = "Boolean"
 	ArrayType    ValueType = "Array"
@@ -15,6 +20,8 @@ const (
 	ReturnType   ValueType = "Return"
 	BreakType    ValueType = "Break"
 	ContinueType ValueType = "Continue"
+	ErrorType    ValueType = "Error"
+	IteratorType ValueType = "Iterator"
 )
 
 type RuntimeVal interface {
@@ -29,6 +36,14 @@ type NumberVal struct {
 func (n *NumberVal) Type() ValueType { return NumberType }
 func (n *NumberVal) String() string  { return fmt.Sprintf("%v", n.Value) }
 
+// Whole number held exactly; see numbers.go for how it mixes with NumberVal
+type IntVal struct {
+	Value int64
+}
+
+func (i *IntVal) Type() ValueType { return IntegerType }
+func (i *IntVal) String() string  { return strconv.FormatInt(i.Value, 10) }
+
 type StringVal struct {
 	Value string
 }
@@ -66,25 +81,67 @@ func (n *NullVal) String() string  { return "null" }
 
 // User-defined function
 type UserFunction struct {
+	Name   string
+	File   string
 	Params []string
 	Body   interface{} // kept generic to avoid import cycle
 	Env    *Environment
+	stats  *FunctionStats // tiering profile, set on its first call in tiered mode
 }
 
 func (u *UserFunction) Type() ValueType { return FunctionType }
 func (u *UserFunction) String() string  { return "[function]" }
 
+// frameName -> name shown for the function in stack traces
+func (u *UserFunction) frameName() string {
+	if u.Name == "" {
+		return "<anonymous>"
+	}
+	return u.Name
+}
+
 // VM-compiled function
 type VMFunction struct {
 	Name      string
+	File      string
 	Arity     int
 	Chunk     *Chunk
 	LocalsMax int
+	Captures  []Capture // how each upvalue is obtained when a closure is created
+	engine    *HybridEngine // engine that compiled it, whose VMs resolve its globals
 }
 
 func (v *VMFunction) Type() ValueType { return FunctionType }
 func (v *VMFunction) String() string  { return "[function]" }
 
+// Capture -> source of a closure's upvalue: a local slot of the enclosing
+// function (Local) or one of the enclosing function's own upvalues
+type Capture struct {
+	Local bool
+	Index int
+}
+
+// VM-compiled function together with the variables it captured
+type VMClosure struct {
+	Fn       *VMFunction
+	Upvalues []*upvalue
+}
+
+func (c *VMClosure) Type() ValueType { return FunctionType }
+func (c *VMClosure) String() string  { return "[function]" }
+
+// compiledBy -> engine that compiled a function value, nil when it is not compiled; a
+// call from another engine, or from Go, has to run it there
+func compiledBy(fn RuntimeVal) *HybridEngine {
+	switch f := fn.(type) {
+	case *VMFunction:
+		return f.engine
+	case *VMClosure:
+		return f.Fn.engine
+	}
+	return nil
+}
+
 // Return wrapper for call site unwinding
 type ReturnVal struct {
 	Inner RuntimeVal
@@ -94,13 +151,88 @@ func (r *ReturnVal) Type() ValueType { return ReturnType }
 func (r *ReturnVal) String() string  { return r.Inner.String() }
 
 // Break for loop control
-type BreakVal struct{}
+type BreakVal struct {
+	Label string // "" -> innermost loop or switch
+}
 
 func (b *BreakVal) Type() ValueType { return BreakType }
 func (b *BreakVal) String() string  { return "break" }
 
 // Continue for loop control
-type ContinueVal struct{}
+type ContinueVal struct {
+	Label string // "" -> innermost loop
+}
 
 func (c *ContinueVal) Type() ValueType { return ContinueType }
 func (c *ContinueVal) String() string  { return "continue" }
+
+// Caught error bound by catch(e)
+type ErrorVal struct {
+	Err   *Error
+	frame StackFrame // frame whose try caught Err; rethrowing unwinds it from there
+}
+
+func (e *ErrorVal) Type() ValueType { return ErrorType }
+func (e *ErrorVal) String() string  { return e.Err.Message }
+
+// Cursor of a for-in loop, never visible to scripts
+type IteratorVal struct {
+	items  []RuntimeVal // array elements or string characters
+	keys   []string     // sorted map keys
+	source *MapVal
+	pos    int
+}
+
+func (it *IteratorVal) Type() ValueType { return IteratorType }
+func (it *IteratorVal) String() string  { return "[iterator]" }
+
+// newIterator -> arrays by element, strings by character, maps by sorted key (error unlocated)
+func newIterator(coll RuntimeVal) (*IteratorVal, *Error) {
+	switch c := coll.(type) {
+	case *ArrayVal:
+		return &IteratorVal{items: c.Elements}, nil
+	case *StringVal:
+		chars := []rune(c.Value)
+		items := make([]RuntimeVal, len(chars))
+		for i, ch := range chars {
+			items[i] = &StringVal{Value: string(ch)}
+		}
+		return &IteratorVal{items: items}, nil
+	case *MapVal:
+		keys := make([]string, 0, len(c.Properties))
+		for k := range c.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return &IteratorVal{keys: keys, source: c}, nil
+	default:
+		return nil, NewError(fmt.Sprintf("cannot iterate over %s", coll.Type()), 0, 0)
+	}
+}
+
+// next -> index or key with its value; map keys removed during the loop are skipped
+func (it *IteratorVal) next() (key, value RuntimeVal, ok bool) {
+	if it.source != nil {
+		for it.pos < len(it.keys) {
+			name := it.keys[it.pos]
+			it.pos++
+			if val, found := it.source.Properties[name]; found {
+				return &StringVal{Value: name}, val, true
+			}
+		}
+		return nil, nil, false
+	}
+	if it.pos >= len(it.items) {
+		return nil, nil, false
+	}
+	it.pos++
+	return &IntVal{Value: int64(it.pos - 1)}, it.items[it.pos-1], true
+}
+
+// single -> what a one-variable loop binds: the key for maps, the value otherwise
+func (it *IteratorVal) single(key, value RuntimeVal) RuntimeVal {
+	if it.source != nil {
+		return key
+	}
+	return value
+}
@@ -3,13 +3,45 @@ package runtime
 import (
 	"DYMS/ast"
 	"fmt"
-	"math"
 )
 
 type frame struct {
-	fn   *VMFunction
-	ip   int
-	base int // base -> stack index for my locals
+	fn       *VMFunction
+	ip       int
+	base     int        // base -> stack index for my locals
+	upvalues []*upvalue // captured variables of a closure call
+}
+
+// upvalue -> variable captured by a closure: a live stack slot while it is open,
+// its own copy once the owning frame returns or the loop iteration ends
+type upvalue struct {
+	vm     *VM // whose stack the slot is in; a closure may be called on another VM
+	slot   int
+	open   bool
+	closed RuntimeVal
+}
+
+func (u *upvalue) get() RuntimeVal {
+	if u.open {
+		return u.vm.stack[u.slot]
+	}
+	return u.closed
+}
+
+func (u *upvalue) set(v RuntimeVal) {
+	if u.open {
+		u.vm.stack[u.slot] = v
+	} else {
+		u.closed = v
+	}
+}
+
+// handler -> installed try block: the frame owning it, the stack height to restore
+// and the ip its catch code starts at
+type handler struct {
+	frame int
+	sp    int
+	catch int
 }
 
 type VM struct {
@@ -17,6 +49,9 @@ type VM struct {
 	sp      int
 	frames  []frame
 	globals *Environment
+	openUpvalues []*upvalue // upvalues still pointing into the stack
+	handlers     []handler  // try blocks in effect, innermost last
+	entryLine    int        // caller's line for the entry frame, 0 for a program
 }
 
 // newvm -> pre-allocated stack
@@ -53,20 +88,167 @@ func (vm *VM) peek() RuntimeVal {
 }
 
 // fast ops -> common constants
-func (vm *VM) pushConst0() { vm.stack[vm.sp] = &NumberVal{Value: 0}; vm.sp++ }
-func (vm *VM) pushConst1() { vm.stack[vm.sp] = &NumberVal{Value: 1}; vm.sp++ }
-func (vm *VM) pushTrue()   { vm.stack[vm.sp] = &BooleanVal{Value: true}; vm.sp++ }
-func (vm *VM) pushFalse()  { vm.stack[vm.sp] = &BooleanVal{Value: false}; vm.sp++ }
-func (vm *VM) pushNull()   { vm.stack[vm.sp] = &NullVal{}; vm.sp++ }
-
-// callfunction -> expect args on stack
-func (vm *VM) callFunction(fn *VMFunction, argc int) {
-	vm.frames = append(vm.frames, frame{fn: fn, ip: 0, base: vm.sp - argc})
+func (vm *VM) pushConst0() { vm.push(&IntVal{Value: 0}) }
+func (vm *VM) pushConst1() { vm.push(&IntVal{Value: 1}) }
+func (vm *VM) pushTrue()   { vm.push(&BooleanVal{Value: true}) }
+func (vm *VM) pushFalse()  { vm.push(&BooleanVal{Value: false}) }
+func (vm *VM) pushNull()   { vm.push(&NullVal{}) }
+
+// maxCallDepth -> calls a program may nest, on the VM's frames or in the interpreter,
+// before the next one raises a stack overflow error
+const maxCallDepth = 10000
+
+// stackOverflow -> error for a call past maxCallDepth; a try block can catch it
+func stackOverflow() *Error {
+	return NewError(fmt.Sprintf("stack overflow: more than %d nested calls", maxCallDepth), 0, 0)
+}
+
+// callfunction -> expect args on stack; missing args become null, extra ones are
+// dropped, and the rest of the frame is reserved for locals
+func (vm *VM) callFunction(fn *VMFunction, argc int, upvalues []*upvalue) *Error {
+	// the entry frame is not a nested call, or was counted by the engine that made it
+	depth := len(vm.frames) - 1
+	if vm.globals.engine != nil {
+		depth += vm.globals.engine.depth
+	}
+	if depth >= maxCallDepth {
+		return stackOverflow()
+	}
+	for ; argc > fn.Arity; argc-- {
+		vm.pop()
+	}
+	base := vm.sp - argc
+	for vm.sp < base+fn.LocalsMax {
+		vm.push(&NullVal{})
+	}
+	vm.frames = append(vm.frames, frame{fn: fn, ip: 0, base: base, upvalues: upvalues})
+	return nil
+}
+
+// callForeign -> calls the function on the stack compiled by another engine (a module's)
+// on that engine, whose VMs resolve its globals
+func (vm *VM) callForeign(owner *HybridEngine, callee RuntimeVal, argc int, line int) *Error {
+	args := make([]RuntimeVal, argc)
+	for i := argc - 1; i >= 0; i-- {
+		args[i] = vm.pop()
+	}
+	vm.pop()
+	res, err := owner.callCompiled(callee, args, line)
+	if err != nil {
+		return err
+	}
+	vm.push(res)
+	return nil
+}
+
+// captureUpvalue -> the open upvalue for a stack slot, shared by every closure capturing it
+func (vm *VM) captureUpvalue(slot int) *upvalue {
+	for _, u := range vm.openUpvalues {
+		if u.slot == slot {
+			return u
+		}
+	}
+	u := &upvalue{vm: vm, slot: slot, open: true}
+	vm.openUpvalues = append(vm.openUpvalues, u)
+	return u
+}
+
+// closeUpvalues -> copies the values of open upvalues at or above slot off the stack
+func (vm *VM) closeUpvalues(from int) {
+	kept := vm.openUpvalues[:0]
+	for _, u := range vm.openUpvalues {
+		if u.slot >= from {
+			u.closed, u.open = vm.stack[u.slot], false
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	vm.openUpvalues = kept
 }
 
 func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
-	vm.callFunction(entry, 0)
+	return vm.Call(entry, nil, 0)
+}
+
+// Call -> runs a compiled function or closure with args to completion; line is where
+// the caller called it, recorded in the traceback of an error escaping it
+func (vm *VM) Call(callee RuntimeVal, args []RuntimeVal, line int) (RuntimeVal, *Error) {
+	switch f := callee.(type) {
+	case *VMFunction:
+		for _, arg := range args {
+			vm.push(arg)
+		}
+		vm.callFunction(f, len(args), nil) // a VM starts with no frames, far from the limit
+	case *VMClosure:
+		for _, arg := range args {
+			vm.push(arg)
+		}
+		vm.callFunction(f.Fn, len(args), f.Upvalues)
+	default:
+		return nil, NewError(fmt.Sprintf("not a function: %T", callee), 0, 0)
+	}
+	vm.entryLine = line
+	for {
+		res, err := vm.run()
+		if err == nil || !vm.raise(err) {
+			return res, err
+		}
+	}
+}
+
+// raise -> locates err at the failing instruction and unwinds it to the innermost
+// handler, which resumes at its catch code with the error on the stack; false when
+// nothing catches it and every frame has been unwound
+func (vm *VM) raise(err *Error) bool {
+	if len(vm.frames) == 0 {
+		return false
+	}
+	// the failing instruction is the one just decoded in the top frame
+	fr := &vm.frames[len(vm.frames)-1]
+	pos := fr.fn.Chunk.position(fr.ip - 1)
+	err.at(pos.Line, pos.Column)
+
+	floor := -1
+	if len(vm.handlers) > 0 {
+		floor = vm.handlers[len(vm.handlers)-1].frame
+	}
+	// every frame above the handler's is a call the error unwinds through
+	for i := len(vm.frames) - 1; i > floor; i-- {
+		callLine := vm.entryLine
+		if i > 0 {
+			caller := &vm.frames[i-1]
+			callLine = caller.fn.Chunk.position(caller.ip - 1).Line
+		}
+		err.unwind(vm.frames[i].fn.Name, vm.frames[i].fn.File, callLine)
+	}
+	if floor < 0 {
+		vm.closeUpvalues(0)
+		for vm.sp > 0 {
+			vm.pop()
+		}
+		vm.frames = vm.frames[:0]
+		return false
+	}
+
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	vm.closeUpvalues(h.sp)
+	for vm.sp > h.sp {
+		vm.pop()
+	}
+	vm.frames = vm.frames[:h.frame+1]
+	vm.frames[h.frame].ip = h.catch
+	caught := vm.frames[h.frame].fn
+	line := err.Line
+	if len(err.Stack) > 0 {
+		line = err.callLine
+	}
+	vm.push(&ErrorVal{Err: err, frame: StackFrame{Function: caught.Name, File: caught.File, Line: line}})
+	return true
+}
 
+// run -> executes until the entry frame returns or an instruction fails
+func (vm *VM) run() (RuntimeVal, *Error) {
 	for len(vm.frames) > 0 {
 		fr := &vm.frames[len(vm.frames)-1]
 		code := fr.fn.Chunk.Code
@@ -89,16 +271,25 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 			nameIdx := code[fr.ip]
 			fr.ip++
 			name := consts[nameIdx].(*StringVal).Value
-			vm.push(vm.globals.LookupVar(name))
+			val := vm.globals.LookupVar(name)
+			if val == nil {
+				return nil, NewError(fmt.Sprintf("undefined variable: %s", name), 0, 0)
+			}
+			vm.push(val)
 		case OP_STORE_GLOBAL:
 			nameIdx := code[fr.ip]
 			fr.ip++
 			name := consts[nameIdx].(*StringVal).Value
-			val := vm.pop()
-			if _, ok := vm.globals.variables[name]; ok {
-				vm.globals.variables[name] = val
-			} else {
-				vm.globals.DeclareVar(name, val, false)
+			if _, err := vm.globals.AssignVar(name, vm.pop()); err != nil {
+				return nil, err
+			}
+		case OP_DEFINE_GLOBAL:
+			nameIdx, kindIdx := code[fr.ip], code[fr.ip+1]
+			fr.ip += 2
+			name := consts[nameIdx].(*StringVal).Value
+			kind := ast.DeclKind(consts[kindIdx].(*StringVal).Value)
+			if _, err := vm.globals.DeclareVar(name, vm.pop(), kind); err != nil {
+				return nil, err
 			}
 		case OP_LOAD_LOCAL:
 			slot := code[fr.ip]
@@ -108,12 +299,12 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 			slot := code[fr.ip]
 			fr.ip++
 			vm.stack[fr.base+int(slot)] = vm.peek()
-		case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD:
+		case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_IDIV, OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_SHL, OP_SHR:
 			r := vm.pop()
 			l := vm.pop()
 			ln, lok := l.(*NumberVal)
 			rn, rok := r.(*NumberVal)
-			if lok && rok {
+			if lok && rok && op <= OP_DIV { // + - * / on floats
 				switch op {
 				case OP_ADD:
 					vm.push(&NumberVal{Value: ln.Value + rn.Value})
@@ -126,28 +317,31 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 						return nil, NewError("division by zero", 0, 0)
 					}
 					vm.push(&NumberVal{Value: ln.Value / rn.Value})
-				case OP_MOD:
-					if rn.Value == 0 {
-						return nil, NewError("modulo by zero", 0, 0)
-					}
-					vm.push(&NumberVal{Value: float64(int(ln.Value) % int(rn.Value))})
 				}
 				break
 			}
-			if op == OP_ADD {
-				if ls, ok := l.(*StringVal); ok {
-					vm.push(&StringVal{Value: ls.Value + r.String()})
-					break
-				}
-				if rs, ok := r.(*StringVal); ok {
-					vm.push(&StringVal{Value: l.String() + rs.Value})
+			if li, ok := l.(*IntVal); ok {
+				if ri, ok := r.(*IntVal); ok && op <= OP_MUL { // + - * on integers
+					res, _ := intOp(binaryOperators[op], li.Value, ri.Value)
+					vm.push(res)
 					break
 				}
 			}
-			return nil, NewError(fmt.Sprintf("unsupported operands for op: %s", op.String()), 0, 0)
+			res, err := binaryOp(binaryOperators[op], l, r)
+			if err != nil {
+				return nil, err
+			}
+			vm.push(res)
 		case OP_CMP_EQ, OP_CMP_NE, OP_CMP_LT, OP_CMP_LE, OP_CMP_GT, OP_CMP_GE:
 			r := vm.pop()
 			l := vm.pop()
+			if li, ok := l.(*IntVal); ok {
+				if ri, ok := r.(*IntVal); ok {
+					result, _ := compareNumbers(binaryOperators[op], li, ri)
+					vm.push(&BooleanVal{Value: result})
+					break
+				}
+			}
 			ln, lok := l.(*NumberVal)
 			rn, rok := r.(*NumberVal)
 			if lok && rok {
@@ -167,26 +361,58 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 				}
 				break
 			}
-			if ls, ok := l.(*StringVal); ok {
-				if rs, ok := r.(*StringVal); ok {
-					if op == OP_CMP_EQ {
-						vm.push(&BooleanVal{Value: ls.Value == rs.Value})
-					} else if op == OP_CMP_NE {
-						vm.push(&BooleanVal{Value: ls.Value != rs.Value})
-					} else {
-						return nil, NewError("unsupported string comparison", 0, 0)
-					}
-					break
-				}
+			res, err := binaryOp(binaryOperators[op], l, r)
+			if err != nil {
+				return nil, err
 			}
-			return nil, NewError("unsupported comparison", 0, 0)
+			vm.push(res)
 		case OP_JUMP:
 			fr.ip = int(code[fr.ip])
+		case OP_AND, OP_OR:
+			addr := int(code[fr.ip])
+			fr.ip++
+			if isTruthy(vm.peek()) == (op == OP_OR) {
+				fr.ip = addr
+			} else {
+				vm.pop()
+			}
+		case OP_NULLISH, OP_JUMP_IF_NULL:
+			addr := int(code[fr.ip])
+			fr.ip++
+			_, isNull := vm.peek().(*NullVal)
+			if isNull == (op == OP_JUMP_IF_NULL) {
+				fr.ip = addr
+			} else if op == OP_NULLISH {
+				vm.pop()
+			}
+		case OP_NOT:
+			vm.push(&BooleanVal{Value: !isTruthy(vm.pop())})
+		case OP_NEGATE, OP_UNARY_PLUS:
+			val := vm.pop()
+			if !isNumeric(val) {
+				operator := "-"
+				if op == OP_UNARY_PLUS {
+					operator = "+"
+				}
+				return nil, NewError(fmt.Sprintf("unary %s requires a number, got %s", operator, val.Type()), 0, 0)
+			}
+			if op == OP_NEGATE {
+				val, _ = negate(val)
+			}
+			vm.push(val)
+		case OP_BIT_NOT:
+			res, err := bitwiseNot(vm.pop())
+			if err != nil {
+				return nil, err
+			}
+			vm.push(res)
+		case OP_SWITCH:
+			table := fr.fn.Chunk.Tables[code[fr.ip]]
+			fr.ip = table.target(vm.pop())
 		case OP_JUMP_IF_FALSE:
 			addr := int(code[fr.ip])
 			fr.ip++
-			cond := vm.pop()
-			if b, ok := cond.(*BooleanVal); ok && !b.Value {
+			if !isTruthy(vm.pop()) {
 				fr.ip = addr
 			}
 		case OP_CALL:
@@ -204,61 +430,141 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 				if err != nil {
 					return nil, err
 				}
+				if res == nil {
+					res = &NullVal{}
+				}
 				vm.push(res)
 		case *VMFunction:
-				vm.callFunction(f, argc)
+				if f.engine != nil && f.engine != vm.globals.engine {
+					if err := vm.callForeign(f.engine, f, argc, fr.fn.Chunk.position(fr.ip-1).Line); err != nil {
+						return nil, err
+					}
+					break
+				}
+				if err := vm.callFunction(f, argc, nil); err != nil {
+					return nil, err
+				}
+		case *VMClosure:
+				if f.Fn.engine != nil && f.Fn.engine != vm.globals.engine {
+					if err := vm.callForeign(f.Fn.engine, f, argc, fr.fn.Chunk.position(fr.ip-1).Line); err != nil {
+						return nil, err
+					}
+					break
+				}
+				if err := vm.callFunction(f.Fn, argc, f.Upvalues); err != nil {
+					return nil, err
+				}
 		case *UserFunction:
+				// a function tiered up to the VM runs in this frame stack when it
+				// resolves its globals the same way
+				if stats := f.stats; stats != nil && stats.PreferVM && f.Env == vm.globals {
+					stats.CallCount++
+					if err := vm.callFunction(stats.compiled, argc, nil); err != nil {
+						return nil, err
+					}
+					break
+				}
 				// Call interpreter function from VM
 				args := make([]RuntimeVal, argc)
 				for i := argc - 1; i >= 0; i-- {
 					args[i] = vm.pop()
 				}
 				vm.pop()
-				res, err := vm.callInterpreterFunction(f, args)
+				res, err := invokeUserFunction(f, args, fr.fn.Chunk.position(fr.ip-1).Line)
 				if err != nil {
 					return nil, err
 				}
 				vm.push(res)
 		default:
-				return nil, NewError("not a function", 0, 0)
+				return nil, NewError(fmt.Sprintf("not a function: %T", callee), 0, 0)
 			}
 		case OP_RET:
 			retVal := vm.pop()
 			frame := vm.frames[len(vm.frames)-1]
+			vm.closeUpvalues(frame.base)
+			// a return from inside a try block leaves its handlers behind
+			for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].frame >= len(vm.frames)-1 {
+				vm.handlers = vm.handlers[:len(vm.handlers)-1]
+			}
 			vm.frames = vm.frames[:len(vm.frames)-1]
 			if len(vm.frames) == 0 {
+				for vm.sp > frame.base {
+					vm.pop()
+				}
 				return retVal, nil
 			}
+			for i := frame.base - 1; i < vm.sp; i++ {
+				vm.stack[i] = nil // drop callee slots
+			}
 			vm.sp = frame.base - 1
-			vm.stack = vm.stack[:vm.sp]
 			vm.push(retVal)
 		case OP_POP:
 			_ = vm.pop()
+		case OP_CLOSURE:
+			fn := consts[code[fr.ip]].(*VMFunction)
+			fr.ip++
+			upvalues := make([]*upvalue, len(fn.Captures))
+			for i, capture := range fn.Captures {
+				if capture.Local {
+					upvalues[i] = vm.captureUpvalue(fr.base + capture.Index)
+				} else {
+					upvalues[i] = fr.upvalues[capture.Index]
+				}
+			}
+			vm.push(&VMClosure{Fn: fn, Upvalues: upvalues})
+		case OP_LOAD_UPVALUE:
+			vm.push(fr.upvalues[code[fr.ip]].get())
+			fr.ip++
+		case OP_STORE_UPVALUE:
+			fr.upvalues[code[fr.ip]].set(vm.peek())
+			fr.ip++
+		case OP_CLOSE_UPVALUES:
+			if len(vm.openUpvalues) > 0 {
+				vm.closeUpvalues(fr.base + code[fr.ip])
+			}
+			fr.ip++
+		case OP_TRY:
+			vm.handlers = append(vm.handlers, handler{frame: len(vm.frames) - 1, sp: vm.sp, catch: code[fr.ip]})
+			fr.ip++
+		case OP_END_TRY:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case OP_THROW:
+			return nil, thrownError(vm.pop())
+		case OP_FAIL:
+			msgIdx := code[fr.ip]
+			fr.ip++
+			return nil, NewError(consts[msgIdx].(*StringVal).Value, 0, 0)
 		case OP_GET_PROP:
 			nameIdx := code[fr.ip]
 			fr.ip++
 			name := consts[nameIdx].(*StringVal).Value
-			obj := vm.pop()
-			if m, ok := obj.(*MapVal); ok {
-				if val, ok := m.Properties[name]; ok {
-					vm.push(val)
-					break
-				}
-				return nil, NewError("unknown property: "+name, 0, 0)
+			val, err := evalMember(vm.pop(), name)
+			if err != nil {
+				return nil, err
+			}
+			vm.push(val)
+		case OP_SET_PROP:
+			nameIdx := code[fr.ip]
+			fr.ip++
+			name := consts[nameIdx].(*StringVal).Value
+			val := vm.pop()
+			if err := setMember(vm.pop(), name, val); err != nil {
+				return nil, err
 			}
-			return nil, NewError(fmt.Sprintf("cannot get property '%s' on %s", name, obj.Type()), 0, 0)
+			vm.push(val)
 		case OP_IMPORT:
 			aliasIdx := code[fr.ip]
 			pathIdx := code[fr.ip+1]
 			fr.ip += 2
 			alias := consts[aliasIdx].(*StringVal).Value
 			path := consts[pathIdx].(*StringVal).Value
-			mods := builtinModules()
-			mod, ok := mods[path]
-			if !ok {
-				return nil, NewError("unknown module: "+path, 0, 0)
+			mod, err := vm.globals.module(path, fr.fn.File, fr.fn.Chunk.position(fr.ip-1).Line)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := vm.globals.DeclareVar(alias, mod, ast.ConstDecl); err != nil {
+				return nil, err
 			}
-			vm.globals.DeclareVar(alias, mod, true)
 
 		// fast opcodes ->
 		case OP_LOAD_CONST_0:
@@ -273,6 +579,9 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 			vm.pushNull()
 
 		// stack opcodes ->
+		case OP_DUP2:
+			vm.push(vm.stack[vm.sp-2])
+			vm.push(vm.stack[vm.sp-2])
 		case OP_DUP:
 			val := vm.peek()
 			vm.push(val)
@@ -286,19 +595,30 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 		case OP_INCREMENT_LOCAL:
 			slot := code[fr.ip]
 			fr.ip++
-			if num, ok := vm.stack[fr.base+int(slot)].(*NumberVal); ok {
-				vm.stack[fr.base+int(slot)] = &NumberVal{Value: num.Value + 1}
+			if num := vm.stack[fr.base+int(slot)]; isNumeric(num) {
+				vm.stack[fr.base+int(slot)], _ = numericOp("+", num, &IntVal{Value: 1})
 			} else {
-				return nil, NewError("cannot increment non-number", 0, 0)
+				return nil, NewError("increment/decrement requires numeric variable", 0, 0)
 			}
 		case OP_DECREMENT_LOCAL:
 			slot := code[fr.ip]
 			fr.ip++
-			if num, ok := vm.stack[fr.base+int(slot)].(*NumberVal); ok {
-				vm.stack[fr.base+int(slot)] = &NumberVal{Value: num.Value - 1}
+			if num := vm.stack[fr.base+int(slot)]; isNumeric(num) {
+				vm.stack[fr.base+int(slot)], _ = numericOp("-", num, &IntVal{Value: 1})
 			} else {
-				return nil, NewError("cannot decrement non-number", 0, 0)
+				return nil, NewError("increment/decrement requires numeric variable", 0, 0)
 			}
+		case OP_INCREMENT, OP_DECREMENT:
+			num := vm.pop()
+			if !isNumeric(num) {
+				return nil, NewError("increment/decrement requires numeric variable", 0, 0)
+			}
+			operator := "+"
+			if op == OP_DECREMENT {
+				operator = "-"
+			}
+			res, _ := numericOp(operator, num, &IntVal{Value: 1})
+			vm.push(res)
 
 		// string opcodes ->
 		case OP_CONCAT_2:
@@ -326,114 +646,87 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 		case OP_MAKE_MAP:
 			n := code[fr.ip] // n -> key-value pairs
 			fr.ip++
-			props := make(map[string]RuntimeVal)
-			for i := 0; i < int(n); i++ {
-				value := vm.pop()
-				key := vm.pop()
-				if keyStr, ok := key.(*StringVal); ok {
-					props[keyStr.Value] = value
-				} else {
-					return nil, NewError("map keys must be strings", 0, 0)
+			props := make(map[string]RuntimeVal, n)
+			// pairs in source order so a repeated key keeps its last value
+			first := vm.sp - 2*n
+			for i := first; i < vm.sp; i += 2 {
+				keyStr, ok := vm.stack[i].(*StringVal)
+				if !ok {
+					return nil, NewError(fmt.Sprintf("map key must be a string, got %s", vm.stack[i].Type()), 0, 0)
 				}
+				props[keyStr.Value] = vm.stack[i+1]
+			}
+			for vm.sp > first {
+				vm.pop()
 			}
 			vm.push(&MapVal{Properties: props})
+		case OP_GET_INDEX:
+			idx := vm.pop()
+			obj := vm.pop()
+			val, err := evalIndex(obj, idx)
+			if err != nil {
+				return nil, err
+			}
+			vm.push(val)
+		case OP_SET_INDEX:
+			val := vm.pop()
+			idx := vm.pop()
+			obj := vm.pop()
+			if err := setIndex(obj, idx, val); err != nil {
+				return nil, err
+			}
+			vm.push(val)
 
 		// for loop ->
 		case OP_FOR_LOOP_NEXT:
 			slot := code[fr.ip]
 			fr.ip++
 			// for_loop_next -> get counter & limit
-			counter, ok1 := vm.stack[fr.base+int(slot)].(*NumberVal)
-			limit, ok2 := vm.peek().(*NumberVal)
-			if !ok1 || !ok2 {
+			counter := vm.stack[fr.base+int(slot)]
+			below, ok := compareNumbers("<", counter, vm.peek())
+			if !ok {
 				return nil, NewError("for loop requires numeric values", 0, 0)
 			}
 			// -> check counter < limit
-			vm.push(&BooleanVal{Value: counter.Value < limit.Value})
+			vm.push(&BooleanVal{Value: below})
 			// -> increment counter
-			vm.stack[fr.base+int(slot)] = &NumberVal{Value: counter.Value + 1}
-
-		// math opcodes ->
-		case OP_POW:
-			y := vm.pop()
-			x := vm.pop()
-			xn, ok1 := x.(*NumberVal)
-			yn, ok2 := y.(*NumberVal)
-			if !ok1 || !ok2 {
-				return nil, NewError("pow requires numeric arguments", 0, 0)
-			}
-			result := math.Pow(xn.Value, yn.Value)
-			vm.push(&NumberVal{Value: result})
-
-		case OP_SQRT:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("sqrt requires numeric argument", 0, 0)
-			}
-			if xn.Value < 0 {
-				return nil, NewError("sqrt of negative number", 0, 0)
-			}
-			vm.push(&NumberVal{Value: math.Sqrt(xn.Value)})
-
-		case OP_SIN:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("sin requires numeric argument", 0, 0)
-			}
-			vm.push(&NumberVal{Value: math.Sin(xn.Value)})
-
-		case OP_COS:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("cos requires numeric argument", 0, 0)
-			}
-			vm.push(&NumberVal{Value: math.Cos(xn.Value)})
-
-		case OP_LOG:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("log requires numeric argument", 0, 0)
-			}
-			if xn.Value <= 0 {
-				return nil, NewError("log of non-positive number", 0, 0)
-			}
-			vm.push(&NumberVal{Value: math.Log(xn.Value)})
-
-		case OP_EXP:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("exp requires numeric argument", 0, 0)
-			}
-			vm.push(&NumberVal{Value: math.Exp(xn.Value)})
-
-		case OP_ABS:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("abs requires numeric argument", 0, 0)
-			}
-			vm.push(&NumberVal{Value: math.Abs(xn.Value)})
-
-		case OP_FLOOR:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
-			if !ok {
-				return nil, NewError("floor requires numeric argument", 0, 0)
+			vm.stack[fr.base+int(slot)], _ = numericOp("+", counter, &IntVal{Value: 1})
+		case OP_FOR_RANGE_CHECK:
+			exit := code[fr.ip]
+			counter := vm.stack[fr.base+code[fr.ip+1]]
+			end := vm.stack[fr.base+code[fr.ip+2]]
+			step, ok := toFloat(vm.stack[fr.base+code[fr.ip+3]])
+			fr.ip += 4
+			if !ok || !isNumeric(counter) || !isNumeric(end) {
+				return nil, NewError("for loop range must be a number", 0, 0)
+			}
+			if step == 0 {
+				return nil, NewError("for range step cannot be 0", 0, 0)
+			}
+			below, _ := compareNumbers("<", counter, end)
+			above, _ := compareNumbers(">", counter, end)
+			if !((step > 0 && below) || (step < 0 && above)) {
+				fr.ip = exit
+			}
+		case OP_ITER:
+			it, err := newIterator(vm.pop())
+			if err != nil {
+				return nil, err
 			}
-			vm.push(&NumberVal{Value: math.Floor(xn.Value)})
-
-		case OP_CEIL:
-			x := vm.pop()
-			xn, ok := x.(*NumberVal)
+			vm.push(it)
+		case OP_ITER_NEXT:
+			exit, slot, pair := code[fr.ip], code[fr.ip+1], code[fr.ip+2]
+			fr.ip += 3
+			it := vm.stack[fr.base+slot].(*IteratorVal)
+			key, value, ok := it.next()
 			if !ok {
-				return nil, NewError("ceil requires numeric argument", 0, 0)
+				fr.ip = exit
+			} else if pair == 1 {
+				vm.push(key)
+				vm.push(value)
+			} else {
+				vm.push(it.single(key, value))
 			}
-			vm.push(&NumberVal{Value: math.Ceil(xn.Value)})
 
 		default:
 			return nil, NewError("unknown opcode", 0, 0)
@@ -445,110 +738,6 @@ func (vm *VM) Run(entry *VMFunction) (RuntimeVal, *Error) {
 	return &NullVal{}, nil
 }
 
-// Call interpreter function from VM context
-func (vm *VM) callInterpreterFunction(uf *UserFunction, args []RuntimeVal) (RuntimeVal, *Error) {
-	// Create call environment
-	callEnv := NewEnvironment(uf.Env)
-	for idx, name := range uf.Params {
-		var val RuntimeVal
-		if idx < len(args) {
-			val = args[idx]
-		} else {
-			val = fastNull()
-		}
-		callEnv.DeclareVar(name, val, false)
-	}
-	
-	// Execute function body in interpreter
-	res, err := evalBlockStatement(uf.Body.(*ast.BlockStatement), callEnv)
-	if err != nil {
-		return nil, err
-	}
-	if rv, ok := res.(*ReturnVal); ok {
-		return rv.Inner, nil
-	}
-	return res, nil
-}
-
-// Call VM function from interpreter context
-func (vm *VM) callVMFunction(vmFunc *VMFunction, args []RuntimeVal) (RuntimeVal, *Error) {
-	// Push arguments to VM stack
-	for _, arg := range args {
-		vm.push(arg)
-	}
-	
-	// Execute VM function
-	vm.callFunction(vmFunc, len(args))
-	
-	// Run VM until completion
-	for len(vm.frames) > 0 {
-		fr := &vm.frames[len(vm.frames)-1]
-		code := fr.fn.Chunk.Code
-		consts := fr.fn.Chunk.Consts
-		if fr.ip >= len(code) {
-			vm.frames = vm.frames[:len(vm.frames)-1]
-			if len(vm.frames) == 0 {
-				break
-			}
-			continue
-		}
-		op := OpCode(code[fr.ip])
-		fr.ip++
-		
-		switch op {
-		case OP_RET:
-			retVal := vm.pop()
-			frame := vm.frames[len(vm.frames)-1]
-			vm.frames = vm.frames[:len(vm.frames)-1]
-			if len(vm.frames) == 0 {
-				return retVal, nil
-			}
-			vm.sp = frame.base - 1
-			vm.push(retVal)
-		default:
-			// Execute other opcodes using main VM loop logic
-			fr.ip-- // Reset IP for main loop
-			result, err := vm.executeOpcode(op, code, consts, fr)
-			if err != nil {
-				return nil, err
-			}
-			if result != nil {
-				return result, nil
-			}
-		}
-	}
-	
-	if vm.sp > 0 {
-		return vm.pop(), nil
-	}
-	return fastNull(), nil
-}
-
-// Execute single opcode (extracted from main Run loop)
-func (vm *VM) executeOpcode(op OpCode, code []int, consts []RuntimeVal, fr *frame) (RuntimeVal, *Error) {
-	// This is a simplified version - in practice you'd extract the full switch from Run()
-	switch op {
-	case OP_CONST:
-		idx := code[fr.ip]
-		fr.ip++
-		vm.push(consts[idx])
-	case OP_ADD:
-		r := vm.pop()
-		l := vm.pop()
-		if ln, ok1 := l.(*NumberVal); ok1 {
-			if rn, ok2 := r.(*NumberVal); ok2 {
-				vm.push(fastNumber(ln.Value + rn.Value))
-				return nil, nil
-			}
-		}
-		return nil, NewError("unsupported add operation", 0, 0)
-	case OP_RET:
-		retVal := vm.pop()
-		return retVal, nil
-	}
-	return nil, nil
-}
-
 func (op OpCode) String() string {
 	switch op {
 	case OP_CONST:
@@ -571,6 +760,18 @@ func (op OpCode) String() string {
 		return "DIV"
 	case OP_MOD:
 		return "MOD"
+	case OP_IDIV:
+		return "IDIV"
+	case OP_BIT_AND:
+		return "BIT_AND"
+	case OP_BIT_OR:
+		return "BIT_OR"
+	case OP_BIT_XOR:
+		return "BIT_XOR"
+	case OP_SHL:
+		return "SHL"
+	case OP_SHR:
+		return "SHR"
 	case OP_CMP_EQ:
 		return "CMP_EQ"
 	case OP_CMP_NE:
@@ -595,8 +796,30 @@ func (op OpCode) String() string {
 		return "POP"
 	case OP_GET_PROP:
 		return "GET_PROP"
+	case OP_SET_PROP:
+		return "SET_PROP"
 	case OP_IMPORT:
 		return "IMPORT"
+	case OP_THROW:
+		return "THROW"
+	case OP_DEFINE_GLOBAL:
+		return "DEFINE_GLOBAL"
+	case OP_SWITCH:
+		return "SWITCH"
+	case OP_CLOSURE:
+		return "CLOSURE"
+	case OP_LOAD_UPVALUE:
+		return "LOAD_UPVALUE"
+	case OP_STORE_UPVALUE:
+		return "STORE_UPVALUE"
+	case OP_CLOSE_UPVALUES:
+		return "CLOSE_UPVALUES"
+	case OP_TRY:
+		return "TRY"
+	case OP_END_TRY:
+		return "END_TRY"
+	case OP_FAIL:
+		return "FAIL"
 	// fast opcodes ->
 	case OP_LOAD_CONST_0:
 		return "LOAD_CONST_0"
@@ -612,10 +835,16 @@ func (op OpCode) String() string {
 		return "DUP"
 	case OP_SWAP:
 		return "SWAP"
+	case OP_DUP2:
+		return "DUP2"
 	case OP_INCREMENT_LOCAL:
 		return "INCREMENT_LOCAL"
 	case OP_DECREMENT_LOCAL:
 		return "DECREMENT_LOCAL"
+	case OP_INCREMENT:
+		return "INCREMENT"
+	case OP_DECREMENT:
+		return "DECREMENT"
 	case OP_CONCAT_2:
 		return "CONCAT_2"
 	case OP_CONCAT_N:
@@ -624,27 +853,35 @@ func (op OpCode) String() string {
 		return "MAKE_ARRAY"
 	case OP_MAKE_MAP:
 		return "MAKE_MAP"
+	case OP_GET_INDEX:
+		return "GET_INDEX"
+	case OP_SET_INDEX:
+		return "SET_INDEX"
 	case OP_FOR_LOOP_NEXT:
 		return "FOR_LOOP_NEXT"
+	case OP_FOR_RANGE_CHECK:
+		return "FOR_RANGE_CHECK"
+	case OP_ITER:
+		return "ITER"
+	case OP_ITER_NEXT:
+		return "ITER_NEXT"
 	// math opcodes ->
-	case OP_POW:
-		return "POW"
-	case OP_SQRT:
-		return "SQRT"
-	case OP_SIN:
-		return "SIN"
-	case OP_COS:
-		return "COS"
-	case OP_LOG:
-		return "LOG"
-	case OP_EXP:
-		return "EXP"
-	case OP_ABS:
-		return "ABS"
-	case OP_FLOOR:
-		return "FLOOR"
-	case OP_CEIL:
-		return "CEIL"
+	case OP_NOT:
+		return "NOT"
+	case OP_AND:
+		return "AND"
+	case OP_OR:
+		return "OR"
+	case OP_NULLISH:
+		return "NULLISH"
+	case OP_JUMP_IF_NULL:
+		return "JUMP_IF_NULL"
+	case OP_NEGATE:
+		return "NEGATE"
+	case OP_BIT_NOT:
+		return "BIT_NOT"
+	case OP_UNARY_PLUS:
+		return "UNARY_PLUS"
 	default:
 		return "?"
 	}